@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/auth"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/config"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/forwarder"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/preflight"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// checkSettings are the settings verified by the check command.
+type checkSettings struct {
+	directorsConfig string
+	subscriptionID  string
+	tokenAudience   string
+
+	// director holds the single director flags. Its CA cert fields hold
+	// the paths of the certs rather than their contents.
+	director config.Director
+
+	metronPort int
+	metronCA   string
+	metronCert string
+	metronKey  string
+
+	timeout time.Duration
+}
+
+// runCheck verifies the configuration of the forwarder step by step and
+// prints a report to w. It returns the exit code of the check command.
+func runCheck(w io.Writer, s checkSettings) int {
+	r := preflight.NewReport(w)
+
+	for _, d := range loadCheckDirectors(r, s) {
+		checkDirector(r, d, s.tokenAudience, s.timeout)
+	}
+	checkMetron(r, s)
+
+	r.Summary()
+	if r.Failed() > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+// loadCheckDirectors returns the directors to check. Directors whose
+// settings cannot be loaded are reported and left out.
+func loadCheckDirectors(r *preflight.Report, s checkSettings) []config.Director {
+	if s.directorsConfig != "" {
+		var directors []config.Director
+		r.Run("directors config", func() (string, error) {
+			var err error
+			directors, err = config.LoadDirectors(s.directorsConfig, s.subscriptionID)
+			return fmt.Sprintf("%d director(s)", len(directors)), err
+		})
+		return directors
+	}
+
+	d := s.director
+	ok := r.Run("client credentials", func() (string, error) {
+		if d.ClientIdentity == "" || d.ClientSecret == "" {
+			return "", errors.New("--auth-client-identity and --auth-client-secret are required")
+		}
+		return d.ClientIdentity, nil
+	})
+
+	for _, f := range []struct {
+		name string
+		path *string
+	}{
+		{"director ca", &d.CACert},
+		{"metrics server ca", &d.MetricsServerCACert},
+	} {
+		ok = r.Run(f.name+" file", func() (string, error) {
+			b, err := os.ReadFile(*f.path)
+			*f.path = string(b)
+			return "", err
+		}) && ok
+	}
+
+	if !ok {
+		return nil
+	}
+
+	return []config.Director{d}
+}
+
+func checkDirector(r *preflight.Report, d config.Director, tokenAudience string, timeout time.Duration) {
+	prefix := ""
+	if d.Name != "" {
+		prefix = d.Name + ": "
+	}
+	now := time.Now()
+
+	directorTLSConf := &tls.Config{}
+	addressProvider := auth.NewAddressProvider(d.URL, directorTLSConf)
+	checkInfo := func() (string, error) {
+		err := addressProvider.Refresh()
+		if err != nil {
+			return "", err
+		}
+		info := addressProvider.Info()
+		return fmt.Sprintf("%s %s, uaa %s", info.Name, info.Version, strings.Join(addressProvider.Addrs(), ", ")), nil
+	}
+
+	var token string
+	checkToken := func() (string, error) {
+		var err error
+		authClient, err := forwarder.NewAuth(addressProvider, d, directorTLSConf)
+		if err != nil {
+			return "", err
+		}
+		token, err = authClient.Token()
+		if err != nil {
+			return "", err
+		}
+
+		claims, err := auth.ParseClaims(token)
+		if errors.Is(err, auth.ErrNotJWT) {
+			return "opaque token, scopes not checked", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		err = claims.Validate(auth.Requirements{Scope: auth.SystemMetricsScope, Audience: tokenAudience}, now)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("scopes %s, expires %s", strings.Join(claims.Scopes, ","), claims.Expiry().Format(time.RFC3339)), nil
+	}
+
+	tokenOK := false
+	switch {
+	case !r.Run(prefix+"director ca", func() (string, error) {
+		detail, err := preflight.CACerts(d.CACert, now)
+		if err != nil {
+			return "", err
+		}
+		return detail, forwarder.SetCACert(directorTLSConf, d.CACert)
+	}):
+		r.Skip(prefix+"director info", "director ca is invalid")
+		r.Skip(prefix+"uaa token", "director ca is invalid")
+	case !r.Run(prefix+"director info", checkInfo):
+		r.Skip(prefix+"uaa token", "director info is unavailable")
+	default:
+		tokenOK = r.Run(prefix+"uaa token", checkToken)
+	}
+
+	serverTLSConf := &tls.Config{ServerName: d.MetricsServerCN}
+	caOK := r.Run(prefix+"metrics server ca", func() (string, error) {
+		detail, err := preflight.CACerts(d.MetricsServerCACert, now)
+		if err != nil {
+			return "", err
+		}
+		return detail, forwarder.SetCACert(serverTLSConf, d.MetricsServerCACert)
+	})
+
+	addrs, err := forwarder.MetricsServerAddrs(d.MetricsServerAddr, d.MetricsServerResolve)
+	if err != nil {
+		r.Run(prefix+"metrics server addr", func() (string, error) { return "", err })
+		return
+	}
+
+	for _, addr := range addrs {
+		name := fmt.Sprintf("%smetrics server stream %s", prefix, addr)
+		switch {
+		case !tokenOK:
+			r.Skip(name, "no uaa token")
+		case !caOK:
+			r.Skip(name, "metrics server ca is invalid")
+		default:
+			r.Run(name, func() (string, error) {
+				return checkMetricsServer(addr, serverTLSConf, token, d.SubscriptionID+"-check", timeout)
+			})
+		}
+	}
+}
+
+// checkMetricsServer opens and closes a stream to the metrics server at
+// addr. A stream that is not rejected within the timeout passes even if
+// no event was received.
+func checkMetricsServer(addr string, c *tls.Config, token, subscriptionID string, timeout time.Duration) (string, error) {
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(credentials.NewTLS(c)))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	ctx := metadata.NewOutgoingContext(context.Background(), metadata.Pairs("authorization", token))
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	stream, err := definitions.NewEgressClient(conn).BoshMetrics(ctx, &definitions.EgressRequest{
+		SubscriptionId: subscriptionID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	_, err = stream.Recv()
+	if status.Code(err) == codes.DeadlineExceeded {
+		return fmt.Sprintf("stream open, no event within %s", timeout), nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return "event received", nil
+}
+
+func checkMetron(r *preflight.Report, s checkSettings) {
+	now := time.Now()
+
+	var caPEM string
+	caOK := r.Run("metron ca", func() (string, error) {
+		b, err := os.ReadFile(s.metronCA)
+		if err != nil {
+			return "", err
+		}
+		caPEM = string(b)
+		return preflight.CACerts(caPEM, now)
+	})
+
+	certOK := r.Run("metron cert", func() (string, error) {
+		return preflight.KeyPair(s.metronCert, s.metronKey, now)
+	})
+
+	name := fmt.Sprintf("metron sender localhost:%d", s.metronPort)
+	if !caOK || !certOK {
+		r.Skip(name, "metron certs are invalid")
+		return
+	}
+
+	r.Run(name, func() (string, error) {
+		client, closeConn, err := forwarder.NewMetronClient(s.metronPort, caPEM, s.metronCert, s.metronKey)
+		if err != nil {
+			return "", err
+		}
+		defer closeConn()
+
+		ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+		defer cancel()
+
+		sender, err := client.Sender(ctx, grpc.WaitForReady(true))
+		if err != nil {
+			return "", err
+		}
+		_, err = sender.CloseAndRecv()
+
+		return "", err
+	})
+}
@@ -1,179 +1,367 @@
 package main
 
 import (
-	"crypto/tls"
-	"crypto/x509"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"time"
 
-	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/auth"
-	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/definitions"
-	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/egress"
-	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/ingress"
-	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/loggregator_v2"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/admin"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/config"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/enrichment"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/forwarder"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/logging"
 	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/mapper"
-	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/monitor"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
-	"google.golang.org/grpc/keepalive"
 )
 
+// logger is the logger of the process. It discards everything until the
+// flags are parsed.
+var logger = logging.Discard()
+
+// Exit codes of the forwarder command. It exits with 0 once it was
+// stopped by a signal and drained its queue.
+const (
+	// exitFailure means a component failed while forwarding.
+	exitFailure = 1
+	// exitUsage means the command or its flags are invalid.
+	exitUsage = 2
+	// exitConfig means the forwarder could not be set up from its
+	// configuration.
+	exitConfig = 3
+)
+
+// fatal logs msg as an error and exits because of an invalid
+// configuration.
+func fatal(msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(exitConfig)
+}
+
+// usage describes the commands of the forwarder.
+const usage = `Usage: %s [command] [flags]
+
+Commands:
+  (none)  forward the metrics of the directors to metron
+  check   verify the configuration and connectivity and exit non-zero on failure
+  tail    print the events of the directors, see tail -h for its flags
+
+Flags:
+`
+
 func main() {
 	directorURL := flag.String("director-url", "", "The url of the bosh director")
 	directorCA := flag.String("director-ca", "", "The CA cert path for the bosh director")
 
 	clientIdentity := flag.String("auth-client-identity", "", "The UAA client identity which has access to bosh system metrics")
 	clientSecret := flag.String("auth-client-secret", "", "The UAA client password")
+	clientAuthMethod := flag.String("auth-client-auth-method", "client_secret_post", "How the UAA client authenticates at the token endpoint. Either client_secret_post to send the credentials in the form or client_secret_basic to send them in the Authorization header")
+	refreshToken := flag.String("auth-refresh-token", "", "A UAA refresh token to retrieve tokens with instead of the client credentials grant")
+	validateToken := flag.Bool("auth-validate-token", true, "Whether to check the expiry and scopes of the UAA tokens before subscribing with them, opaque tokens are not checked")
+	tokenAudience := flag.String("auth-token-audience", "", "The audience the UAA tokens must be issued for. Empty accepts any audience")
+	uaaURLTTL := flag.Duration("auth-uaa-url-ttl", 10*time.Minute, "How long the UAA urls advertised by the director are used before they are discovered again. 0 caches them until the director info is refreshed")
+	verifyTokenSignature := flag.Bool("auth-verify-token-signature", false, "Whether to verify the UAA tokens against the token keys of the UAA")
 
 	metronPort := flag.Int("metron-port", 3458, "The GRPC port to inject metrics to")
 	metronCA := flag.String("metron-ca", "", "The CA cert path for metron")
 	metronCert := flag.String("metron-cert", "", "The cert path for metron")
 	metronKey := flag.String("metron-key", "", "The key path for metron")
 
-	metricsServerAddr := flag.String("metrics-server-addr", "", "The host and port of the metrics server")
+	metricsServerAddr := flag.String("metrics-server-addr", "", "The host and port of the metrics server. Accepts a comma separated list to fail over between")
+	metricsServerResolve := flag.Bool("metrics-server-resolve", false, "Resolve the metrics server hosts and fail over between all of their addresses")
+	metricsServerPreferPrimary := flag.Bool("metrics-server-prefer-primary", false, "Move back to the first metrics server addr once it recovers")
 	metricsCA := flag.String("metrics-ca", "", "The CA cert path for the metrics server")
 	metricsCN := flag.String("metrics-cn", "", "The common name for the metrics server")
 
+	streamIdleTimeout := flag.Duration("stream-idle-timeout", 2*time.Minute, "How long the metrics server stream may go without events before it is reestablished")
+
+	drainTimeout := flag.Duration("drain-timeout", 15*time.Second, "How long queued envelopes are drained to metron on shutdown. 0 waits until they are drained")
+
 	subscriptionID := flag.String("subscription-id", "bosh-system-metrics-forwarder", "The subscription id to use for the metrics server")
 
 	envelopeIpTag := flag.String("envelope-ip-tag", "", "The ip address to tag loggregator envelopes with")
+	unitModeName := flag.String("unit-mode", "compat", "The units of the forwarded metrics. Either compat to keep the units of previous releases or base to convert to base units such as bytes")
+	directorInfoTags := flag.Bool("director-info-tags", false, "Tag loggregator envelopes with the director_name, director_uuid and bosh_version reported by the director")
+	directorInfoRefresh := flag.Duration("director-info-refresh-interval", 5*time.Minute, "How often the director info is refreshed")
+	instanceMetadataTags := flag.Bool("instance-metadata-tags", false, "Tag loggregator envelopes with the az, vm cid, stemcell and ips of the instance as known by the director")
+	instanceMetadataRefresh := flag.Duration("instance-metadata-refresh-interval", 5*time.Minute, "How often the instances are fetched from the director")
+	staticTagsConfig := flag.String("static-tags-config", "", "The path to a json file of rules mapping deployments and jobs to additional envelope tags. Reloaded on SIGHUP")
 
-	healthPort := flag.Int("health-port", 0, "The port for the localhost health endpoint")
-	pprofPort := flag.Int("pprof-port", 0, "The port for the localhost pprof endpoint")
+	dedupWindow := flag.Duration("dedup-window", 0, "How long received events are remembered to drop duplicates delivered after reconnects. 0 disables deduplication")
+	dedupGapThreshold := flag.Duration("dedup-gap-threshold", 90*time.Second, "The time between the heartbeats of an instance above which a gap is counted. Gaps are counted per director and deployment")
 
-	flag.Parse()
+	filterConfig := flag.String("filter-config", "", "The path to a json file of allow and deny rules deciding which heartbeat metrics are forwarded")
 
-	validateCredentials(*clientIdentity, *clientSecret)
+	deploymentRateLimit := flag.Float64("deployment-rate-limit", 0, "The maximum events per second forwarded for each deployment. 0 disables the limit")
+	deploymentRateBurst := flag.Int("deployment-rate-burst", 100, "The burst of events allowed above the deployment rate limit")
+	instanceRateLimit := flag.Float64("instance-rate-limit", 0, "The maximum events per second forwarded for each instance. 0 disables the limit")
+	instanceRateBurst := flag.Int("instance-rate-burst", 10, "The burst of events allowed above the instance rate limit")
+	maxMetricNames := flag.Int("max-metric-names-per-deployment", 0, "The maximum distinct metric names forwarded for each deployment. 0 disables the limit")
+	maxTagValues := flag.Int("max-tag-values-per-deployment", 0, "The maximum distinct values of each metric tag forwarded for each deployment, the job and instance id are not capped. 0 disables the limit")
 
-	directorTLSConf := &tls.Config{}
-	err := setCACert(directorTLSConf, *directorCA)
-	if err != nil {
-		log.Fatal(err)
-	}
+	aggregateInterval := flag.Duration("aggregate-interval", 0, "How often deployment and job rollups are emitted. 0 disables rollups")
+	aggregateMetrics := flag.String("aggregate-metrics", "system.cpu.user,system.mem.percent,system.disk.persistent.percent", "Comma separated list of heartbeat metrics to emit min, avg and max rollups for")
+	aggregateSourceID := flag.String("aggregate-source-id", "bosh-system-metrics-aggregator", "The source id of the rollup envelopes")
 
-	addressProvider := auth.NewAddressProvider(*directorURL, directorTLSConf)
-	authClient := auth.New(addressProvider, *clientIdentity, *clientSecret, directorTLSConf)
+	livenessMissedIntervals := flag.Int("liveness-missed-intervals", 0, "The number of heartbeat intervals an instance may miss before it is reported missing. 0 disables liveness tracking")
+	livenessHeartbeatInterval := flag.Duration("liveness-heartbeat-interval", 30*time.Second, "The interval at which instances are expected to send heartbeats")
+	livenessForgetAfter := flag.Duration("liveness-forget-after", time.Hour, "How long an instance is tracked after its last heartbeat")
 
-	messages := make(chan *loggregator_v2.Envelope, 1024)
+	alertConfig := flag.String("alert-config", "", "The path to a json file of threshold rules that emit alert events when they fire or resolve")
+	alertForgetAfter := flag.Duration("alert-forget-after", time.Hour, "How long the alert state of an instance is kept after its last heartbeat. Firing alerts of forgotten instances are resolved")
+	alertLog := flag.Bool("alert-log", false, "Log a line whenever an alert rule fires or resolves")
 
-	// server setup (ingress)
-	logger := log.New(os.Stderr, "", log.LstdFlags)
-	serverClient, serverConnClose := setupConnToMetricsServer(*metricsServerAddr, *metricsCN, *metricsCA)
-	i := ingress.New(serverClient, mapper.New(*envelopeIpTag), messages, authClient, *subscriptionID, logger)
+	diskPrediction := flag.Bool("disk-prediction", false, "Emit the predicted time until each disk and its inodes are full")
+	diskPredictionWindow := flag.Duration("disk-prediction-window", time.Hour, "How much disk usage history the prediction is based on")
+	diskPredictionMinSamples := flag.Int("disk-prediction-min-samples", 5, "The number of samples in the window required before a prediction is made")
 
-	// metron setup (egress)
-	metronClient, metronConnClose := setupConnToMetron(*metronPort, *metronCA, *metronCert, *metronKey)
-	e := egress.New(metronClient, messages)
+	shardIndex := flag.Int("shard-index", 0, "The index of this forwarder among the forwarders sharing the deployments")
+	shardTotal := flag.Int("shard-total", 1, "The number of forwarders sharing the deployments. 1 disables sharding")
+	shardStandby := flag.Bool("shard-standby", false, "Allow taking over the shards of peers that are down through the /shards endpoint of the health port, which must be enabled")
 
-	ingressStop := i.Start()
-	egressStop := e.Start()
+	tapEnabled := flag.Bool("tap", false, "Stream the events being forwarded and their envelopes as server-sent events on /tap of the health endpoint")
+	tapMaxRate := flag.Float64("tap-max-rate", 10, "The maximum number of records per second streamed to each tap client")
 
-	go monitor.NewHealth(uint32(*healthPort)).Start()
-	go monitor.NewProfiler(uint32(*pprofPort)).Start()
+	directorsConfig := flag.String("directors-config", "", "The path to a json file listing the directors to forward metrics from. Overrides the single director flags")
 
-	defer func() {
-		fmt.Println("process shutting down, stop accepting messages from system metrics server...")
-		serverConnClose()
-		ingressStop()
+	healthPort := flag.Int("health-port", 0, "The port for the localhost health endpoint. 0 disables the endpoint")
+	pprofPort := flag.Int("pprof-port", 0, "The port for the localhost pprof endpoint. 0 disables the endpoint")
+	adminPort := flag.Int("admin-port", 0, "The port for the localhost admin api to inspect the forwarder, change the log level and pause forwarding. 0 disables the api")
 
-		close(messages)
+	logFormat := flag.String("log-format", "logfmt", "The format of the logs. Either logfmt or json")
+	logLevel := flag.String("log-level", "info", "The minimum level of the logs. One of debug, info, warn or error")
+	logRepeatInterval := flag.Duration("log-repeat-interval", time.Minute, "How often a repeated warning or error is logged. 0 logs every repeat")
 
-		fmt.Println("drain remaining messages...")
-		egressStop()
-		metronConnClose()
+	checkTimeout := flag.Duration("check-timeout", 10*time.Second, "How long the check command waits for each connection")
 
-		fmt.Println("DONE")
-	}()
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), usage, os.Args[0])
+		flag.PrintDefaults()
+	}
 
-	killSignal := make(chan os.Signal, 1)
-	signal.Notify(killSignal, syscall.SIGINT, syscall.SIGTERM)
-	<-killSignal
-}
+	command, args := "", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
 
-func validateCredentials(id, secret string) {
-	if id == "" || secret == "" {
-		log.Fatalf("UAA System Metrics Client Credentials are required. Please see Bosh System Metrics Forwarder configuration")
+	var tailOpts tailSettings
+	if command == "tail" {
+		tailFlags(&tailOpts).Parse(args)
+	} else {
+		flag.CommandLine.Parse(args)
 	}
-}
 
-func setupConnToMetron(metronPort int, metronCA, metronCert, metronKey string) (loggregator_v2.IngressClient, func() error) {
-	c, err := newTLSConfig(metronCA, metronCert, metronKey, "metron")
+	var level slog.LevelVar
+	err := level.UnmarshalText([]byte(*logLevel))
 	if err != nil {
-		log.Fatalf("unable to read tls certs: %s", err)
+		fmt.Fprintf(os.Stderr, "invalid log level %q\n", *logLevel)
+		os.Exit(exitUsage)
 	}
-	metronConn, err := grpc.NewClient(
-		fmt.Sprintf("localhost:%d", metronPort),
-		grpc.WithTransportCredentials(credentials.NewTLS(c)),
-	)
+	logger, err = logging.New(os.Stderr, *logFormat, &level, *logRepeatInterval)
 	if err != nil {
-		log.Fatalf("did not connect: %v", err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitUsage)
 	}
-	return loggregator_v2.NewIngressClient(metronConn), metronConn.Close
-}
 
-func setupConnToMetricsServer(addr, cn, ca string) (definitions.EgressClient, func() error) {
-	serverTLSConf := &tls.Config{
-		ServerName: cn,
+	switch command {
+	case "", "tail":
+	case "check":
+		os.Exit(runCheck(os.Stdout, checkSettings{
+			directorsConfig: *directorsConfig,
+			subscriptionID:  *subscriptionID,
+			tokenAudience:   *tokenAudience,
+			director: config.Director{
+				URL:                 *directorURL,
+				CACert:              *directorCA,
+				ClientIdentity:      *clientIdentity,
+				ClientSecret:        *clientSecret,
+				ClientAuthMethod:    *clientAuthMethod,
+				RefreshToken:        *refreshToken,
+				MetricsServerAddr:   *metricsServerAddr,
+				MetricsServerCACert: *metricsCA,
+				MetricsServerCN:     *metricsCN,
+				SubscriptionID:      *subscriptionID,
+
+				MetricsServerResolve: *metricsServerResolve,
+			},
+			metronPort: *metronPort,
+			metronCA:   *metronCA,
+			metronCert: *metronCert,
+			metronKey:  *metronKey,
+			timeout:    *checkTimeout,
+		}))
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", command)
+		flag.Usage()
+		os.Exit(exitUsage)
 	}
-	err := setCACert(serverTLSConf, ca)
-	if err != nil {
-		log.Fatal(err)
-	}
-	serverConn, err := grpc.NewClient(
-		addr,
-		grpc.WithTransportCredentials(credentials.NewTLS(serverTLSConf)),
-		grpc.WithKeepaliveParams(keepalive.ClientParameters{
-			Time:                10 * time.Second,
-			Timeout:             20 * time.Second,
-			PermitWithoutStream: true,
-		}),
-	)
+
+	var directors []config.Director
+	if *directorsConfig != "" {
+		directors, err = config.LoadDirectors(*directorsConfig, *subscriptionID)
+		if err != nil {
+			fatal("unable to load directors config", "error", err)
+		}
+	} else {
+		validateCredentials(*clientIdentity, *clientSecret)
+
+		directors = []config.Director{{
+			URL:                 *directorURL,
+			CACert:              readFile(*directorCA),
+			ClientIdentity:      *clientIdentity,
+			ClientSecret:        *clientSecret,
+			ClientAuthMethod:    *clientAuthMethod,
+			RefreshToken:        *refreshToken,
+			MetricsServerAddr:   *metricsServerAddr,
+			MetricsServerCACert: readFile(*metricsCA),
+			MetricsServerCN:     *metricsCN,
+			SubscriptionID:      *subscriptionID,
+
+			MetricsServerResolve:       *metricsServerResolve,
+			MetricsServerPreferPrimary: *metricsServerPreferPrimary,
+		}}
+	}
+
+	unitMode, err := mapper.ParseUnitMode(*unitModeName)
 	if err != nil {
-		log.Fatalf("did not connect: %v", err)
+		fatal("invalid unit mode", "error", err)
 	}
 
-	return definitions.NewEgressClient(serverConn), serverConn.Close
-}
+	if command == "tail" {
+		os.Exit(runTail(os.Stdout, directors, tailOpts, *envelopeIpTag, unitMode))
+	}
 
-func newTLSConfig(caPath, certPath, keyPath, cn string) (*tls.Config, error) {
-	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
-	if err != nil {
-		return nil, err
+	var taggers []mapper.Tagger
+	if *staticTagsConfig != "" {
+		table, err := enrichment.NewStaticTable(*staticTagsConfig)
+		if err != nil {
+			fatal("unable to load static tags config", "error", err)
+		}
+		taggers = append(taggers, table)
+		go reloadOnSIGHUP(table)
 	}
 
-	tlsConfig := &tls.Config{
-		ServerName:         cn,
-		Certificates:       []tls.Certificate{cert},
-		InsecureSkipVerify: false,
+	redacted := make([]config.Director, 0, len(directors))
+	for _, d := range directors {
+		redacted = append(redacted, d.Redacted())
 	}
 
-	err = setCACert(tlsConfig, caPath)
-	if err != nil {
-		return nil, err
+	c := forwarder.DefaultConfig()
+	c.Directors = directors
+	c.MetronPort = *metronPort
+	c.MetronCACert = readFile(*metronCA)
+	c.MetronCertPath = *metronCert
+	c.MetronKeyPath = *metronKey
+	c.Logger = logger
+	c.LogLevel = &level
+	c.StreamIdleTimeout = *streamIdleTimeout
+	c.DrainTimeout = *drainTimeout
+	c.ValidateToken = *validateToken
+	c.TokenAudience = *tokenAudience
+	c.VerifyTokenSignature = *verifyTokenSignature
+	c.UAAURLTTL = *uaaURLTTL
+	c.EnvelopeIPTag = *envelopeIpTag
+	c.UnitMode = unitMode
+	c.DirectorInfoTags = *directorInfoTags
+	c.DirectorInfoRefresh = *directorInfoRefresh
+	c.InstanceMetadataTags = *instanceMetadataTags
+	c.InstanceMetadataRefresh = *instanceMetadataRefresh
+	c.Taggers = taggers
+	c.DedupWindow = *dedupWindow
+	c.DedupGapThreshold = *dedupGapThreshold
+	c.FilterConfig = *filterConfig
+	c.DeploymentRateLimit = *deploymentRateLimit
+	c.DeploymentRateBurst = *deploymentRateBurst
+	c.InstanceRateLimit = *instanceRateLimit
+	c.InstanceRateBurst = *instanceRateBurst
+	c.MaxMetricNames = *maxMetricNames
+	c.MaxTagValues = *maxTagValues
+	c.AggregateInterval = *aggregateInterval
+	c.AggregateMetrics = splitList(*aggregateMetrics)
+	c.AggregateSourceID = *aggregateSourceID
+	c.LivenessMissedIntervals = *livenessMissedIntervals
+	c.LivenessHeartbeatInterval = *livenessHeartbeatInterval
+	c.LivenessForgetAfter = *livenessForgetAfter
+	c.AlertConfig = *alertConfig
+	c.AlertLog = *alertLog
+	c.AlertForgetAfter = *alertForgetAfter
+	c.DiskPrediction = *diskPrediction
+	c.DiskPredictionWindow = *diskPredictionWindow
+	c.DiskPredictionMinSamples = *diskPredictionMinSamples
+	c.ShardIndex = *shardIndex
+	c.ShardTotal = *shardTotal
+	c.ShardStandby = *shardStandby
+	c.Tap = *tapEnabled
+	c.TapMaxRate = *tapMaxRate
+	c.HealthPort = *healthPort
+	c.PprofPort = *pprofPort
+	c.AdminPort = *adminPort
+	c.AdminConfig = map[string]any{
+		"flags":     admin.RedactedFlags(flag.CommandLine, "auth-client-secret", "auth-refresh-token"),
+		"directors": redacted,
 	}
 
-	return tlsConfig, nil
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		// a second signal exits without draining.
+		<-ctx.Done()
+		stop()
+	}()
+
+	err = forwarder.Run(ctx, c)
+	var setupErr *forwarder.SetupError
+	switch {
+	case errors.As(err, &setupErr):
+		fatal("unable to set up forwarder", "error", err)
+	case err != nil:
+		logger.Error("forwarder failed", "error", err)
+		os.Exit(exitFailure)
+	}
 }
 
-func setCACert(tlsConfig *tls.Config, caPath string) error {
-	caCertBytes, err := ioutil.ReadFile(caPath)
-	if err != nil {
-		return err
+func reloadOnSIGHUP(table *enrichment.StaticTable) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		err := table.Reload()
+		if err != nil {
+			logger.Error("unable to reload static tags config", "error", err)
+			continue
+		}
+		logger.Info("static tags config reloaded")
 	}
+}
+
+func validateCredentials(id, secret string) {
+	if id == "" || secret == "" {
+		fatal("UAA System Metrics Client Credentials are required. Please see Bosh System Metrics Forwarder configuration")
+	}
+}
 
-	caCertPool := x509.NewCertPool()
-	if ok := caCertPool.AppendCertsFromPEM(caCertBytes); !ok {
-		return fmt.Errorf("cannot parse ca cert from %s", caPath)
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
 	}
 
-	tlsConfig.RootCAs = caCertPool
+	return items
+}
+
+func readFile(path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		fatal("unable to read file", "path", path, "error", err)
+	}
 
-	return nil
+	return string(b)
 }
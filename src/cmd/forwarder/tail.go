@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/auth"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/config"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/forwarder"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/mapper"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/tail"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+)
+
+// tailSettings are the settings of the tail command.
+type tailSettings struct {
+	format     string
+	deployment string
+	job        string
+	mapped     bool
+}
+
+// tailFlags returns a flag set with all flags of the forwarder and those
+// of the tail command.
+func tailFlags(s *tailSettings) *flag.FlagSet {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+
+	fs.StringVar(&s.format, "format", "table", "The output format. Either table or json")
+	fs.StringVar(&s.deployment, "deployment", "", "Only print the events of deployments matching the glob")
+	fs.StringVar(&s.job, "job", "", "Only print the heartbeats of jobs matching the glob")
+	fs.BoolVar(&s.mapped, "mapped", false, "Print the envelopes the heartbeats are converted to rather than the heartbeats")
+
+	return fs
+}
+
+// runTail prints the events of the directors to w until interrupted.
+// Each director is subscribed to with its subscription id suffixed with
+// -tail so the forwarder does not miss any of the events. Mapped envelopes
+// are converted with the ip tag and unit mode only, without the tags of
+// the enrichment options.
+// It returns the exit code of the tail command.
+func runTail(w io.Writer, directors []config.Director, s tailSettings, ipTag string, unitMode mapper.UnitMode) int {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	opts := []tail.PrinterOpt{tail.WithDeployment(s.deployment), tail.WithJob(s.job)}
+	if s.mapped {
+		opts = append(opts, tail.WithMapper(mapper.New(ipTag, mapper.WithUnitMode(unitMode))))
+	}
+	p, err := tail.NewPrinter(w, s.format, opts...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	p.Header()
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed bool
+	)
+	for _, d := range directors {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := tailDirector(ctx, d, p)
+			if err != nil && ctx.Err() == nil {
+				logger.Error("unable to tail director", "director", d.Name, "error", err)
+
+				mu.Lock()
+				failed = true
+				mu.Unlock()
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if failed {
+		return 1
+	}
+
+	return 0
+}
+
+func tailDirector(ctx context.Context, d config.Director, p *tail.Printer) error {
+	directorTLSConf := &tls.Config{}
+	err := forwarder.SetCACert(directorTLSConf, d.CACert)
+	if err != nil {
+		return fmt.Errorf("unable to read director ca cert: %s", err)
+	}
+
+	authClient, err := forwarder.NewAuth(auth.NewAddressProvider(d.URL, directorTLSConf), d, directorTLSConf)
+	if err != nil {
+		return err
+	}
+	token, err := authClient.Token()
+	if err != nil {
+		return fmt.Errorf("unable to get token: %s", err)
+	}
+
+	client, closeConn, err := forwarder.NewMetricsServerClient(d)
+	if err != nil {
+		return err
+	}
+	defer closeConn()
+
+	stream, err := client.BoshMetrics(
+		metadata.NewOutgoingContext(ctx, metadata.Pairs("authorization", token)),
+		&definitions.EgressRequest{SubscriptionId: d.SubscriptionID + "-tail"},
+	)
+	if err != nil {
+		return err
+	}
+
+	for {
+		event, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+
+		err = p.Print(d.Name, event)
+		if err != nil {
+			return err
+		}
+	}
+}
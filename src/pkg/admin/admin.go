@@ -0,0 +1,237 @@
+package admin
+
+import (
+	"encoding/json"
+	"flag"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var pausedGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Subsystem: "admin",
+	Name:      "paused",
+	Help:      "Whether forwarding is paused through the admin api",
+})
+
+func init() {
+	prometheus.MustRegister(pausedGauge)
+}
+
+// Pause is a switch to pause forwarding during maintenance.
+type Pause struct {
+	mu     sync.Mutex
+	paused bool
+	since  time.Time
+}
+
+// PauseStatus is the state of a Pause.
+type PauseStatus struct {
+	Paused bool      `json:"paused"`
+	Since  time.Time `json:"since"`
+}
+
+// Paused reports whether forwarding is paused.
+func (p *Pause) Paused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.paused
+}
+
+// Set pauses or resumes forwarding.
+func (p *Pause) Set(paused bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.paused == paused {
+		return
+	}
+	p.paused = paused
+	p.since = time.Now()
+
+	if paused {
+		pausedGauge.Set(1)
+	} else {
+		pausedGauge.Set(0)
+	}
+}
+
+// Status returns the state of the Pause.
+func (p *Pause) Status() PauseStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return PauseStatus{Paused: p.paused, Since: p.since}
+}
+
+// Server is a localhost http api to inspect and control a running
+// forwarder. It serves:
+//
+//	GET /config               the configuration with secrets redacted
+//	GET /status               the status of every registered component
+//	GET, PUT /log-level       the log level, set with ?level=debug
+//	GET, PUT, DELETE /pause   whether forwarding is paused
+type Server struct {
+	logger   *slog.Logger
+	config   any
+	level    *slog.LevelVar
+	pause    *Pause
+	statuses map[string]func() any
+}
+
+type ServerOpt func(*Server)
+
+// WithConfig serves c on /config. Secrets must be redacted by the caller.
+func WithConfig(c any) ServerOpt {
+	return func(s *Server) {
+		s.config = c
+	}
+}
+
+// WithLogLevel allows reading and changing the log level.
+func WithLogLevel(l *slog.LevelVar) ServerOpt {
+	return func(s *Server) {
+		s.level = l
+	}
+}
+
+// WithPause allows pausing and resuming forwarding.
+func WithPause(p *Pause) ServerOpt {
+	return func(s *Server) {
+		s.pause = p
+	}
+}
+
+// WithStatus adds the result of f under name to /status.
+func WithStatus(name string, f func() any) ServerOpt {
+	return func(s *Server) {
+		s.statuses[name] = f
+	}
+}
+
+// New returns a new Server. Its Handler is served by the caller.
+func New(l *slog.Logger, opts ...ServerOpt) *Server {
+	s := &Server{
+		logger:   l,
+		statuses: make(map[string]func() any),
+	}
+
+	for _, o := range opts {
+		o(s)
+	}
+
+	return s
+}
+
+// Handler returns the http.Handler of the admin api.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/config", s.serveConfig)
+	mux.HandleFunc("/status", s.serveStatus)
+	mux.HandleFunc("/log-level", s.serveLogLevel)
+	mux.HandleFunc("/pause", s.servePause)
+
+	return mux
+}
+
+func (s *Server) serveConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, s.config)
+}
+
+func (s *Server) serveStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := make(map[string]any, len(s.statuses)+1)
+	for name, f := range s.statuses {
+		status[name] = f()
+	}
+	if s.pause != nil {
+		status["pause"] = s.pause.Status()
+	}
+
+	writeJSON(w, status)
+}
+
+type logLevel struct {
+	Level string `json:"level"`
+}
+
+func (s *Server) serveLogLevel(w http.ResponseWriter, r *http.Request) {
+	if s.level == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var level slog.Level
+		err := level.UnmarshalText([]byte(r.URL.Query().Get("level")))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.level.Set(level)
+		s.logger.Info("log level changed", "level", level)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, logLevel{Level: s.level.Level().String()})
+}
+
+func (s *Server) servePause(w http.ResponseWriter, r *http.Request) {
+	if s.pause == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		s.pause.Set(true)
+		s.logger.Warn("forwarding paused")
+	case http.MethodDelete:
+		s.pause.Set(false)
+		s.logger.Info("forwarding resumed")
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, s.pause.Status())
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// RedactedFlags returns the values of all flags in fs by name. The values
+// of the secret flags are redacted if they are set.
+func RedactedFlags(fs *flag.FlagSet, secrets ...string) map[string]string {
+	flags := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if value != "" && slices.Contains(secrets, f.Name) {
+			value = "REDACTED"
+		}
+		flags[f.Name] = value
+	})
+
+	return flags
+}
@@ -0,0 +1,93 @@
+package admin_test
+
+import (
+	"encoding/json"
+	"flag"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/admin"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/logging"
+	. "github.com/onsi/gomega"
+)
+
+func TestPauseAndResume(t *testing.T) {
+	RegisterTestingT(t)
+
+	pause := &admin.Pause{}
+	h := admin.New(logging.Discard(), admin.WithPause(pause)).Handler()
+
+	rec := serve(h, http.MethodPut, "/pause")
+	Expect(rec.Code).To(Equal(http.StatusOK))
+	Expect(pause.Paused()).To(BeTrue())
+
+	var status admin.PauseStatus
+	Expect(json.Unmarshal(rec.Body.Bytes(), &status)).To(Succeed())
+	Expect(status.Paused).To(BeTrue())
+	Expect(status.Since).ToNot(BeZero())
+
+	serve(h, http.MethodDelete, "/pause")
+	Expect(pause.Paused()).To(BeFalse())
+
+	Expect(serve(h, http.MethodPost, "/pause").Code).To(Equal(http.StatusMethodNotAllowed))
+}
+
+func TestChangeLogLevel(t *testing.T) {
+	RegisterTestingT(t)
+
+	var level slog.LevelVar
+	h := admin.New(logging.Discard(), admin.WithLogLevel(&level)).Handler()
+
+	rec := serve(h, http.MethodPut, "/log-level?level=debug")
+	Expect(rec.Code).To(Equal(http.StatusOK))
+	Expect(rec.Body.String()).To(MatchJSON(`{"level": "DEBUG"}`))
+	Expect(level.Level()).To(Equal(slog.LevelDebug))
+
+	rec = serve(h, http.MethodPut, "/log-level?level=loud")
+	Expect(rec.Code).To(Equal(http.StatusBadRequest))
+	Expect(level.Level()).To(Equal(slog.LevelDebug))
+}
+
+func TestStatusReportsComponents(t *testing.T) {
+	RegisterTestingT(t)
+
+	h := admin.New(logging.Discard(),
+		admin.WithPause(&admin.Pause{}),
+		admin.WithStatus("queues", func() any { return map[string]int{"messages": 3} }),
+	).Handler()
+
+	rec := serve(h, http.MethodGet, "/status")
+	Expect(rec.Code).To(Equal(http.StatusOK))
+	Expect(rec.Body.String()).To(MatchJSON(`{
+		"queues": {"messages": 3},
+		"pause": {"paused": false, "since": "0001-01-01T00:00:00Z"}
+	}`))
+}
+
+func TestConfigRedactsSecretFlags(t *testing.T) {
+	RegisterTestingT(t)
+
+	fs := flag.NewFlagSet("forwarder", flag.ContinueOnError)
+	fs.String("auth-client-identity", "client", "")
+	fs.String("auth-client-secret", "hunter2", "")
+	fs.String("auth-refresh-token", "", "")
+	fs.String("auth-token-audience", "bosh", "")
+
+	h := admin.New(logging.Discard(), admin.WithConfig(admin.RedactedFlags(fs, "auth-client-secret", "auth-refresh-token"))).Handler()
+
+	rec := serve(h, http.MethodGet, "/config")
+	Expect(rec.Body.String()).To(MatchJSON(`{
+		"auth-client-identity": "client",
+		"auth-client-secret": "REDACTED",
+		"auth-refresh-token": "",
+		"auth-token-audience": "bosh"
+	}`))
+}
+
+func serve(h http.Handler, method, target string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+	return rec
+}
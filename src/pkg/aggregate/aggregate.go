@@ -0,0 +1,292 @@
+package aggregate
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/loggregator_v2"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/mapper"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var droppedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+	Subsystem: "aggregate",
+	Name:      "dropped",
+	Help:      "Tracks the number of rollup envelopes dropped if unable to queue the msg",
+})
+
+func init() {
+	prometheus.MustRegister(droppedCounter)
+}
+
+type instanceKey struct {
+	deployment string
+	id         string
+}
+
+type instance struct {
+	job     string
+	seen    time.Time
+	healthy bool
+	metrics map[string]float64
+}
+
+// Aggregator keeps the latest heartbeat of every instance and periodically
+// emits rollup gauges per deployment and per job. Deployments are only
+// unique per director, so every director needs its own Aggregator.
+type Aggregator struct {
+	messages chan<- *loggregator_v2.Envelope
+	metrics  []string
+	sourceID string
+	ttl      time.Duration
+	unitMode mapper.UnitMode
+	tags     map[string]string
+	now      func() time.Time
+
+	mu        sync.Mutex
+	instances map[instanceKey]*instance
+}
+
+type AggregatorOpt func(*Aggregator)
+
+// WithMetrics sets the heartbeat metrics for which min, avg and max
+// rollups are emitted.
+func WithMetrics(names []string) AggregatorOpt {
+	return func(a *Aggregator) {
+		a.metrics = names
+	}
+}
+
+// WithSourceID sets the source id of the rollup envelopes.
+func WithSourceID(id string) AggregatorOpt {
+	return func(a *Aggregator) {
+		a.sourceID = id
+	}
+}
+
+// WithUnitMode sets the units of the metric rollups. It defaults to
+// mapper.CompatUnits.
+func WithUnitMode(mode mapper.UnitMode) AggregatorOpt {
+	return func(a *Aggregator) {
+		a.unitMode = mode
+	}
+}
+
+// WithTags adds the given tags to every rollup envelope.
+func WithTags(tags map[string]string) AggregatorOpt {
+	return func(a *Aggregator) {
+		for k, v := range tags {
+			a.tags[k] = v
+		}
+	}
+}
+
+// WithTTL sets how long an instance is included in the rollups after its
+// latest heartbeat.
+func WithTTL(d time.Duration) AggregatorOpt {
+	return func(a *Aggregator) {
+		a.ttl = d
+	}
+}
+
+// WithClock sets the function used to tell the current time.
+func WithClock(now func() time.Time) AggregatorOpt {
+	return func(a *Aggregator) {
+		a.now = now
+	}
+}
+
+// New returns a new Aggregator that writes rollup envelopes to messages.
+func New(messages chan<- *loggregator_v2.Envelope, opts ...AggregatorOpt) *Aggregator {
+	a := &Aggregator{
+		messages:  messages,
+		sourceID:  "bosh-system-metrics-aggregator",
+		ttl:       5 * time.Minute,
+		tags:      make(map[string]string),
+		now:       time.Now,
+		instances: make(map[instanceKey]*instance),
+	}
+
+	for _, o := range opts {
+		o(a)
+	}
+
+	return a
+}
+
+// Observe records the heartbeat as the latest state of its instance.
+// Other events are ignored.
+func (a *Aggregator) Observe(event *definitions.Event) {
+	hb := event.GetHeartbeat()
+	if hb == nil {
+		return
+	}
+
+	i := &instance{
+		job:     hb.GetJob(),
+		seen:    a.now(),
+		metrics: make(map[string]float64, len(hb.GetMetrics())),
+	}
+	for _, m := range hb.GetMetrics() {
+		i.metrics[m.GetName()] = m.GetValue()
+	}
+	i.healthy = i.metrics["system.healthy"] == 1
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.instances[instanceKey{deployment: event.GetDeployment(), id: hb.GetInstanceId()}] = i
+}
+
+// Start spins a new go routine that emits the rollups every interval.
+// It returns a shutdown function that blocks until the go routine has
+// exited.
+func (a *Aggregator) Start(interval time.Duration) func() {
+	done := make(chan struct{})
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				a.Emit()
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// Emit writes one rollup envelope per deployment and one per job to the
+// messages channel. Instances that have not sent a heartbeat within the
+// ttl are forgotten.
+func (a *Aggregator) Emit() {
+	for _, e := range a.rollups() {
+		select {
+		case a.messages <- e:
+		default:
+			droppedCounter.Inc()
+		}
+	}
+}
+
+type group struct {
+	tags      map[string]string
+	instances []*instance
+}
+
+func (a *Aggregator) rollups() []*loggregator_v2.Envelope {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.now()
+	groups := make(map[string]*group)
+	addTo := func(key string, tags map[string]string, i *instance) {
+		g, ok := groups[key]
+		if !ok {
+			g = &group{tags: tags}
+			groups[key] = g
+		}
+		g.instances = append(g.instances, i)
+	}
+
+	for k, i := range a.instances {
+		if now.Sub(i.seen) > a.ttl {
+			delete(a.instances, k)
+			continue
+		}
+
+		addTo(k.deployment, map[string]string{
+			"deployment": k.deployment,
+		}, i)
+		addTo(k.deployment+"/"+i.job, map[string]string{
+			"deployment": k.deployment,
+			"job":        i.job,
+		}, i)
+	}
+
+	envelopes := make([]*loggregator_v2.Envelope, 0, len(groups))
+	for _, g := range groups {
+		envelopes = append(envelopes, a.envelope(g, now))
+	}
+
+	return envelopes
+}
+
+func (a *Aggregator) envelope(g *group, now time.Time) *loggregator_v2.Envelope {
+	var healthy float64
+	for _, i := range g.instances {
+		if i.healthy {
+			healthy++
+		}
+	}
+
+	metrics := map[string]*loggregator_v2.GaugeValue{
+		"instances": {Value: float64(len(g.instances)), Unit: "Count"},
+		"healthy":   {Value: healthy, Unit: "Count"},
+	}
+
+	for _, name := range a.metrics {
+		var (
+			count    int
+			sum      float64
+			min, max = math.Inf(1), math.Inf(-1)
+		)
+		for _, i := range g.instances {
+			v, ok := i.metrics[name]
+			if !ok {
+				continue
+			}
+			count++
+			sum += v
+			min = math.Min(min, v)
+			max = math.Max(max, v)
+		}
+		if count == 0 {
+			continue
+		}
+
+		a.setGauges(metrics, name, ".min", min)
+		a.setGauges(metrics, name, ".avg", sum/float64(count))
+		a.setGauges(metrics, name, ".max", max)
+	}
+
+	tags := map[string]string{
+		"origin": "bosh-system-metrics-forwarder",
+	}
+	for k, v := range a.tags {
+		tags[k] = v
+	}
+	for k, v := range g.tags {
+		tags[k] = v
+	}
+
+	return &loggregator_v2.Envelope{
+		Timestamp: now.UnixNano(),
+		SourceId:  a.sourceID,
+		Tags:      tags,
+		Message: &loggregator_v2.Envelope_Gauge{
+			Gauge: &loggregator_v2.Gauge{
+				Metrics: metrics,
+			},
+		},
+	}
+}
+
+// setGauges converts the value of the metric with the given name to the
+// unit mode and sets it under the converted name with the suffix.
+func (a *Aggregator) setGauges(metrics map[string]*loggregator_v2.GaugeValue, name, suffix string, value float64) {
+	name, value, unit := mapper.Convert(a.unitMode, name, value)
+	metrics[name+suffix] = &loggregator_v2.GaugeValue{Value: value, Unit: unit}
+}
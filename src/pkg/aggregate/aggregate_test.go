@@ -0,0 +1,199 @@
+package aggregate_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/aggregate"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/loggregator_v2"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/mapper"
+	. "github.com/onsi/gomega"
+)
+
+func TestEmitRollsUpPerDeploymentAndJob(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *loggregator_v2.Envelope, 10)
+	a := aggregate.New(messages, aggregate.WithMetrics([]string{"system.cpu.user"}))
+
+	a.Observe(heartbeat("cf", "router", "id-1", 1, 10))
+	a.Observe(heartbeat("cf", "router", "id-2", 0, 20))
+	a.Observe(heartbeat("cf", "diego-cell", "id-3", 1, 60))
+
+	a.Emit()
+
+	envelopes := receiveAll(messages)
+	Expect(envelopes).To(HaveLen(3))
+
+	deployment := find(envelopes, map[string]string{"deployment": "cf"})
+	Expect(deployment).ToNot(BeNil())
+	Expect(deployment.GetSourceId()).To(Equal("bosh-system-metrics-aggregator"))
+	Expect(deployment.GetGauge().GetMetrics()).To(Equal(map[string]*loggregator_v2.GaugeValue{
+		"instances":           {Value: 3, Unit: "Count"},
+		"healthy":             {Value: 2, Unit: "Count"},
+		"system.cpu.user.min": {Value: 10, Unit: "Load"},
+		"system.cpu.user.avg": {Value: 30, Unit: "Load"},
+		"system.cpu.user.max": {Value: 60, Unit: "Load"},
+	}))
+
+	router := find(envelopes, map[string]string{"deployment": "cf", "job": "router"})
+	Expect(router).ToNot(BeNil())
+	Expect(router.GetGauge().GetMetrics()).To(Equal(map[string]*loggregator_v2.GaugeValue{
+		"instances":           {Value: 2, Unit: "Count"},
+		"healthy":             {Value: 1, Unit: "Count"},
+		"system.cpu.user.min": {Value: 10, Unit: "Load"},
+		"system.cpu.user.avg": {Value: 15, Unit: "Load"},
+		"system.cpu.user.max": {Value: 20, Unit: "Load"},
+	}))
+}
+
+func TestEmitAddsTags(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *loggregator_v2.Envelope, 10)
+	a := aggregate.New(messages, aggregate.WithTags(map[string]string{"director": "bosh-1"}))
+
+	a.Observe(heartbeat("cf", "router", "id-1", 1, 10))
+	a.Emit()
+
+	envelopes := receiveAll(messages)
+	Expect(envelopes).To(HaveLen(2))
+	for _, e := range envelopes {
+		Expect(e.GetTags()).To(HaveKeyWithValue("director", "bosh-1"))
+		Expect(e.GetTags()).To(HaveKeyWithValue("deployment", "cf"))
+	}
+}
+
+func TestEmitUsesLatestHeartbeatPerInstance(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *loggregator_v2.Envelope, 10)
+	a := aggregate.New(messages, aggregate.WithMetrics([]string{"system.cpu.user"}))
+
+	a.Observe(heartbeat("cf", "router", "id-1", 1, 10))
+	a.Observe(heartbeat("cf", "router", "id-1", 0, 50))
+
+	a.Emit()
+
+	deployment := find(receiveAll(messages), map[string]string{"deployment": "cf"})
+	Expect(deployment.GetGauge().GetMetrics()).To(HaveKeyWithValue("instances", &loggregator_v2.GaugeValue{Value: 1, Unit: "Count"}))
+	Expect(deployment.GetGauge().GetMetrics()).To(HaveKeyWithValue("healthy", &loggregator_v2.GaugeValue{Value: 0, Unit: "Count"}))
+	Expect(deployment.GetGauge().GetMetrics()).To(HaveKeyWithValue("system.cpu.user.max", &loggregator_v2.GaugeValue{Value: 50, Unit: "Load"}))
+}
+
+func TestEmitConvertsToUnitMode(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *loggregator_v2.Envelope, 10)
+	a := aggregate.New(
+		messages,
+		aggregate.WithMetrics([]string{"system.cpu.user", "system.mem.kb"}),
+		aggregate.WithUnitMode(mapper.BaseUnits),
+	)
+
+	event := heartbeat("cf", "router", "id-1", 1, 10)
+	hb := event.GetHeartbeat()
+	hb.Metrics = append(hb.Metrics, &definitions.Heartbeat_Metric{Name: "system.mem.kb", Value: 2})
+	a.Observe(event)
+	a.Emit()
+
+	deployment := find(receiveAll(messages), map[string]string{"deployment": "cf"})
+	Expect(deployment.GetGauge().GetMetrics()).To(HaveKeyWithValue("system.cpu.user.max", &loggregator_v2.GaugeValue{Value: 10, Unit: "percentage"}))
+	Expect(deployment.GetGauge().GetMetrics()).To(HaveKeyWithValue("system.mem.bytes.max", &loggregator_v2.GaugeValue{Value: 2048, Unit: "bytes"}))
+}
+
+func TestEmitForgetsStaleInstances(t *testing.T) {
+	RegisterTestingT(t)
+
+	now := time.Unix(1499293724, 0)
+	messages := make(chan *loggregator_v2.Envelope, 10)
+	a := aggregate.New(
+		messages,
+		aggregate.WithTTL(time.Minute),
+		aggregate.WithClock(func() time.Time { return now }),
+	)
+
+	a.Observe(heartbeat("cf", "router", "id-1", 1, 10))
+	now = now.Add(2 * time.Minute)
+	a.Observe(heartbeat("redis", "redis", "id-2", 1, 10))
+
+	a.Emit()
+
+	envelopes := receiveAll(messages)
+	Expect(envelopes).To(HaveLen(2))
+	Expect(find(envelopes, map[string]string{"deployment": "cf"})).To(BeNil())
+}
+
+func TestEmitDoesNotBlockWhenMessagesAreFull(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *loggregator_v2.Envelope)
+	a := aggregate.New(messages)
+	a.Observe(heartbeat("cf", "router", "id-1", 1, 10))
+
+	done := make(chan struct{})
+	go func() {
+		a.Emit()
+		close(done)
+	}()
+
+	Eventually(done).Should(BeClosed())
+}
+
+func TestStartEmitsPeriodically(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *loggregator_v2.Envelope, 100)
+	a := aggregate.New(messages)
+	a.Observe(heartbeat("cf", "router", "id-1", 1, 10))
+
+	stop := a.Start(time.Millisecond)
+	defer stop()
+
+	Eventually(func() int { return len(messages) }).Should(BeNumerically(">=", 4))
+}
+
+func heartbeat(deployment, job, instanceID string, healthy, cpu float64) *definitions.Event {
+	return &definitions.Event{
+		Deployment: deployment,
+		Message: &definitions.Event_Heartbeat{
+			Heartbeat: &definitions.Heartbeat{
+				Job:        job,
+				InstanceId: instanceID,
+				Metrics: []*definitions.Heartbeat_Metric{
+					{Name: "system.healthy", Value: healthy},
+					{Name: "system.cpu.user", Value: cpu},
+				},
+			},
+		},
+	}
+}
+
+func receiveAll(messages chan *loggregator_v2.Envelope) []*loggregator_v2.Envelope {
+	var envelopes []*loggregator_v2.Envelope
+	for {
+		select {
+		case e := <-messages:
+			envelopes = append(envelopes, e)
+		default:
+			return envelopes
+		}
+	}
+}
+
+func find(envelopes []*loggregator_v2.Envelope, tags map[string]string) *loggregator_v2.Envelope {
+	for _, e := range envelopes {
+		match := len(e.GetTags()) == len(tags)+1
+		for k, v := range tags {
+			if e.GetTags()[k] != v {
+				match = false
+			}
+		}
+		if match {
+			return e
+		}
+	}
+
+	return nil
+}
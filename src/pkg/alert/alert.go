@@ -0,0 +1,498 @@
+package alert
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/loggregator_v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	transitionsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "alert",
+		Name:      "transitions",
+		Help:      "Tracks the number of times each alert rule fired or resolved",
+	}, []string{"rule", "state"})
+	droppedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "alert",
+		Name:      "dropped",
+		Help:      "Tracks the number of alert envelopes dropped if unable to queue the msg",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(transitionsCounter)
+	prometheus.MustRegister(droppedCounter)
+}
+
+const (
+	statePending  = "pending"
+	stateFiring   = "firing"
+	stateResolved = "resolved"
+)
+
+type ruleConfig struct {
+	Name           string   `json:"name"`
+	Metric         string   `json:"metric"`
+	Deployment     string   `json:"deployment"`
+	Job            string   `json:"job"`
+	Op             string   `json:"op"`
+	Threshold      float64  `json:"threshold"`
+	ClearThreshold *float64 `json:"clear_threshold"`
+	For            string   `json:"for"`
+}
+
+type fileConfig struct {
+	Rules []ruleConfig `json:"rules"`
+}
+
+type rule struct {
+	name       string
+	metric     string
+	deployment string
+	job        string
+	op         string
+	threshold  float64
+	clear      float64
+	forPeriod  time.Duration
+}
+
+// breached reports whether value is beyond the threshold of the rule.
+func (r rule) breached(value float64) bool {
+	return compare(r.op, value, r.threshold)
+}
+
+// cleared reports whether value is back within the clear threshold of the
+// rule.
+func (r rule) cleared(value float64) bool {
+	return !compare(r.op, value, r.clear)
+}
+
+func (r rule) matches(deployment, job, metric string) bool {
+	return r.metric == metric &&
+		globOrAny(r.deployment, deployment) &&
+		globOrAny(r.job, job)
+}
+
+func globOrAny(pattern, s string) bool {
+	if pattern == "" {
+		return true
+	}
+	ok, _ := path.Match(pattern, s)
+	return ok
+}
+
+func compare(op string, value, threshold float64) bool {
+	switch op {
+	case ">":
+		return value > threshold
+	case ">=":
+		return value >= threshold
+	case "<":
+		return value < threshold
+	default:
+		return value <= threshold
+	}
+}
+
+// sweepInterval is how often the states of instances that stopped
+// reporting are looked for.
+const sweepInterval = time.Minute
+
+type instanceKey struct {
+	director   string
+	deployment string
+	job        string
+	id         string
+}
+
+type instanceState struct {
+	state    string
+	since    time.Time
+	value    float64
+	lastSeen time.Time
+}
+
+// Engine evaluates threshold rules against the heartbeat metrics of every
+// instance.
+// A rule becomes pending once a metric breaches its threshold and fires
+// once it has been breached for the rule's for duration. A firing rule
+// resolves when the metric crosses back over its clear threshold, which
+// defaults to the threshold. An event envelope is emitted whenever a rule
+// fires or resolves. The states of instances that stop reporting are
+// forgotten, resolving the rules firing for them.
+type Engine struct {
+	messages    chan<- *loggregator_v2.Envelope
+	rules       []rule
+	logger      *slog.Logger
+	now         func() time.Time
+	forgetAfter time.Duration
+
+	mu        sync.Mutex
+	states    map[string]map[instanceKey]*instanceState
+	lastSweep time.Time
+}
+
+type EngineOpt func(*Engine)
+
+// WithLogger logs a line whenever a rule fires or resolves.
+func WithLogger(l *slog.Logger) EngineOpt {
+	return func(e *Engine) {
+		e.logger = l
+	}
+}
+
+// WithClock sets the function used to tell the current time.
+func WithClock(now func() time.Time) EngineOpt {
+	return func(e *Engine) {
+		e.now = now
+	}
+}
+
+// WithForgetAfter sets how long the state of an instance is kept after
+// its last heartbeat.
+func WithForgetAfter(d time.Duration) EngineOpt {
+	return func(e *Engine) {
+		e.forgetAfter = d
+	}
+}
+
+// Load returns a new Engine configured with the json file at path that
+// writes alert envelopes to messages.
+// Deployment and job patterns are globs.
+// It returns an error if the file cannot be read or a rule is invalid.
+func Load(path string, messages chan<- *loggregator_v2.Envelope, opts ...EngineOpt) (*Engine, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var c fileConfig
+	err = json.Unmarshal(b, &c)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode alert config %s: %s", path, err)
+	}
+
+	e := &Engine{
+		messages:    messages,
+		now:         time.Now,
+		forgetAfter: time.Hour,
+		states:      make(map[string]map[instanceKey]*instanceState),
+	}
+
+	names := make(map[string]bool)
+	for i, rc := range c.Rules {
+		r, err := newRule(rc)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %s", i, err)
+		}
+		if names[r.name] {
+			return nil, fmt.Errorf("rule %d: duplicate name %s", i, r.name)
+		}
+		names[r.name] = true
+
+		e.rules = append(e.rules, r)
+		e.states[r.name] = make(map[instanceKey]*instanceState)
+	}
+
+	for _, o := range opts {
+		o(e)
+	}
+	e.lastSweep = e.now()
+
+	return e, nil
+}
+
+func newRule(rc ruleConfig) (rule, error) {
+	if rc.Name == "" {
+		return rule{}, fmt.Errorf("name is required")
+	}
+	if rc.Metric == "" {
+		return rule{}, fmt.Errorf("metric is required")
+	}
+
+	switch rc.Op {
+	case ">", ">=", "<", "<=":
+	default:
+		return rule{}, fmt.Errorf("invalid op %q", rc.Op)
+	}
+
+	for _, p := range []string{rc.Deployment, rc.Job} {
+		if _, err := path.Match(p, ""); err != nil {
+			return rule{}, fmt.Errorf("invalid pattern %q: %s", p, err)
+		}
+	}
+
+	r := rule{
+		name:       rc.Name,
+		metric:     rc.Metric,
+		deployment: rc.Deployment,
+		job:        rc.Job,
+		op:         rc.Op,
+		threshold:  rc.Threshold,
+		clear:      rc.Threshold,
+	}
+
+	if rc.ClearThreshold != nil {
+		r.clear = *rc.ClearThreshold
+		if compare(rc.Op, r.clear, r.threshold) {
+			return rule{}, fmt.Errorf("clear_threshold %v is beyond threshold %v", r.clear, r.threshold)
+		}
+	}
+
+	if rc.For != "" {
+		d, err := time.ParseDuration(rc.For)
+		if err != nil {
+			return rule{}, fmt.Errorf("invalid for: %s", err)
+		}
+		r.forPeriod = d
+	}
+
+	return r, nil
+}
+
+// Observer is notified of events.
+type Observer interface {
+	Observe(event *definitions.Event)
+}
+
+type directorObserver struct {
+	engine   *Engine
+	director string
+}
+
+func (o directorObserver) Observe(event *definitions.Event) {
+	o.engine.observe(o.director, event)
+}
+
+// Director returns an Observer evaluating the rules against the events of
+// the named director. The alerts of its instances are tagged with the
+// director.
+func (e *Engine) Director(name string) Observer {
+	return directorObserver{engine: e, director: name}
+}
+
+// Observe evaluates the rules against the metrics of the heartbeat.
+// Other events are ignored.
+func (e *Engine) Observe(event *definitions.Event) {
+	e.observe("", event)
+}
+
+func (e *Engine) observe(director string, event *definitions.Event) {
+	hb := event.GetHeartbeat()
+	if hb == nil {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := e.now()
+	if now.Sub(e.lastSweep) >= sweepInterval {
+		e.sweep(now)
+	}
+
+	k := instanceKey{
+		director:   director,
+		deployment: event.GetDeployment(),
+		job:        hb.GetJob(),
+		id:         hb.GetInstanceId(),
+	}
+
+	for _, m := range hb.GetMetrics() {
+		for _, r := range e.rules {
+			if !r.matches(k.deployment, k.job, m.GetName()) {
+				continue
+			}
+			e.evaluate(r, k, m.GetValue(), now)
+		}
+	}
+}
+
+func (e *Engine) evaluate(r rule, k instanceKey, value float64, now time.Time) {
+	states := e.states[r.name]
+	s, ok := states[k]
+
+	if !ok {
+		if !r.breached(value) {
+			return
+		}
+		s = &instanceState{state: statePending, since: now, lastSeen: now}
+		states[k] = s
+	}
+	s.value = value
+	s.lastSeen = now
+
+	switch s.state {
+	case statePending:
+		if !r.breached(value) {
+			delete(states, k)
+			return
+		}
+		if now.Sub(s.since) >= r.forPeriod {
+			s.state = stateFiring
+			s.since = now
+			e.transition(r, k, s, "")
+		}
+	case stateFiring:
+		if r.cleared(value) {
+			delete(states, k)
+			e.transition(r, k, &instanceState{state: stateResolved, since: now, value: value}, "")
+		}
+	}
+}
+
+// sweep forgets the states of instances without a heartbeat within the
+// forget after duration. Firing rules are resolved.
+func (e *Engine) sweep(now time.Time) {
+	e.lastSweep = now
+
+	for _, r := range e.rules {
+		states := e.states[r.name]
+		for k, s := range states {
+			if now.Sub(s.lastSeen) <= e.forgetAfter {
+				continue
+			}
+
+			delete(states, k)
+			if s.state == stateFiring {
+				e.transition(r, k, &instanceState{state: stateResolved, since: now, value: s.value}, fmt.Sprintf(
+					"no heartbeat received since %s", s.lastSeen.UTC().Format(time.RFC3339),
+				))
+			}
+		}
+	}
+}
+
+// transition emits the alert event of the state of the rule for the
+// instance. The reason is appended to the body when it is set.
+func (e *Engine) transition(r rule, k instanceKey, s *instanceState, reason string) {
+	transitionsCounter.WithLabelValues(r.name, s.state).Inc()
+
+	title := fmt.Sprintf("alert %s %s", r.name, s.state)
+	body := fmt.Sprintf(
+		"%s of %s/%s/%s is %v (threshold %s %v)",
+		r.metric, k.deployment, k.job, k.id, s.value, r.op, r.threshold,
+	)
+	if reason != "" {
+		body += ": " + reason
+	}
+
+	if e.logger != nil {
+		e.logger.Info(
+			title,
+			"rule", r.name,
+			"state", s.state,
+			"metric", r.metric,
+			"value", s.value,
+			"deployment", k.deployment,
+			"job", k.job,
+			"id", k.id,
+			"director", k.director,
+		)
+	}
+
+	tags := map[string]string{
+		"deployment": k.deployment,
+		"job":        k.job,
+		"id":         k.id,
+		"origin":     "bosh-system-metrics-forwarder",
+		"alert":      r.name,
+		"state":      s.state,
+	}
+	if k.director != "" {
+		tags["director"] = k.director
+	}
+
+	envelope := &loggregator_v2.Envelope{
+		Timestamp: s.since.UnixNano(),
+		Tags:      tags,
+		Message: &loggregator_v2.Envelope_Event{
+			Event: &loggregator_v2.Event{
+				Title: title,
+				Body:  body,
+			},
+		},
+	}
+
+	select {
+	case e.messages <- envelope:
+	default:
+		droppedCounter.Inc()
+	}
+}
+
+// RuleStatus is the state of a rule as reported on the status endpoint.
+type RuleStatus struct {
+	Name      string           `json:"name"`
+	Metric    string           `json:"metric"`
+	Instances []InstanceStatus `json:"instances"`
+}
+
+// InstanceStatus is the state of a rule for an instance that is pending or
+// firing.
+type InstanceStatus struct {
+	Director   string    `json:"director,omitempty"`
+	Deployment string    `json:"deployment"`
+	Job        string    `json:"job"`
+	ID         string    `json:"id"`
+	State      string    `json:"state"`
+	Since      time.Time `json:"since"`
+	Value      float64   `json:"value"`
+}
+
+// Status returns the state of every rule.
+func (e *Engine) Status() []RuleStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.sweep(e.now())
+
+	statuses := make([]RuleStatus, 0, len(e.rules))
+	for _, r := range e.rules {
+		rs := RuleStatus{
+			Name:      r.name,
+			Metric:    r.metric,
+			Instances: []InstanceStatus{},
+		}
+		for k, s := range e.states[r.name] {
+			rs.Instances = append(rs.Instances, InstanceStatus{
+				Director:   k.director,
+				Deployment: k.deployment,
+				Job:        k.job,
+				ID:         k.id,
+				State:      s.state,
+				Since:      s.since,
+				Value:      s.value,
+			})
+		}
+		sort.Slice(rs.Instances, func(i, j int) bool {
+			a, b := rs.Instances[i], rs.Instances[j]
+			if a.Director != b.Director {
+				return a.Director < b.Director
+			}
+			if a.Deployment != b.Deployment {
+				return a.Deployment < b.Deployment
+			}
+			return a.ID < b.ID
+		})
+		statuses = append(statuses, rs)
+	}
+
+	return statuses
+}
+
+// ServeHTTP writes the state of every rule as json.
+func (e *Engine) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(e.Status())
+}
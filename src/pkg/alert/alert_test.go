@@ -0,0 +1,267 @@
+package alert_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/alert"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/loggregator_v2"
+	. "github.com/onsi/gomega"
+)
+
+const diskRule = `{"rules": [{
+	"name": "disk-full",
+	"metric": "system.disk.persistent.percent",
+	"op": ">",
+	"threshold": 90,
+	"clear_threshold": 85,
+	"for": "5m"
+}]}`
+
+func TestRuleFiresAfterForDuration(t *testing.T) {
+	RegisterTestingT(t)
+
+	now := time.Unix(1499293724, 0)
+	messages := make(chan *loggregator_v2.Envelope, 10)
+	e := loadEngine(t, diskRule, messages, alert.WithClock(func() time.Time { return now }))
+
+	e.Observe(heartbeat("cf", "router", "id-1", 95))
+	now = now.Add(4 * time.Minute)
+	e.Observe(heartbeat("cf", "router", "id-1", 95))
+	Expect(messages).To(BeEmpty())
+
+	now = now.Add(time.Minute)
+	e.Observe(heartbeat("cf", "router", "id-1", 96))
+
+	Expect(messages).To(HaveLen(1))
+	envelope := <-messages
+	Expect(envelope.GetTimestamp()).To(Equal(now.UnixNano()))
+	Expect(envelope.GetTags()).To(Equal(map[string]string{
+		"deployment": "cf",
+		"job":        "router",
+		"id":         "id-1",
+		"origin":     "bosh-system-metrics-forwarder",
+		"alert":      "disk-full",
+		"state":      "firing",
+	}))
+	Expect(envelope.GetEvent().GetTitle()).To(Equal("alert disk-full firing"))
+	Expect(envelope.GetEvent().GetBody()).To(Equal("system.disk.persistent.percent of cf/router/id-1 is 96 (threshold > 90)"))
+}
+
+func TestDirectorTagsAlerts(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *loggregator_v2.Envelope, 10)
+	e := loadEngine(t, `{"rules": [{"name": "disk-full", "metric": "system.disk.persistent.percent", "op": ">", "threshold": 90}]}`, messages)
+
+	e.Director("bosh-1").Observe(heartbeat("cf", "router", "id-1", 95))
+	e.Director("bosh-2").Observe(heartbeat("cf", "router", "id-1", 50))
+
+	Expect(messages).To(HaveLen(1))
+	envelope := <-messages
+	Expect(envelope.GetTags()).To(HaveKeyWithValue("director", "bosh-1"))
+
+	instances := e.Status()[0].Instances
+	Expect(instances).To(HaveLen(1))
+	Expect(instances[0].Director).To(Equal("bosh-1"))
+}
+
+func TestRuleResolvesOnceInstanceStopsReporting(t *testing.T) {
+	RegisterTestingT(t)
+
+	now := time.Unix(1499293724, 0)
+	messages := make(chan *loggregator_v2.Envelope, 10)
+	e := loadEngine(t, `{"rules": [{"name": "disk-full", "metric": "system.disk.persistent.percent", "op": ">", "threshold": 90}]}`, messages,
+		alert.WithClock(func() time.Time { return now }),
+		alert.WithForgetAfter(time.Hour),
+	)
+
+	e.Observe(heartbeat("cf", "router", "id-1", 95))
+	Expect(messages).To(HaveLen(1))
+	<-messages
+
+	now = now.Add(30 * time.Minute)
+	Expect(e.Status()[0].Instances).To(HaveLen(1))
+
+	now = now.Add(31 * time.Minute)
+	Expect(e.Status()[0].Instances).To(BeEmpty())
+
+	Expect(messages).To(HaveLen(1))
+	envelope := <-messages
+	Expect(envelope.GetTags()).To(HaveKeyWithValue("state", "resolved"))
+	Expect(envelope.GetEvent().GetBody()).To(Equal("system.disk.persistent.percent of cf/router/id-1 is 95 (threshold > 90): no heartbeat received since 2017-07-05T22:28:44Z"))
+}
+
+func TestRuleDoesNotFireWhenBreachIsInterrupted(t *testing.T) {
+	RegisterTestingT(t)
+
+	now := time.Unix(1499293724, 0)
+	messages := make(chan *loggregator_v2.Envelope, 10)
+	e := loadEngine(t, diskRule, messages, alert.WithClock(func() time.Time { return now }))
+
+	e.Observe(heartbeat("cf", "router", "id-1", 95))
+	now = now.Add(3 * time.Minute)
+	e.Observe(heartbeat("cf", "router", "id-1", 80))
+	now = now.Add(3 * time.Minute)
+	e.Observe(heartbeat("cf", "router", "id-1", 95))
+
+	Expect(messages).To(BeEmpty())
+}
+
+func TestRuleResolvesBelowClearThreshold(t *testing.T) {
+	RegisterTestingT(t)
+
+	now := time.Unix(1499293724, 0)
+	messages := make(chan *loggregator_v2.Envelope, 10)
+	e := loadEngine(t, `{"rules": [{
+		"name": "disk-full",
+		"metric": "system.disk.persistent.percent",
+		"op": ">",
+		"threshold": 90,
+		"clear_threshold": 85
+	}]}`, messages, alert.WithClock(func() time.Time { return now }))
+
+	e.Observe(heartbeat("cf", "router", "id-1", 95))
+	Expect(messages).To(HaveLen(1))
+	<-messages
+
+	e.Observe(heartbeat("cf", "router", "id-1", 88))
+	Expect(messages).To(BeEmpty())
+
+	e.Observe(heartbeat("cf", "router", "id-1", 84))
+	Expect(messages).To(HaveLen(1))
+	envelope := <-messages
+	Expect(envelope.GetTags()).To(HaveKeyWithValue("state", "resolved"))
+	Expect(envelope.GetEvent().GetTitle()).To(Equal("alert disk-full resolved"))
+}
+
+func TestRuleMatchesDeploymentAndJob(t *testing.T) {
+	RegisterTestingT(t)
+
+	messages := make(chan *loggregator_v2.Envelope, 10)
+	e := loadEngine(t, `{"rules": [{
+		"name": "cf-cpu",
+		"metric": "system.cpu.user",
+		"deployment": "cf-*",
+		"job": "router",
+		"op": ">=",
+		"threshold": 90
+	}]}`, messages)
+
+	e.Observe(metricHeartbeat("redis", "router", "id-1", "system.cpu.user", 95))
+	e.Observe(metricHeartbeat("cf-prod", "diego-cell", "id-2", "system.cpu.user", 95))
+	e.Observe(metricHeartbeat("cf-prod", "router", "id-3", "system.mem.percent", 95))
+	Expect(messages).To(BeEmpty())
+
+	e.Observe(metricHeartbeat("cf-prod", "router", "id-4", "system.cpu.user", 90))
+	Expect(messages).To(HaveLen(1))
+}
+
+func TestRuleLogsTransitions(t *testing.T) {
+	RegisterTestingT(t)
+
+	var buf bytes.Buffer
+	messages := make(chan *loggregator_v2.Envelope, 10)
+	e := loadEngine(t, `{"rules": [{"name": "disk-full", "metric": "system.disk.persistent.percent", "op": ">", "threshold": 90}]}`,
+		messages,
+		alert.WithLogger(slog.New(slog.NewTextHandler(&buf, nil))),
+	)
+
+	e.Observe(heartbeat("cf", "router", "id-1", 95))
+
+	Expect(buf.String()).To(ContainSubstring(`msg="alert disk-full firing" rule=disk-full state=firing metric=system.disk.persistent.percent value=95 deployment=cf job=router id=id-1`))
+}
+
+func TestServeHTTPReportsRuleStates(t *testing.T) {
+	RegisterTestingT(t)
+
+	now := time.Unix(1499293724, 0).UTC()
+	messages := make(chan *loggregator_v2.Envelope, 10)
+	e := loadEngine(t, diskRule, messages, alert.WithClock(func() time.Time { return now }))
+
+	e.Observe(heartbeat("cf", "router", "id-1", 95))
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/alerts", nil))
+
+	var statuses []alert.RuleStatus
+	Expect(json.Unmarshal(rec.Body.Bytes(), &statuses)).To(Succeed())
+	Expect(statuses).To(Equal([]alert.RuleStatus{{
+		Name:   "disk-full",
+		Metric: "system.disk.persistent.percent",
+		Instances: []alert.InstanceStatus{{
+			Deployment: "cf",
+			Job:        "router",
+			ID:         "id-1",
+			State:      "pending",
+			Since:      now,
+			Value:      95,
+		}},
+	}}))
+}
+
+func TestLoadWithInvalidConfig(t *testing.T) {
+	RegisterTestingT(t)
+
+	for _, c := range []string{
+		"wont-parse-json",
+		`{"rules": [{"metric": "system.healthy", "op": "<", "threshold": 1}]}`,
+		`{"rules": [{"name": "no-metric", "op": "<", "threshold": 1}]}`,
+		`{"rules": [{"name": "bad-op", "metric": "system.healthy", "op": "==", "threshold": 1}]}`,
+		`{"rules": [{"name": "bad-for", "metric": "system.healthy", "op": "<", "threshold": 1, "for": "soon"}]}`,
+		`{"rules": [{"name": "bad-glob", "metric": "system.healthy", "op": "<", "threshold": 1, "job": "["}]}`,
+		`{"rules": [{"name": "bad-clear", "metric": "system.healthy", "op": ">", "threshold": 90, "clear_threshold": 95}]}`,
+		`{"rules": [
+			{"name": "dup", "metric": "system.healthy", "op": "<", "threshold": 1},
+			{"name": "dup", "metric": "system.healthy", "op": "<", "threshold": 1}
+		]}`,
+	} {
+		_, err := alert.Load(writeFile(t, c), nil)
+		Expect(err).To(HaveOccurred(), c)
+	}
+}
+
+func loadEngine(t *testing.T, config string, messages chan *loggregator_v2.Envelope, opts ...alert.EngineOpt) *alert.Engine {
+	e, err := alert.Load(writeFile(t, config), messages, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return e
+}
+
+func writeFile(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "alerts.json")
+	err := os.WriteFile(path, []byte(contents), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func heartbeat(deployment, job, instanceID string, diskPercent float64) *definitions.Event {
+	return metricHeartbeat(deployment, job, instanceID, "system.disk.persistent.percent", diskPercent)
+}
+
+func metricHeartbeat(deployment, job, instanceID, metric string, value float64) *definitions.Event {
+	return &definitions.Event{
+		Deployment: deployment,
+		Message: &definitions.Event_Heartbeat{
+			Heartbeat: &definitions.Heartbeat{
+				Job:        job,
+				InstanceId: instanceID,
+				Metrics: []*definitions.Heartbeat_Metric{
+					{Name: metric, Value: value},
+				},
+			},
+		},
+	}
+}
@@ -3,30 +3,117 @@ package auth
 import (
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"sync"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	uaaURLActiveGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "auth",
+		Name:      "uaa_url_active",
+		Help:      "Whether the uaa url is used for token requests",
+	}, []string{"url"})
+	uaaURLErrCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "auth",
+		Name:      "uaa_url_err",
+		Help:      "Tracks token requests failing because the uaa url is unreachable",
+	}, []string{"url"})
+)
+
+func init() {
+	prometheus.MustRegister(uaaURLActiveGauge)
+	prometheus.MustRegister(uaaURLErrCounter)
+}
+
+const (
+	// DefaultAddrTTL is how long the uaa urls of the info response are
+	// used before the info endpoint is requested again.
+	DefaultAddrTTL = 10 * time.Minute
+
+	// DefaultRediscoverAfter is the number of consecutive unreachable uaa
+	// urls after which the info endpoint is requested again.
+	DefaultRediscoverAfter = 3
 )
 
 type infoResponse struct {
+	Name               string `json:"name"`
+	UUID               string `json:"uuid"`
+	Version            string `json:"version"`
 	UserAuthentication struct {
 		AuthType string `json:"type"`
 		Options  struct {
-			Url string `json:"url"`
+			Url  string   `json:"url"`
+			Urls []string `json:"urls"`
 		} `json:"options"`
 	} `json:"user_authentication"`
 }
 
+// UnsupportedAuthTypeError is returned when the director does not use uaa
+// for user authentication, such as directors configured for basic auth.
+type UnsupportedAuthTypeError struct {
+	Type string
+}
+
+func (e *UnsupportedAuthTypeError) Error() string {
+	return fmt.Sprintf("director uses %q user authentication, only uaa is supported", e.Type)
+}
+
+// DirectorInfo identifies a bosh director.
+type DirectorInfo struct {
+	Name    string
+	UUID    string
+	Version string
+}
+
+// AddressProvider discovers the uaa urls of the director from its info
+// endpoint. The urls are cached for a ttl. Token requests fail over to
+// the next advertised url when the current one is unreachable.
 type AddressProvider struct {
-	infoURL    string
-	httpClient *http.Client
-	authAddr   string
+	infoURL         string
+	httpClient      *http.Client
+	ttl             time.Duration
+	rediscoverAfter int
+
+	mu        sync.RWMutex
+	authAddrs []string
+	current   int
+	expiresAt time.Time
+	// stale is set once rediscoverAfter consecutive urls were unreachable.
+	stale    bool
+	failures int
+	info     DirectorInfo
+}
+
+type AddressProviderOpt func(*AddressProvider)
+
+// WithAddrTTL sets how long the uaa urls are used before the info endpoint
+// is requested again. A ttl of 0 caches them until a refresh. Defaults to
+// DefaultAddrTTL.
+func WithAddrTTL(ttl time.Duration) AddressProviderOpt {
+	return func(a *AddressProvider) {
+		a.ttl = ttl
+	}
+}
+
+// WithRediscoverAfter sets the number of consecutive unreachable uaa urls
+// after which the info endpoint is requested again. Defaults to
+// DefaultRediscoverAfter.
+func WithRediscoverAfter(n int) AddressProviderOpt {
+	return func(a *AddressProvider) {
+		a.rediscoverAfter = n
+	}
 }
 
 // NewAddressProvider returns a new AddressProvider
 // that has been configured with the bosh director url and tlsConfig.
-func NewAddressProvider(url string, c *tls.Config) *AddressProvider {
-	return &AddressProvider{
+func NewAddressProvider(url string, c *tls.Config, opts ...AddressProviderOpt) *AddressProvider {
+	a := &AddressProvider{
 		infoURL: url,
 		httpClient: &http.Client{
 			Transport: &http.Transport{
@@ -34,32 +121,216 @@ func NewAddressProvider(url string, c *tls.Config) *AddressProvider {
 			},
 			Timeout: 30 * time.Second,
 		},
+		ttl:             DefaultAddrTTL,
+		rediscoverAfter: DefaultRediscoverAfter,
+	}
+
+	for _, o := range opts {
+		o(a)
 	}
+
+	return a
 }
 
-// Addr returns the url of the user authentication entity from the info response.
-// It returns an error if the request fails or response cannot be decoded.
+// Addr returns the current url of the user authentication entity from the
+// info response. The info endpoint is requested again once the urls
+// expired or too many of them were unreachable. The previous url is
+// returned if that request fails, unless the director no longer uses uaa.
+// It returns an error if the request fails or response cannot be decoded
+// and no url is known.
 func (a *AddressProvider) Addr() (string, error) {
-	if a.authAddr != "" {
-		return a.authAddr, nil
+	a.mu.RLock()
+	authAddr, fresh := a.currentAddr()
+	a.mu.RUnlock()
+
+	if authAddr != "" && fresh {
+		return authAddr, nil
+	}
+
+	err := a.Refresh()
+	var typeErr *UnsupportedAuthTypeError
+	if err != nil && (authAddr == "" || errors.As(err, &typeErr)) {
+		return "", err
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	authAddr, _ = a.currentAddr()
+	return authAddr, nil
+}
+
+// Addrs returns all uaa urls from the latest info response.
+func (a *AddressProvider) Addrs() []string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return append([]string(nil), a.authAddrs...)
+}
+
+// currentAddr returns the url token requests are sent to and whether it
+// can be used without requesting the info endpoint again.
+func (a *AddressProvider) currentAddr() (string, bool) {
+	if len(a.authAddrs) == 0 {
+		return "", false
 	}
+
+	fresh := !a.stale && (a.ttl <= 0 || time.Now().Before(a.expiresAt))
+	return a.authAddrs[a.current], fresh
+}
+
+// Failed reports that the uaa at addr is unreachable. Token requests are
+// sent to the next advertised url from then on.
+func (a *AddressProvider) Failed(addr string) {
+	uaaURLErrCounter.WithLabelValues(addr).Inc()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.failures++
+	if a.rediscoverAfter > 0 && a.failures >= a.rediscoverAfter {
+		a.stale = true
+	}
+
+	if len(a.authAddrs) > 1 && a.authAddrs[a.current] == addr {
+		a.current = (a.current + 1) % len(a.authAddrs)
+		a.setActive()
+	}
+}
+
+// Succeeded reports that a token was retrieved from the uaa at addr.
+func (a *AddressProvider) Succeeded(addr string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.failures = 0
+}
+
+// setActive exposes which of the urls is current.
+func (a *AddressProvider) setActive() {
+	for i, addr := range a.authAddrs {
+		active := 0.0
+		if i == a.current {
+			active = 1
+		}
+		uaaURLActiveGauge.WithLabelValues(addr).Set(active)
+	}
+}
+
+// Info returns the director metadata from the latest info response.
+// It is empty until the info endpoint has been successfully requested.
+func (a *AddressProvider) Info() DirectorInfo {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.info
+}
+
+// Refresh requests the info endpoint and updates the cached addresses and
+// director metadata. The current url is kept if it is still advertised.
+// It returns an error if the request fails or response cannot be decoded.
+// It returns an *UnsupportedAuthTypeError if the director does not use
+// uaa, after updating the director metadata.
+func (a *AddressProvider) Refresh() error {
 	resp, err := a.httpClient.Get(fmt.Sprintf("%s/info", a.infoURL))
 	if err != nil {
-		return "", err
+		return err
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("info endpoint returned bad status code: %d", resp.StatusCode)
+		return fmt.Errorf("info endpoint returned bad status code: %d", resp.StatusCode)
 	}
-	defer resp.Body.Close()
 
 	var info infoResponse
 	decoder := json.NewDecoder(resp.Body)
 	err = decoder.Decode(&info)
 	if err != nil {
-		return "", err
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.info = DirectorInfo{
+		Name:    info.Name,
+		UUID:    info.UUID,
+		Version: info.Version,
+	}
+
+	authType := info.UserAuthentication.AuthType
+	if authType != "" && authType != "uaa" {
+		a.setAddrs(nil)
+		return &UnsupportedAuthTypeError{Type: authType}
+	}
+
+	addrs := uaaURLs(info.UserAuthentication.Options.Url, info.UserAuthentication.Options.Urls)
+	if len(addrs) == 0 {
+		return errors.New("info endpoint does not advertise a uaa url")
+	}
+	a.setAddrs(addrs)
+	a.expiresAt = time.Now().Add(a.ttl)
+	a.stale = false
+	a.failures = 0
+
+	return nil
+}
+
+// setAddrs replaces the urls, keeping the current url if it is still
+// advertised.
+func (a *AddressProvider) setAddrs(addrs []string) {
+	current := 0
+	for i, addr := range addrs {
+		if len(a.authAddrs) > 0 && addr == a.authAddrs[a.current] {
+			current = i
+		}
+	}
+
+	for _, old := range a.authAddrs {
+		uaaURLActiveGauge.DeleteLabelValues(old)
+	}
+	a.authAddrs = addrs
+	a.current = current
+	a.setActive()
+}
+
+// uaaURLs returns the advertised uaa urls with the primary url first.
+func uaaURLs(primary string, urls []string) []string {
+	var addrs []string
+	for _, u := range append([]string{primary}, urls...) {
+		if u != "" && !contains(addrs, u) {
+			addrs = append(addrs, u)
+		}
 	}
-	a.authAddr = info.UserAuthentication.Options.Url
 
-	return a.authAddr, nil
+	return addrs
+}
+
+// Start spins a new go routine that refreshes the info every interval,
+// starting immediately.
+// It returns a shutdown function that blocks until the go routine has
+// exited.
+func (a *AddressProvider) Start(interval time.Duration, l *slog.Logger) func() {
+	done := make(chan struct{})
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		for {
+			err := a.Refresh()
+			if err != nil {
+				l.Warn("unable to refresh director info", "error", err)
+			}
+
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}
 }
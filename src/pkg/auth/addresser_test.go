@@ -1,15 +1,19 @@
 package auth_test
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
 	"sync"
 	"testing"
+	"time"
 
-	. "github.com/onsi/gomega"
 	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/auth"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/logging"
+	. "github.com/onsi/gomega"
 )
 
 func TestAuthServerAddrMakesRequestToInfoServer(t *testing.T) {
@@ -75,8 +79,178 @@ func TestAuthServerWithUnparseableInfoRequest(t *testing.T) {
 	Expect(err).To(HaveOccurred())
 }
 
+func TestAuthServerInfoReturnsDirectorMetadata(t *testing.T) {
+	RegisterTestingT(t)
+
+	sis := newSpyInfoServer(validInfoResponse("https://some-url.com"), 200)
+	infoServer := httptest.NewServer(sis)
+	defer infoServer.Close()
+
+	addrProvider := auth.NewAddressProvider(infoServer.URL, nil)
+	Expect(addrProvider.Info()).To(Equal(auth.DirectorInfo{}))
+
+	_, err := addrProvider.Addr()
+	Expect(err).ToNot(HaveOccurred())
+
+	Expect(addrProvider.Info()).To(Equal(auth.DirectorInfo{
+		Name:    "Bosh Lite Director",
+		UUID:    "3f20c4a3-0ef0-4443-8f39-efef33f502a7",
+		Version: "262.3.0 (00000000)",
+	}))
+}
+
+func TestAuthServerRefreshUpdatesAddressAndInfo(t *testing.T) {
+	RegisterTestingT(t)
+
+	sis := newSpyInfoServer(validInfoResponse("https://some-url.com"), 200)
+	infoServer := httptest.NewServer(sis)
+	defer infoServer.Close()
+
+	addrProvider := auth.NewAddressProvider(infoServer.URL, nil)
+	_, err := addrProvider.Addr()
+	Expect(err).ToNot(HaveOccurred())
+
+	sis.SetBody(`{"name":"other-director","uuid":"other-uuid","version":"280.0.0","user_authentication":{"type":"uaa","options":{"url":"https://other-url.com"}}}`)
+	Expect(addrProvider.Refresh()).To(Succeed())
+
+	a, err := addrProvider.Addr()
+	Expect(err).ToNot(HaveOccurred())
+	Expect(a).To(Equal("https://other-url.com"))
+	Expect(addrProvider.Info()).To(Equal(auth.DirectorInfo{
+		Name:    "other-director",
+		UUID:    "other-uuid",
+		Version: "280.0.0",
+	}))
+}
+
+func TestAuthServerStartRefreshesPeriodically(t *testing.T) {
+	RegisterTestingT(t)
+
+	sis := newSpyInfoServer(validInfoResponse("https://some-url.com"), 200)
+	infoServer := httptest.NewServer(sis)
+	defer infoServer.Close()
+
+	addrProvider := auth.NewAddressProvider(infoServer.URL, nil)
+	stop := addrProvider.Start(time.Millisecond, logging.Discard())
+	defer stop()
+
+	Eventually(sis.Calls).Should(BeNumerically(">", 1))
+	Expect(addrProvider.Info().Name).To(Equal("Bosh Lite Director"))
+}
+
+func TestAuthServerAddrWithNonUAADirector(t *testing.T) {
+	RegisterTestingT(t)
+
+	sis := newSpyInfoServer(`{"name":"basic-director","uuid":"uuid-1","user_authentication":{"type":"basic","options":{}}}`, 200)
+	infoServer := httptest.NewServer(sis)
+	defer infoServer.Close()
+
+	addrProvider := auth.NewAddressProvider(infoServer.URL, nil)
+	_, err := addrProvider.Addr()
+
+	var typeErr *auth.UnsupportedAuthTypeError
+	Expect(errors.As(err, &typeErr)).To(BeTrue())
+	Expect(err).To(MatchError(`director uses "basic" user authentication, only uaa is supported`))
+	Expect(addrProvider.Info().Name).To(Equal("basic-director"))
+}
+
+func TestAuthServerAddrFailsOverAcrossURLs(t *testing.T) {
+	RegisterTestingT(t)
+
+	sis := newSpyInfoServer(multiURLInfoResponse("https://uaa-1.com", "https://uaa-1.com", "https://uaa-2.com"), 200)
+	infoServer := httptest.NewServer(sis)
+	defer infoServer.Close()
+
+	addrProvider := auth.NewAddressProvider(infoServer.URL, nil)
+	Expect(addrProvider.Addr()).To(Equal("https://uaa-1.com"))
+	Expect(addrProvider.Addrs()).To(Equal([]string{"https://uaa-1.com", "https://uaa-2.com"}))
+
+	addrProvider.Failed("https://uaa-1.com")
+	Expect(addrProvider.Addr()).To(Equal("https://uaa-2.com"))
+
+	addrProvider.Failed("https://uaa-2.com")
+	Expect(addrProvider.Addr()).To(Equal("https://uaa-1.com"))
+	Expect(sis.Calls()).To(Equal(1))
+}
+
+func TestAuthServerAddrExpires(t *testing.T) {
+	RegisterTestingT(t)
+
+	sis := newSpyInfoServer(validInfoResponse("https://some-url.com"), 200)
+	infoServer := httptest.NewServer(sis)
+	defer infoServer.Close()
+
+	addrProvider := auth.NewAddressProvider(infoServer.URL, nil, auth.WithAddrTTL(time.Millisecond))
+	Expect(addrProvider.Addr()).To(Equal("https://some-url.com"))
+
+	time.Sleep(10 * time.Millisecond)
+	sis.SetBody(validInfoResponse("https://other-url.com"))
+
+	Expect(addrProvider.Addr()).To(Equal("https://other-url.com"))
+	Expect(sis.Calls()).To(Equal(2))
+}
+
+func TestAuthServerAddrKeepsExpiredAddressWhenInfoFails(t *testing.T) {
+	RegisterTestingT(t)
+
+	sis := newSpyInfoServer(validInfoResponse("https://some-url.com"), 200)
+	infoServer := httptest.NewServer(sis)
+	defer infoServer.Close()
+
+	addrProvider := auth.NewAddressProvider(infoServer.URL, nil, auth.WithAddrTTL(time.Millisecond))
+	Expect(addrProvider.Addr()).To(Equal("https://some-url.com"))
+
+	time.Sleep(10 * time.Millisecond)
+	sis.SetStatus(500)
+
+	Expect(addrProvider.Addr()).To(Equal("https://some-url.com"))
+	Expect(sis.Calls()).To(Equal(2))
+}
+
+func TestAuthServerAddrRediscoversAfterRepeatedFailures(t *testing.T) {
+	RegisterTestingT(t)
+
+	sis := newSpyInfoServer(validInfoResponse("https://some-url.com"), 200)
+	infoServer := httptest.NewServer(sis)
+	defer infoServer.Close()
+
+	addrProvider := auth.NewAddressProvider(infoServer.URL, nil, auth.WithRediscoverAfter(2))
+	Expect(addrProvider.Addr()).To(Equal("https://some-url.com"))
+
+	sis.SetBody(validInfoResponse("https://moved-url.com"))
+	addrProvider.Failed("https://some-url.com")
+	Expect(addrProvider.Addr()).To(Equal("https://some-url.com"))
+	Expect(sis.Calls()).To(Equal(1))
+
+	addrProvider.Failed("https://some-url.com")
+	Expect(addrProvider.Addr()).To(Equal("https://moved-url.com"))
+	Expect(sis.Calls()).To(Equal(2))
+}
+
+func TestAuthServerSucceededResetsFailures(t *testing.T) {
+	RegisterTestingT(t)
+
+	sis := newSpyInfoServer(validInfoResponse("https://some-url.com"), 200)
+	infoServer := httptest.NewServer(sis)
+	defer infoServer.Close()
+
+	addrProvider := auth.NewAddressProvider(infoServer.URL, nil, auth.WithRediscoverAfter(2))
+	Expect(addrProvider.Addr()).To(Equal("https://some-url.com"))
+
+	addrProvider.Failed("https://some-url.com")
+	addrProvider.Succeeded("https://some-url.com")
+	addrProvider.Failed("https://some-url.com")
+	Expect(addrProvider.Addr()).To(Equal("https://some-url.com"))
+	Expect(sis.Calls()).To(Equal(1))
+}
+
+func multiURLInfoResponse(authAddr string, urls ...string) string {
+	list, _ := json.Marshal(urls)
+	return fmt.Sprintf(`{"name":"Bosh Lite Director","user_authentication":{"type":"uaa","options":{"url":%q,"urls":%s}}}`, authAddr, list)
+}
+
 func validInfoResponse(authAddr string) string {
-	responseTemplate := `{"name":"Bosh Lite Director","uuid":"3f20c4a3-0ef0-4443-8f39-efef33f502a7","version":"262.3.0 (00000000)","user":null,"cpi":"warden_cpi","user_authentication":{"type":"uaa","options":{"url":"%0s","urls":["%0s"]}},"features":{"dns":{"status":false,"extras":{"domain_name":"bosh"}},"compiled_package_cache":{"status":false,"extras":{"provider":null}},"snapshots":{"status":false},"config_server":{"status":false,"extras":{"urls":[]}}}}`
+	responseTemplate := `{"name":"Bosh Lite Director","uuid":"3f20c4a3-0ef0-4443-8f39-efef33f502a7","version":"262.3.0 (00000000)","user":null,"cpi":"warden_cpi","user_authentication":{"type":"uaa","options":{"url":"%[1]s","urls":["%[1]s"]}},"features":{"dns":{"status":false,"extras":{"domain_name":"bosh"}},"compiled_package_cache":{"status":false,"extras":{"provider":null}},"snapshots":{"status":false},"config_server":{"status":false,"extras":{"urls":[]}}}}`
 	return fmt.Sprintf(responseTemplate, authAddr)
 }
 
@@ -96,6 +270,24 @@ func newSpyInfoServer(body string, status int) *spyInfoServer {
 	}
 }
 
+func (a *spyInfoServer) SetBody(body string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.body = body
+}
+
+func (a *spyInfoServer) SetStatus(status int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.status = status
+}
+
+func (a *spyInfoServer) Calls() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.CallCount
+}
+
 func (a *spyInfoServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
@@ -3,28 +3,169 @@ package auth
 import (
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	tokenExpiryGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "auth",
+		Name:      "token_expiry_timestamp_seconds",
+		Help:      "When the latest validated token of the uaa client expires",
+	}, []string{"director", "client"})
+	tokenScopeGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "auth",
+		Name:      "token_scope",
+		Help:      "The scopes and authorities granted to the latest validated token of the uaa client",
+	}, []string{"director", "client", "scope"})
+	tokenInvalidCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "auth",
+		Name:      "token_invalid",
+		Help:      "Tracks tokens rejected by the validation by reason",
+	}, []string{"director", "client", "reason"})
 )
 
+func init() {
+	prometheus.MustRegister(tokenExpiryGauge)
+	prometheus.MustRegister(tokenScopeGauge)
+	prometheus.MustRegister(tokenInvalidCounter)
+}
+
 type addresser interface {
 	Addr() (string, error)
 }
 
+// failoverAddresser is an addresser of several uaa urls that is told which
+// of them are unreachable, like the AddressProvider.
+type failoverAddresser interface {
+	addresser
+	Failed(addr string)
+	Succeeded(addr string)
+}
+
+// unreachableError is the error of a token request to a uaa url that
+// cannot be reached or does not serve tokens.
+type unreachableError struct {
+	err error
+}
+
+func (e *unreachableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *unreachableError) Unwrap() error {
+	return e.err
+}
+
+// The methods of authenticating the client at the token endpoint.
+const (
+	// ClientSecretPost sends the client credentials in the form body.
+	ClientSecretPost = "client_secret_post"
+	// ClientSecretBasic sends the client credentials in the Authorization
+	// header.
+	ClientSecretBasic = "client_secret_basic"
+)
+
 type Auth struct {
 	httpClient   *http.Client
 	addrProvider addresser
 	authAddr     string
 	clientID     string
 	clientSecret string
+	authMethod   string
+
+	mu     sync.Mutex
+	expiry time.Time
+
+	// refreshToken is used for the refresh_token grant when it is set.
+	// configuredRefresh is set if it was configured rather than issued
+	// along with a client_credentials token.
+	refreshToken      string
+	configuredRefresh bool
+
+	// requirements are checked against the claims of every token when
+	// they are set.
+	requirements    *Requirements
+	verifySignature bool
+	keys            *KeySet
+
+	// director labels the token metrics.
+	director     string
+	logger       *slog.Logger
+	warnedOpaque atomic.Bool
+}
+
+type AuthOpt func(*Auth)
+
+// WithClientSecretBasic sends the client credentials in the Authorization
+// header rather than the form body, for token endpoints that reject form
+// posted client secrets.
+func WithClientSecretBasic() AuthOpt {
+	return func(a *Auth) {
+		a.authMethod = ClientSecretBasic
+	}
+}
+
+// WithRefreshToken retrieves tokens with the refresh_token grant rather
+// than the client_credentials grant. Refresh tokens issued in exchange
+// replace the configured one.
+func WithRefreshToken(token string) AuthOpt {
+	return func(a *Auth) {
+		a.refreshToken = token
+		a.configuredRefresh = token != ""
+	}
+}
+
+// WithValidation decodes the claims of every token and checks them
+// against the requirements, so that a token that cannot be used fails
+// Token with an actionable error rather than being rejected by the
+// metrics server. The expiry and scopes of validated tokens are exposed
+// as metrics. Opaque tokens cannot be validated and are used as they are,
+// unless signature verification is enabled.
+func WithValidation(r Requirements) AuthOpt {
+	return func(a *Auth) {
+		a.requirements = &r
+	}
+}
+
+// WithSignatureVerification also verifies the signature of every token
+// against the token keys of the uaa. It implies validation of the
+// expiry.
+func WithSignatureVerification() AuthOpt {
+	return func(a *Auth) {
+		a.verifySignature = true
+	}
+}
+
+// WithDirector sets the name of the director whose uaa issues the tokens.
+// The name is used to label the token metrics.
+func WithDirector(name string) AuthOpt {
+	return func(a *Auth) {
+		a.director = name
+	}
+}
+
+// WithLogger sets the logger warning about tokens that cannot be
+// validated.
+func WithLogger(l *slog.Logger) AuthOpt {
+	return func(a *Auth) {
+		a.logger = l
+	}
 }
 
 // New returns a new Auth.
-func New(a addresser, clientID string, clientSecret string, tlsConfig *tls.Config) *Auth {
-	return &Auth{
+func New(a addresser, clientID string, clientSecret string, tlsConfig *tls.Config, opts ...AuthOpt) *Auth {
+	auth := &Auth{
 		httpClient: &http.Client{
 			Transport: &http.Transport{
 				TLSClientConfig: tlsConfig,
@@ -34,41 +175,169 @@ func New(a addresser, clientID string, clientSecret string, tlsConfig *tls.Confi
 		addrProvider: a,
 		clientID:     clientID,
 		clientSecret: clientSecret,
+		authMethod:   ClientSecretPost,
+		logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+
+	for _, o := range opts {
+		o(auth)
 	}
+
+	if auth.verifySignature {
+		if auth.requirements == nil {
+			auth.requirements = &Requirements{}
+		}
+		auth.keys = NewKeySet(a, auth.httpClient)
+	}
+
+	return auth
 }
 
 type authResponse struct {
-	AccessToken string `json:"access_token"`
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// errorResponse is the body of a failed token request.
+type errorResponse struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+// Expiry returns when the latest token expires. It is zero until a token
+// with a lifetime was retrieved.
+func (a *Auth) Expiry() time.Time {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.expiry
 }
 
 // Token returns the token provided by the auth endpoint.
-// It returns an error if the  request fails or the response cannot be decoded.
+// When a refresh token is known the refresh_token grant is used. A refresh
+// token issued along with a client_credentials token that is rejected is
+// dropped in favour of the client_credentials grant.
+// It returns an error if the  request fails or the response cannot be decoded,
+// and a *ValidationError if the token is validated and does not meet the
+// requirements.
 func (a *Auth) Token() (string, error) {
-	addr, err := a.addrProvider.Addr()
+	token, err := a.token()
+	if err != nil || a.requirements == nil {
+		return token, err
+	}
+
+	err = a.validate(token)
 	if err != nil {
+		var vErr *ValidationError
+		if errors.As(err, &vErr) {
+			tokenInvalidCounter.WithLabelValues(a.director, a.clientID, vErr.Reason).Inc()
+		}
 		return "", err
 	}
 
-	form := url.Values{}
-	form.Set("client_id", a.clientID)
-	form.Set("client_secret", a.clientSecret)
-	form.Set("grant_type", "client_credentials")
+	return token, nil
+}
+
+func (a *Auth) token() (string, error) {
+	a.mu.Lock()
+	refreshToken, configured := a.refreshToken, a.configuredRefresh
+	a.mu.Unlock()
+
+	if refreshToken == "" {
+		return a.requestToken(url.Values{"grant_type": {"client_credentials"}})
+	}
+
+	token, err := a.requestToken(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+	})
+	if err == nil || configured {
+		return token, err
+	}
+
+	a.mu.Lock()
+	a.refreshToken = ""
+	a.mu.Unlock()
+
+	return a.requestToken(url.Values{"grant_type": {"client_credentials"}})
+}
+
+// requestToken requests a token from the uaa. When the addresser advertises
+// several uaa urls, unreachable ones are reported and the request is
+// retried with every other url once.
+func (a *Auth) requestToken(form url.Values) (string, error) {
+	fa, failover := a.addrProvider.(failoverAddresser)
+	tried := make(map[string]bool)
+
+	var lastErr error
+	for {
+		addr, err := a.addrProvider.Addr()
+		if err != nil {
+			return "", err
+		}
+		if tried[addr] {
+			return "", lastErr
+		}
+		tried[addr] = true
+
+		token, err := a.requestTokenFrom(addr, form)
+		if !failover {
+			return token, err
+		}
+
+		var uErr *unreachableError
+		if !errors.As(err, &uErr) {
+			if err == nil {
+				fa.Succeeded(addr)
+			}
+			return token, err
+		}
+
+		fa.Failed(addr)
+		lastErr = err
+	}
+}
+
+func (a *Auth) requestTokenFrom(addr string, form url.Values) (string, error) {
+	requested := time.Now()
+
 	form.Set("response_type", "token")
+	if a.authMethod == ClientSecretPost {
+		form.Set("client_id", a.clientID)
+		form.Set("client_secret", a.clientSecret)
+	}
 
-	resp, err := a.httpClient.Post(
+	req, err := http.NewRequest(
+		http.MethodPost,
 		fmt.Sprintf("%s/oauth/token", addr),
-		"application/x-www-form-urlencoded",
 		strings.NewReader(form.Encode()),
 	)
 	if err != nil {
 		return "", err
 	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if a.authMethod == ClientSecretBasic {
+		// the credentials are form encoded before they are combined as
+		// required by RFC 6749.
+		req.SetBasicAuth(url.QueryEscape(a.clientID), url.QueryEscape(a.clientSecret))
+	}
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("auth endpoint returned bad status code: %d", resp.StatusCode)
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return "", &unreachableError{err: err}
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		err = statusError(form.Get("grant_type"), resp)
+		if resp.StatusCode == http.StatusNotFound || resp.StatusCode >= 500 {
+			return "", &unreachableError{err: err}
+		}
+		return "", err
+	}
+
 	var auth authResponse
 	decoder := json.NewDecoder(resp.Body)
 	err = decoder.Decode(&auth)
@@ -76,5 +345,67 @@ func (a *Auth) Token() (string, error) {
 		return "", err
 	}
 
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if auth.ExpiresIn > 0 {
+		a.expiry = requested.Add(time.Duration(auth.ExpiresIn) * time.Second)
+	}
+	if auth.RefreshToken != "" {
+		a.refreshToken = auth.RefreshToken
+	}
+
 	return auth.AccessToken, nil
 }
+
+// validate checks the claims and optionally the signature of the token and
+// records its expiry and scopes.
+func (a *Auth) validate(token string) error {
+	claims, err := ParseClaims(token)
+	if errors.Is(err, ErrNotJWT) && a.keys == nil {
+		if !a.warnedOpaque.Swap(true) {
+			a.logger.Warn("uaa issues opaque tokens, skipping token validation", "client", a.clientID)
+		}
+		return nil
+	}
+	if err != nil {
+		return &ValidationError{Reason: "malformed", Detail: err.Error()}
+	}
+
+	if a.keys != nil {
+		err = a.keys.Verify(token)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = claims.Validate(*a.requirements, time.Now())
+	if err != nil {
+		return err
+	}
+
+	tokenExpiryGauge.WithLabelValues(a.director, a.clientID).Set(float64(claims.ExpiresAt))
+	tokenScopeGauge.DeletePartialMatch(prometheus.Labels{"director": a.director, "client": a.clientID})
+	for _, granted := range [][]string{claims.Scopes, claims.Authorities} {
+		for _, s := range granted {
+			tokenScopeGauge.WithLabelValues(a.director, a.clientID, s).Set(1)
+		}
+	}
+
+	return nil
+}
+
+// statusError describes a failed token request including the oauth error
+// of the response if there is one.
+func statusError(grant string, resp *http.Response) error {
+	err := fmt.Errorf("auth endpoint returned bad status code: %d", resp.StatusCode)
+
+	var e errorResponse
+	if json.NewDecoder(resp.Body).Decode(&e) != nil || e.Error == "" {
+		return err
+	}
+	if e.Description != "" {
+		return fmt.Errorf("%s: %s grant failed with %s: %s", err, grant, e.Error, e.Description)
+	}
+
+	return fmt.Errorf("%s: %s grant failed with %s", err, grant, e.Error)
+}
@@ -10,6 +10,7 @@ import (
 
 	"fmt"
 	"sync"
+	"time"
 
 	. "github.com/onsi/gomega"
 
@@ -45,6 +46,263 @@ func TestToken(t *testing.T) {
 	Expect(receivedRequest.Form.Get("client_secret")).To(Equal(clientSecret))
 }
 
+func TestTokenWithClientSecretBasic(t *testing.T) {
+	RegisterTestingT(t)
+
+	sas := newSpyAuthServer(validAuthResponse("test-access-token"), 200)
+	testAuthServer := httptest.NewServer(sas)
+	defer testAuthServer.Close()
+
+	client := auth.New(newSpyAddresser(testAuthServer.URL, nil), "metrics client", "s3cr=t", nil, auth.WithClientSecretBasic())
+	token, err := client.Token()
+	Expect(err).ToNot(HaveOccurred())
+	Expect(token).To(Equal("test-access-token"))
+
+	receivedRequest := sas.LastRequest()
+	id, secret, ok := receivedRequest.BasicAuth()
+	Expect(ok).To(BeTrue())
+	Expect(id).To(Equal("metrics+client"))
+	Expect(secret).To(Equal("s3cr%3Dt"))
+
+	Expect(receivedRequest.ParseForm()).ToNot(HaveOccurred())
+	Expect(receivedRequest.Form.Get("grant_type")).To(Equal("client_credentials"))
+	Expect(receivedRequest.Form).ToNot(HaveKey("client_id"))
+	Expect(receivedRequest.Form).ToNot(HaveKey("client_secret"))
+}
+
+func TestTokenWithRefreshToken(t *testing.T) {
+	RegisterTestingT(t)
+
+	sas := newSpyAuthServer(`{"access_token":"access-1","refresh_token":"refresh-2","expires_in":60}`, 200)
+	testAuthServer := httptest.NewServer(sas)
+	defer testAuthServer.Close()
+
+	client := auth.New(newSpyAddresser(testAuthServer.URL, nil), "id", "secret", nil, auth.WithRefreshToken("refresh-1"))
+	token, err := client.Token()
+	Expect(err).ToNot(HaveOccurred())
+	Expect(token).To(Equal("access-1"))
+
+	receivedRequest := sas.LastRequest()
+	Expect(receivedRequest.ParseForm()).ToNot(HaveOccurred())
+	Expect(receivedRequest.Form.Get("grant_type")).To(Equal("refresh_token"))
+	Expect(receivedRequest.Form.Get("refresh_token")).To(Equal("refresh-1"))
+	Expect(receivedRequest.Form.Get("client_id")).To(Equal("id"))
+
+	_, err = client.Token()
+	Expect(err).ToNot(HaveOccurred())
+
+	receivedRequest = sas.LastRequest()
+	Expect(receivedRequest.ParseForm()).ToNot(HaveOccurred())
+	Expect(receivedRequest.Form.Get("refresh_token")).To(Equal("refresh-2"))
+}
+
+func TestTokenWithRejectedRefreshToken(t *testing.T) {
+	RegisterTestingT(t)
+
+	sas := newSpyAuthServer(`{"error":"invalid_token","error_description":"refresh token expired"}`, 401)
+	testAuthServer := httptest.NewServer(sas)
+	defer testAuthServer.Close()
+
+	client := auth.New(newSpyAddresser(testAuthServer.URL, nil), "id", "secret", nil, auth.WithRefreshToken("refresh-1"))
+	_, err := client.Token()
+
+	Expect(err).To(MatchError("auth endpoint returned bad status code: 401: refresh_token grant failed with invalid_token: refresh token expired"))
+	Expect(sas.Calls()).To(Equal(1))
+}
+
+func TestTokenFallsBackToClientCredentialsWhenIssuedRefreshTokenIsRejected(t *testing.T) {
+	RegisterTestingT(t)
+
+	sas := newSpyAuthServer(`{"access_token":"access-1","refresh_token":"refresh-1"}`, 200)
+	testAuthServer := httptest.NewServer(sas)
+	defer testAuthServer.Close()
+
+	client := auth.New(newSpyAddresser(testAuthServer.URL, nil), "id", "secret", nil)
+	_, err := client.Token()
+	Expect(err).ToNot(HaveOccurred())
+
+	sas.Respond(`{"error":"invalid_grant"}`, 400)
+	_, err = client.Token()
+	Expect(err).To(HaveOccurred())
+	Expect(sas.Calls()).To(Equal(3))
+
+	receivedRequest := sas.LastRequest()
+	Expect(receivedRequest.ParseForm()).ToNot(HaveOccurred())
+	Expect(receivedRequest.Form.Get("grant_type")).To(Equal("client_credentials"))
+}
+
+func TestTokenRecordsExpiry(t *testing.T) {
+	RegisterTestingT(t)
+
+	sas := newSpyAuthServer(validAuthResponse("test-access-token"), 200)
+	testAuthServer := httptest.NewServer(sas)
+	defer testAuthServer.Close()
+
+	client := auth.New(newSpyAddresser(testAuthServer.URL, nil), "id", "secret", nil)
+	Expect(client.Expiry()).To(BeZero())
+
+	before := time.Now()
+	_, err := client.Token()
+	Expect(err).ToNot(HaveOccurred())
+
+	Expect(client.Expiry()).To(BeTemporally("~", before.Add(43199*time.Second), time.Second))
+}
+
+func TestTokenWithValidation(t *testing.T) {
+	RegisterTestingT(t)
+
+	exp := time.Now().Add(time.Hour).Unix()
+	token := jwt(fmt.Sprintf(`{"client_id":"id","authorities":["bosh.system_metrics.read"],"aud":"bosh","exp":%d}`, exp))
+	sas := newSpyAuthServer(validAuthResponse(token), 200)
+	testAuthServer := httptest.NewServer(sas)
+	defer testAuthServer.Close()
+
+	client := auth.New(newSpyAddresser(testAuthServer.URL, nil), "id", "secret", nil,
+		auth.WithValidation(auth.Requirements{Scope: auth.SystemMetricsScope, Audience: "bosh"}),
+	)
+	actual, err := client.Token()
+
+	Expect(err).ToNot(HaveOccurred())
+	Expect(actual).To(Equal(token))
+}
+
+func TestTokenWithValidationFailsFast(t *testing.T) {
+	RegisterTestingT(t)
+
+	sas := newSpyAuthServer(validAuthResponse(jwt(`{"client_id":"id","scope":["uaa.none"]}`)), 200)
+	testAuthServer := httptest.NewServer(sas)
+	defer testAuthServer.Close()
+
+	client := auth.New(newSpyAddresser(testAuthServer.URL, nil), "id", "secret", nil,
+		auth.WithValidation(auth.Requirements{Scope: auth.SystemMetricsScope}),
+	)
+	token, err := client.Token()
+
+	Expect(token).To(BeEmpty())
+	Expect(err).To(MatchError(ContainSubstring("is missing the bosh.system_metrics.read authority")))
+
+	sas.Respond(validAuthResponse("a.!!!.c"), 200)
+	_, err = client.Token()
+
+	var vErr *auth.ValidationError
+	Expect(errors.As(err, &vErr)).To(BeTrue())
+	Expect(vErr.Reason).To(Equal("malformed"))
+}
+
+func TestTokenWithValidationAcceptsOpaqueTokens(t *testing.T) {
+	RegisterTestingT(t)
+
+	sas := newSpyAuthServer(validAuthResponse("opaque-token"), 200)
+	testAuthServer := httptest.NewServer(sas)
+	defer testAuthServer.Close()
+
+	client := auth.New(newSpyAddresser(testAuthServer.URL, nil), "id", "secret", nil,
+		auth.WithValidation(auth.Requirements{Scope: auth.SystemMetricsScope}),
+	)
+	token, err := client.Token()
+
+	Expect(err).ToNot(HaveOccurred())
+	Expect(token).To(Equal("opaque-token"))
+}
+
+func TestTokenWithSignatureVerificationRejectsOpaqueTokens(t *testing.T) {
+	RegisterTestingT(t)
+
+	sas := newSpyAuthServer(validAuthResponse("opaque-token"), 200)
+	testAuthServer := httptest.NewServer(sas)
+	defer testAuthServer.Close()
+
+	client := auth.New(newSpyAddresser(testAuthServer.URL, nil), "id", "secret", nil, auth.WithSignatureVerification())
+	_, err := client.Token()
+
+	var vErr *auth.ValidationError
+	Expect(errors.As(err, &vErr)).To(BeTrue())
+	Expect(vErr.Reason).To(Equal("malformed"))
+}
+
+func TestTokenWithSignatureVerification(t *testing.T) {
+	RegisterTestingT(t)
+
+	key := newRSAKey(t)
+	token := signedJWT(t, key, "key-1", `{"client_id":"id"}`)
+	sas := newSpyAuthServer(validAuthResponse(token), 200)
+	mux := http.NewServeMux()
+	mux.Handle("/oauth/token", sas)
+	mux.Handle("/token_keys", newSpyAuthServer(tokenKeys("key-1", key), 200))
+	testAuthServer := httptest.NewServer(mux)
+	defer testAuthServer.Close()
+
+	client := auth.New(newSpyAddresser(testAuthServer.URL, nil), "id", "secret", nil, auth.WithSignatureVerification())
+	actual, err := client.Token()
+	Expect(err).ToNot(HaveOccurred())
+	Expect(actual).To(Equal(token))
+
+	sas.Respond(validAuthResponse(signedJWT(t, newRSAKey(t), "key-1", `{"client_id":"id"}`)), 200)
+	_, err = client.Token()
+	Expect(err).To(MatchError(ContainSubstring(`token signature does not match key "key-1" of the uaa`)))
+}
+
+func TestTokenFailsOverToNextUAAURL(t *testing.T) {
+	RegisterTestingT(t)
+
+	down := httptest.NewServer(newSpyAuthServer("", 503))
+	defer down.Close()
+	sas := newSpyAuthServer(validAuthResponse("test-access-token"), 200)
+	up := httptest.NewServer(sas)
+	defer up.Close()
+
+	infoServer := httptest.NewServer(newSpyInfoServer(multiURLInfoResponse(down.URL, down.URL, up.URL), 200))
+	defer infoServer.Close()
+	addrProvider := auth.NewAddressProvider(infoServer.URL, nil)
+
+	client := auth.New(addrProvider, "id", "secret", nil)
+	token, err := client.Token()
+	Expect(err).ToNot(HaveOccurred())
+	Expect(token).To(Equal("test-access-token"))
+	Expect(addrProvider.Addr()).To(Equal(up.URL))
+
+	_, err = client.Token()
+	Expect(err).ToNot(HaveOccurred())
+	Expect(sas.Calls()).To(Equal(2))
+}
+
+func TestTokenReturnsErrorWhenAllUAAURLsAreUnreachable(t *testing.T) {
+	RegisterTestingT(t)
+
+	down := httptest.NewServer(newSpyAuthServer("", 503))
+	defer down.Close()
+	missing := httptest.NewServer(newSpyAuthServer("", 404))
+	defer missing.Close()
+
+	sis := newSpyInfoServer(multiURLInfoResponse(down.URL, down.URL, missing.URL), 200)
+	infoServer := httptest.NewServer(sis)
+	defer infoServer.Close()
+
+	client := auth.New(auth.NewAddressProvider(infoServer.URL, nil), "id", "secret", nil)
+	_, err := client.Token()
+
+	Expect(err).To(MatchError("auth endpoint returned bad status code: 404"))
+}
+
+func TestTokenDoesNotFailOverOnRejectedCredentials(t *testing.T) {
+	RegisterTestingT(t)
+
+	rejecting := httptest.NewServer(newSpyAuthServer(`{"error":"unauthorized"}`, 401))
+	defer rejecting.Close()
+	sas := newSpyAuthServer(validAuthResponse("test-access-token"), 200)
+	other := httptest.NewServer(sas)
+	defer other.Close()
+
+	infoServer := httptest.NewServer(newSpyInfoServer(multiURLInfoResponse(rejecting.URL, rejecting.URL, other.URL), 200))
+	defer infoServer.Close()
+
+	client := auth.New(auth.NewAddressProvider(infoServer.URL, nil), "id", "secret", nil)
+	_, err := client.Token()
+
+	Expect(err).To(MatchError(ContainSubstring("401")))
+	Expect(sas.Calls()).To(BeZero())
+}
+
 func TestTokenWithFailingAddresser(t *testing.T) {
 	RegisterTestingT(t)
 
@@ -97,6 +355,7 @@ type spyAuthServer struct {
 
 	mu          sync.Mutex
 	lastRequest *http.Request
+	calls       int
 }
 
 func newSpyAuthServer(body string, status int) *spyAuthServer {
@@ -106,12 +365,32 @@ func newSpyAuthServer(body string, status int) *spyAuthServer {
 	}
 }
 
+func (a *spyAuthServer) Respond(body string, status int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.body = body
+	a.status = status
+}
+
+func (a *spyAuthServer) LastRequest() *http.Request {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.lastRequest
+}
+
+func (a *spyAuthServer) Calls() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.calls
+}
+
 func (a *spyAuthServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
 	httputil.DumpRequest(r, true)
 	a.lastRequest = r
+	a.calls++
 
 	w.WriteHeader(a.status)
 	w.Write([]byte(a.body))
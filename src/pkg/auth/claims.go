@@ -0,0 +1,152 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SystemMetricsScope is the scope or authority required to subscribe to
+// the metrics server.
+const SystemMetricsScope = "bosh.system_metrics.read"
+
+// Claims are the claims of a UAA access token relevant to the forwarder.
+type Claims struct {
+	ClientID    string   `json:"client_id"`
+	Scopes      []string `json:"scope"`
+	Authorities []string `json:"authorities"`
+	Audience    audience `json:"aud"`
+	ExpiresAt   int64    `json:"exp"`
+}
+
+// Expiry returns when the token expires.
+func (c Claims) Expiry() time.Time {
+	return time.Unix(c.ExpiresAt, 0)
+}
+
+// HasScope reports whether scope was granted to the token as a scope or
+// an authority.
+func (c Claims) HasScope(scope string) bool {
+	for _, granted := range [][]string{c.Scopes, c.Authorities} {
+		for _, s := range granted {
+			if s == scope {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Requirements are the claims a token must have to be used.
+type Requirements struct {
+	// Scope must be granted as a scope or an authority.
+	Scope string
+	// Audience must be one of the audiences of the token when it is set.
+	Audience string
+}
+
+// ValidationError describes why a token does not meet the requirements.
+// Reason is one of expired, scope, audience, malformed or signature.
+type ValidationError struct {
+	Reason string
+	Detail string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid token: " + e.Detail
+}
+
+// Validate checks that the token is not expired at now and meets the
+// requirements.
+// It returns a *ValidationError otherwise.
+func (c Claims) Validate(r Requirements, now time.Time) error {
+	if c.ExpiresAt != 0 && !now.Before(c.Expiry()) {
+		return &ValidationError{
+			Reason: "expired",
+			Detail: fmt.Sprintf("token of client %q expired at %s, check the clocks of the forwarder and uaa", c.ClientID, c.Expiry().UTC().Format(time.RFC3339)),
+		}
+	}
+
+	if r.Scope != "" && !c.HasScope(r.Scope) {
+		return &ValidationError{
+			Reason: "scope",
+			Detail: fmt.Sprintf("token of client %q is missing the %s authority, granted %q: add it to the authorities of the uaa client", c.ClientID, r.Scope, c.granted()),
+		}
+	}
+
+	if r.Audience != "" && !contains(c.Audience, r.Audience) {
+		return &ValidationError{
+			Reason: "audience",
+			Detail: fmt.Sprintf("token of client %q is not issued for audience %q, audience is %q", c.ClientID, r.Audience, strings.Join(c.Audience, ",")),
+		}
+	}
+
+	return nil
+}
+
+// granted returns the scopes and authorities of the token.
+func (c Claims) granted() string {
+	return strings.Join(append(append([]string{}, c.Scopes...), c.Authorities...), ",")
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// audience is the aud claim, which is either a single string or a list.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if json.Unmarshal(b, &s) == nil {
+		*a = audience{s}
+		return nil
+	}
+
+	var list []string
+	err := json.Unmarshal(b, &list)
+	if err != nil {
+		return err
+	}
+	*a = list
+
+	return nil
+}
+
+// ErrNotJWT is returned by ParseClaims for opaque tokens.
+var ErrNotJWT = errors.New("token is not a jwt")
+
+// ParseClaims decodes the claims of the jwt access token. The signature
+// is not verified.
+// It returns ErrNotJWT if the token is not a jwt.
+func ParseClaims(token string) (Claims, error) {
+	token = strings.TrimPrefix(token, "bearer ")
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Claims{}, ErrNotJWT
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return Claims{}, fmt.Errorf("unable to decode token payload: %s", err)
+	}
+
+	var c Claims
+	err = json.Unmarshal(payload, &c)
+	if err != nil {
+		return Claims{}, fmt.Errorf("unable to decode token claims: %s", err)
+	}
+
+	return c, nil
+}
@@ -0,0 +1,122 @@
+package auth_test
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/auth"
+	. "github.com/onsi/gomega"
+)
+
+func TestParseClaims(t *testing.T) {
+	RegisterTestingT(t)
+
+	claims, err := auth.ParseClaims(jwt(`{
+		"client_id": "system-metrics",
+		"scope": ["bosh.system_metrics.read"],
+		"aud": "bosh",
+		"exp": 1499293724
+	}`))
+	Expect(err).ToNot(HaveOccurred())
+
+	Expect(claims.ClientID).To(Equal("system-metrics"))
+	Expect(claims.HasScope("bosh.system_metrics.read")).To(BeTrue())
+	Expect(claims.HasScope("bosh.admin")).To(BeFalse())
+	Expect([]string(claims.Audience)).To(Equal([]string{"bosh"}))
+	Expect(claims.Expiry()).To(Equal(time.Unix(1499293724, 0)))
+}
+
+func TestParseClaimsWithAuthoritiesAndAudienceList(t *testing.T) {
+	RegisterTestingT(t)
+
+	claims, err := auth.ParseClaims("bearer " + jwt(`{
+		"authorities": ["bosh.system_metrics.read"],
+		"aud": ["bosh", "uaa"]
+	}`))
+	Expect(err).ToNot(HaveOccurred())
+
+	Expect(claims.HasScope("bosh.system_metrics.read")).To(BeTrue())
+	Expect([]string(claims.Audience)).To(Equal([]string{"bosh", "uaa"}))
+}
+
+func TestParseClaimsWithInvalidToken(t *testing.T) {
+	RegisterTestingT(t)
+
+	for _, token := range []string{
+		"opaque-token",
+		"header.!!!.signature",
+		jwt("not-json"),
+	} {
+		_, err := auth.ParseClaims(token)
+		Expect(err).To(HaveOccurred(), token)
+	}
+}
+
+func jwt(claims string) string {
+	return "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".signature"
+}
+
+func TestValidate(t *testing.T) {
+	RegisterTestingT(t)
+
+	now := time.Unix(1499293000, 0)
+	claims, err := auth.ParseClaims(jwt(`{
+		"client_id": "system-metrics",
+		"authorities": ["bosh.system_metrics.read"],
+		"aud": ["bosh", "uaa"],
+		"exp": 1499293724
+	}`))
+	Expect(err).ToNot(HaveOccurred())
+
+	Expect(claims.Validate(auth.Requirements{Scope: auth.SystemMetricsScope, Audience: "bosh"}, now)).To(Succeed())
+	Expect(claims.Validate(auth.Requirements{}, now)).To(Succeed())
+}
+
+func TestValidateWithUnmetRequirements(t *testing.T) {
+	RegisterTestingT(t)
+
+	now := time.Unix(1499293000, 0)
+	claims, err := auth.ParseClaims(jwt(`{
+		"client_id": "system-metrics",
+		"scope": ["uaa.none"],
+		"aud": "uaa",
+		"exp": 1499293724
+	}`))
+	Expect(err).ToNot(HaveOccurred())
+
+	tests := []struct {
+		requirements auth.Requirements
+		now          time.Time
+		reason       string
+		message      string
+	}{
+		{
+			now:     time.Unix(1499293724, 0),
+			reason:  "expired",
+			message: `token of client "system-metrics" expired at 2017-07-05T22:28:44Z`,
+		},
+		{
+			requirements: auth.Requirements{Scope: auth.SystemMetricsScope},
+			now:          now,
+			reason:       "scope",
+			message:      `token of client "system-metrics" is missing the bosh.system_metrics.read authority, granted "uaa.none": add it to the authorities of the uaa client`,
+		},
+		{
+			requirements: auth.Requirements{Audience: "bosh"},
+			now:          now,
+			reason:       "audience",
+			message:      `token of client "system-metrics" is not issued for audience "bosh", audience is "uaa"`,
+		},
+	}
+
+	for _, tt := range tests {
+		err := claims.Validate(tt.requirements, tt.now)
+
+		var vErr *auth.ValidationError
+		Expect(errors.As(err, &vErr)).To(BeTrue(), tt.reason)
+		Expect(vErr.Reason).To(Equal(tt.reason))
+		Expect(err.Error()).To(ContainSubstring(tt.message))
+	}
+}
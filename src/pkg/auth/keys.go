@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keyRefetchInterval limits how often the token keys are requested when a
+// token is signed with an unknown key.
+const keyRefetchInterval = time.Minute
+
+type tokenKeysResponse struct {
+	Keys []struct {
+		Kid string `json:"kid"`
+		Kty string `json:"kty"`
+		Alg string `json:"alg"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	} `json:"keys"`
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// KeySet verifies the signature of tokens with the RS256 keys served by
+// the token_keys endpoint of the uaa.
+type KeySet struct {
+	addrProvider addresser
+	httpClient   *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+}
+
+// NewKeySet returns a KeySet that requests the keys from the uaa of the
+// addresser with the httpClient.
+func NewKeySet(a addresser, httpClient *http.Client) *KeySet {
+	return &KeySet{
+		addrProvider: a,
+		httpClient:   httpClient,
+	}
+}
+
+// Verify checks the RS256 signature of the jwt token. The keys are
+// requested again if the token is signed with an unknown key, at most
+// once a minute, to pick up rotated keys.
+// It returns a *ValidationError if the token is malformed or the signature
+// is invalid.
+func (k *KeySet) Verify(token string) error {
+	token = strings.TrimPrefix(token, "bearer ")
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return &ValidationError{Reason: "malformed", Detail: "token is not a jwt"}
+	}
+
+	var h tokenHeader
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err == nil {
+		err = json.Unmarshal(b, &h)
+	}
+	if err != nil {
+		return &ValidationError{Reason: "malformed", Detail: fmt.Sprintf("unable to decode token header: %s", err)}
+	}
+	if h.Alg != "RS256" {
+		return &ValidationError{Reason: "signature", Detail: fmt.Sprintf("token is signed with %s, only RS256 is supported", h.Alg)}
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return &ValidationError{Reason: "malformed", Detail: fmt.Sprintf("unable to decode token signature: %s", err)}
+	}
+
+	key, err := k.key(h.Kid)
+	if err != nil {
+		return err
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig)
+	if err != nil {
+		return &ValidationError{Reason: "signature", Detail: fmt.Sprintf("token signature does not match key %q of the uaa", h.Kid)}
+	}
+
+	return nil
+}
+
+// key returns the key with the kid. An empty kid selects the only key.
+func (k *KeySet) key(kid string) (*rsa.PublicKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if key, ok := k.lookup(kid); ok {
+		return key, nil
+	}
+
+	if !k.fetchedAt.IsZero() && time.Since(k.fetchedAt) < keyRefetchInterval {
+		return nil, &ValidationError{Reason: "signature", Detail: fmt.Sprintf("token is signed with unknown key %q", kid)}
+	}
+
+	keys, err := k.fetch()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get token keys: %s", err)
+	}
+	k.keys = keys
+	k.fetchedAt = time.Now()
+
+	if key, ok := k.lookup(kid); ok {
+		return key, nil
+	}
+
+	return nil, &ValidationError{Reason: "signature", Detail: fmt.Sprintf("token is signed with unknown key %q", kid)}
+}
+
+func (k *KeySet) lookup(kid string) (*rsa.PublicKey, bool) {
+	if kid == "" && len(k.keys) == 1 {
+		for _, key := range k.keys {
+			return key, true
+		}
+	}
+
+	key, ok := k.keys[kid]
+	return key, ok
+}
+
+func (k *KeySet) fetch() (map[string]*rsa.PublicKey, error) {
+	addr, err := k.addrProvider.Addr()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := k.httpClient.Get(fmt.Sprintf("%s/token_keys", addr))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token keys endpoint returned bad status code: %d", resp.StatusCode)
+	}
+
+	var r tokenKeysResponse
+	err = json.NewDecoder(resp.Body).Decode(&r)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, jwk := range r.Keys {
+		if jwk.Kty != "RSA" || (jwk.Alg != "" && jwk.Alg != "RS256") {
+			continue
+		}
+
+		key, err := rsaKey(jwk.N, jwk.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %s", jwk.Kid, err)
+		}
+		keys[jwk.Kid] = key
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("uaa does not serve any RS256 key")
+	}
+
+	return keys, nil
+}
+
+// rsaKey decodes the base64url encoded modulus and exponent of a key.
+func rsaKey(n, e string) (*rsa.PublicKey, error) {
+	nb, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil {
+		return nil, err
+	}
+	eb, err := base64.RawURLEncoding.DecodeString(e)
+	if err != nil {
+		return nil, err
+	}
+
+	exp := new(big.Int).SetBytes(eb)
+	if len(nb) == 0 || !exp.IsInt64() || exp.Int64() < 2 || exp.Int64() > 1<<31-1 {
+		return nil, errors.New("invalid modulus or exponent")
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(nb),
+		E: int(exp.Int64()),
+	}, nil
+}
@@ -0,0 +1,117 @@
+package auth_test
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/auth"
+	. "github.com/onsi/gomega"
+)
+
+func TestVerify(t *testing.T) {
+	RegisterTestingT(t)
+
+	key := newRSAKey(t)
+	sas := newSpyAuthServer(tokenKeys("key-1", key), 200)
+	server := httptest.NewServer(sas)
+	defer server.Close()
+
+	keys := auth.NewKeySet(newSpyAddresser(server.URL, nil), server.Client())
+
+	Expect(keys.Verify(signedJWT(t, key, "key-1", `{"client_id":"system-metrics"}`))).To(Succeed())
+	Expect(keys.Verify("bearer " + signedJWT(t, key, "key-1", `{}`))).To(Succeed())
+	Expect(sas.LastRequest().URL.Path).To(Equal("/token_keys"))
+	Expect(sas.Calls()).To(Equal(1))
+}
+
+func TestVerifyWithInvalidSignature(t *testing.T) {
+	RegisterTestingT(t)
+
+	key := newRSAKey(t)
+	server := httptest.NewServer(newSpyAuthServer(tokenKeys("key-1", key), 200))
+	defer server.Close()
+
+	keys := auth.NewKeySet(newSpyAddresser(server.URL, nil), server.Client())
+
+	for _, token := range []string{
+		signedJWT(t, newRSAKey(t), "key-1", `{}`),
+		jwt(`{}`),
+		"opaque-token",
+	} {
+		err := keys.Verify(token)
+
+		var vErr *auth.ValidationError
+		Expect(errors.As(err, &vErr)).To(BeTrue(), token)
+	}
+}
+
+func TestVerifyRequestsKeysForUnknownKey(t *testing.T) {
+	RegisterTestingT(t)
+
+	key := newRSAKey(t)
+	rotated := newRSAKey(t)
+	sas := newSpyAuthServer(tokenKeys("key-1", key), 200)
+	server := httptest.NewServer(sas)
+	defer server.Close()
+
+	keys := auth.NewKeySet(newSpyAddresser(server.URL, nil), server.Client())
+	Expect(keys.Verify(signedJWT(t, key, "key-1", `{}`))).To(Succeed())
+
+	sas.Respond(tokenKeys("key-2", rotated), 200)
+	err := keys.Verify(signedJWT(t, rotated, "key-2", `{}`))
+
+	Expect(err).To(MatchError(ContainSubstring(`unknown key "key-2"`)))
+	Expect(sas.Calls()).To(Equal(1))
+}
+
+func TestVerifyWithFailingKeysRequest(t *testing.T) {
+	RegisterTestingT(t)
+
+	server := httptest.NewServer(newSpyAuthServer("", 500))
+	defer server.Close()
+
+	keys := auth.NewKeySet(newSpyAddresser(server.URL, nil), server.Client())
+	err := keys.Verify(signedJWT(t, newRSAKey(t), "key-1", `{}`))
+
+	Expect(err).To(MatchError("unable to get token keys: token keys endpoint returned bad status code: 500"))
+}
+
+func newRSAKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+// tokenKeys returns a token_keys response serving the public key.
+func tokenKeys(kid string, key *rsa.PrivateKey) string {
+	return fmt.Sprintf(`{"keys":[{"kty":"RSA","alg":"RS256","use":"sig","kid":%q,"n":%q,"e":%q}]}`,
+		kid,
+		base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	)
+}
+
+// signedJWT returns a jwt with the claims signed by key.
+func signedJWT(t *testing.T, key *rsa.PrivateKey, kid string, claims string) string {
+	header := fmt.Sprintf(`{"alg":"RS256","kid":%q,"typ":"JWT"}`, kid)
+	signed := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." + base64.RawURLEncoding.EncodeToString([]byte(claims))
+
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
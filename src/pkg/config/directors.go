@@ -0,0 +1,128 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Director holds the settings required to consume the metrics stream of a
+// single bosh director.
+type Director struct {
+	Name string `json:"name"`
+
+	URL    string `json:"url"`
+	CACert string `json:"ca_cert"`
+
+	ClientIdentity string `json:"client_identity"`
+	ClientSecret   string `json:"client_secret"`
+
+	// ClientAuthMethod is how the client authenticates at the token
+	// endpoint, either client_secret_post or client_secret_basic. Defaults
+	// to client_secret_post.
+	ClientAuthMethod string `json:"client_auth_method"`
+
+	// RefreshToken makes the client retrieve tokens with the refresh token
+	// grant rather than the client credentials grant.
+	RefreshToken string `json:"refresh_token"`
+
+	// MetricsServerAddr may hold a comma separated list of addresses to
+	// fail over between.
+	MetricsServerAddr   string `json:"metrics_server_addr"`
+	MetricsServerCACert string `json:"metrics_server_ca_cert"`
+	MetricsServerCN     string `json:"metrics_server_cn"`
+
+	MetricsServerResolve       bool `json:"metrics_server_resolve"`
+	MetricsServerPreferPrimary bool `json:"metrics_server_prefer_primary"`
+
+	SubscriptionID string `json:"subscription_id"`
+}
+
+type directorsFile struct {
+	Directors []Director `json:"directors"`
+}
+
+// LoadDirectors reads the list of directors from the json file at path.
+// It returns an error if the file cannot be read or decoded, or if any of
+// the directors is missing a required setting.
+// Directors without a subscription id are given defaultSubscriptionID.
+func LoadDirectors(path, defaultSubscriptionID string) ([]Director, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f directorsFile
+	err = json.Unmarshal(b, &f)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode directors config %s: %s", path, err)
+	}
+
+	if len(f.Directors) == 0 {
+		return nil, errors.New("directors config does not contain any directors")
+	}
+
+	names := make(map[string]bool, len(f.Directors))
+	for i := range f.Directors {
+		d := &f.Directors[i]
+		if d.SubscriptionID == "" {
+			d.SubscriptionID = defaultSubscriptionID
+		}
+
+		err = d.validate()
+		if err != nil {
+			return nil, fmt.Errorf("director %d: %s", i, err)
+		}
+
+		if names[d.Name] {
+			return nil, fmt.Errorf("director %d: duplicate name %q", i, d.Name)
+		}
+		names[d.Name] = true
+	}
+
+	return f.Directors, nil
+}
+
+func (d Director) validate() error {
+	required := []struct {
+		field string
+		value string
+	}{
+		{"name", d.Name},
+		{"url", d.URL},
+		{"ca_cert", d.CACert},
+		{"client_identity", d.ClientIdentity},
+		{"client_secret", d.ClientSecret},
+		{"metrics_server_addr", d.MetricsServerAddr},
+		{"metrics_server_ca_cert", d.MetricsServerCACert},
+		{"metrics_server_cn", d.MetricsServerCN},
+	}
+
+	for _, r := range required {
+		if r.value == "" {
+			return fmt.Errorf("%s is required", r.field)
+		}
+	}
+
+	switch d.ClientAuthMethod {
+	case "", "client_secret_post", "client_secret_basic":
+	default:
+		return fmt.Errorf("client_auth_method %q is invalid, expected client_secret_post or client_secret_basic", d.ClientAuthMethod)
+	}
+
+	return nil
+}
+
+// Redacted returns a copy of the director with its client secret and
+// refresh token replaced so it can be shown to operators.
+func (d Director) Redacted() Director {
+	if d.ClientSecret != "" {
+		d.ClientSecret = "REDACTED"
+	}
+	if d.RefreshToken != "" {
+		d.RefreshToken = "REDACTED"
+	}
+
+	return d
+}
@@ -0,0 +1,157 @@
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/config"
+	. "github.com/onsi/gomega"
+)
+
+func TestLoadDirectors(t *testing.T) {
+	RegisterTestingT(t)
+
+	path := writeConfig(t, `{"directors": [
+		{
+			"name": "director-a",
+			"url": "https://10.0.0.6:25555",
+			"ca_cert": "director-a-ca",
+			"client_identity": "client-a",
+			"client_secret": "secret-a",
+			"metrics_server_addr": "10.0.0.6:25595",
+			"metrics_server_ca_cert": "metrics-a-ca",
+			"metrics_server_cn": "metrics-a",
+			"subscription_id": "sub-a"
+		},
+		{
+			"name": "director-b",
+			"url": "https://10.0.1.6:25555",
+			"ca_cert": "director-b-ca",
+			"client_identity": "client-b",
+			"client_secret": "secret-b",
+			"metrics_server_addr": "10.0.1.6:25595",
+			"metrics_server_ca_cert": "metrics-b-ca",
+			"metrics_server_cn": "metrics-b"
+		}
+	]}`)
+
+	directors, err := config.LoadDirectors(path, "default-sub")
+	Expect(err).ToNot(HaveOccurred())
+
+	Expect(directors).To(Equal([]config.Director{
+		{
+			Name:                "director-a",
+			URL:                 "https://10.0.0.6:25555",
+			CACert:              "director-a-ca",
+			ClientIdentity:      "client-a",
+			ClientSecret:        "secret-a",
+			MetricsServerAddr:   "10.0.0.6:25595",
+			MetricsServerCACert: "metrics-a-ca",
+			MetricsServerCN:     "metrics-a",
+			SubscriptionID:      "sub-a",
+		},
+		{
+			Name:                "director-b",
+			URL:                 "https://10.0.1.6:25555",
+			CACert:              "director-b-ca",
+			ClientIdentity:      "client-b",
+			ClientSecret:        "secret-b",
+			MetricsServerAddr:   "10.0.1.6:25595",
+			MetricsServerCACert: "metrics-b-ca",
+			MetricsServerCN:     "metrics-b",
+			SubscriptionID:      "default-sub",
+		},
+	}))
+}
+
+func TestLoadDirectorsWithMissingFile(t *testing.T) {
+	RegisterTestingT(t)
+
+	_, err := config.LoadDirectors(filepath.Join(t.TempDir(), "missing.json"), "unused")
+	Expect(err).To(HaveOccurred())
+}
+
+func TestLoadDirectorsWithUnparseableFile(t *testing.T) {
+	RegisterTestingT(t)
+
+	path := writeConfig(t, "wont-parse-json")
+
+	_, err := config.LoadDirectors(path, "unused")
+	Expect(err).To(HaveOccurred())
+}
+
+func TestLoadDirectorsWithoutDirectors(t *testing.T) {
+	RegisterTestingT(t)
+
+	path := writeConfig(t, `{"directors": []}`)
+
+	_, err := config.LoadDirectors(path, "unused")
+	Expect(err).To(HaveOccurred())
+}
+
+func TestLoadDirectorsWithMissingSetting(t *testing.T) {
+	RegisterTestingT(t)
+
+	path := writeConfig(t, `{"directors": [{"name": "director-a", "url": "https://10.0.0.6:25555"}]}`)
+
+	_, err := config.LoadDirectors(path, "unused")
+	Expect(err).To(MatchError(ContainSubstring("ca_cert is required")))
+}
+
+func TestLoadDirectorsWithDuplicateNames(t *testing.T) {
+	RegisterTestingT(t)
+
+	director := `{
+		"name": "director-a",
+		"url": "https://10.0.0.6:25555",
+		"ca_cert": "director-a-ca",
+		"client_identity": "client-a",
+		"client_secret": "secret-a",
+		"metrics_server_addr": "10.0.0.6:25595",
+		"metrics_server_ca_cert": "metrics-a-ca",
+		"metrics_server_cn": "metrics-a"
+	}`
+	path := writeConfig(t, `{"directors": [`+director+`,`+director+`]}`)
+
+	_, err := config.LoadDirectors(path, "unused")
+	Expect(err).To(MatchError(ContainSubstring("duplicate name")))
+}
+
+func TestLoadDirectorsWithInvalidClientAuthMethod(t *testing.T) {
+	RegisterTestingT(t)
+
+	path := writeConfig(t, `{"directors": [{
+		"name": "director-a",
+		"url": "https://10.0.0.6:25555",
+		"ca_cert": "director-a-ca",
+		"client_identity": "client-a",
+		"client_secret": "secret-a",
+		"client_auth_method": "private_key_jwt",
+		"metrics_server_addr": "10.0.0.6:25595",
+		"metrics_server_ca_cert": "metrics-a-ca",
+		"metrics_server_cn": "metrics-a"
+	}]}`)
+
+	_, err := config.LoadDirectors(path, "default-sub")
+	Expect(err).To(MatchError(ContainSubstring(`client_auth_method "private_key_jwt" is invalid`)))
+}
+
+func TestRedactedHidesClientSecret(t *testing.T) {
+	RegisterTestingT(t)
+
+	d := config.Director{Name: "director-a", ClientIdentity: "client-a", ClientSecret: "secret-a", RefreshToken: "refresh-a"}
+
+	Expect(d.Redacted()).To(Equal(config.Director{Name: "director-a", ClientIdentity: "client-a", ClientSecret: "REDACTED", RefreshToken: "REDACTED"}))
+	Expect(d.ClientSecret).To(Equal("secret-a"))
+}
+
+func writeConfig(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "directors.json")
+	err := os.WriteFile(path, []byte(contents), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
@@ -0,0 +1,223 @@
+package dedup
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/definitions"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	duplicatesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "dedup",
+		Name:      "duplicates",
+		Help:      "Tracks the number of duplicate events dropped",
+	}, []string{"director", "deployment"})
+	// gapsCounter is not labelled by instance, the instance ids of a
+	// foundation are unbounded as vms are recreated. The gaps are detected
+	// per instance and counted per deployment.
+	gapsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "dedup",
+		Name:      "gaps",
+		Help:      "Tracks the number of gaps detected between the heartbeats of the instances of a deployment",
+	}, []string{"director", "deployment"})
+)
+
+func init() {
+	prometheus.MustRegister(duplicatesCounter)
+	prometheus.MustRegister(gapsCounter)
+}
+
+type seenKey struct {
+	key  string
+	seen time.Time
+}
+
+type instanceKey struct {
+	deployment string
+	id         string
+}
+
+type instance struct {
+	timestamp int64
+	lastSeen  time.Time
+}
+
+// Deduplicator drops events that were already received within a window,
+// such as events delivered again after the stream reconnects.
+// An event is a duplicate if its id or its deployment, instance and
+// timestamp were already received. It also counts the gaps between
+// consecutive heartbeats of each instance that exceed the gap threshold.
+type Deduplicator struct {
+	window       time.Duration
+	maxEntries   int
+	gapThreshold time.Duration
+	instanceTTL  time.Duration
+	now          func() time.Time
+	director     string
+
+	mu        sync.Mutex
+	seen      map[string]struct{}
+	order     []seenKey
+	instances map[instanceKey]*instance
+	lastSweep time.Time
+}
+
+type DeduplicatorOpt func(*Deduplicator)
+
+// WithWindow sets how long an event is remembered after it was received.
+func WithWindow(window time.Duration) DeduplicatorOpt {
+	return func(d *Deduplicator) {
+		d.window = window
+	}
+}
+
+// WithMaxEntries caps the number of event ids and instance timestamps
+// remembered. The oldest are forgotten first.
+func WithMaxEntries(n int) DeduplicatorOpt {
+	return func(d *Deduplicator) {
+		d.maxEntries = n
+	}
+}
+
+// WithGapThreshold sets the time between the heartbeats of an instance
+// above which a gap is counted. 0 disables gap detection.
+func WithGapThreshold(t time.Duration) DeduplicatorOpt {
+	return func(d *Deduplicator) {
+		d.gapThreshold = t
+	}
+}
+
+// WithDirector sets the name of the director whose events are
+// deduplicated. The name is used to label the dedup metrics.
+func WithDirector(name string) DeduplicatorOpt {
+	return func(d *Deduplicator) {
+		d.director = name
+	}
+}
+
+// WithClock sets the function used to tell the current time.
+func WithClock(now func() time.Time) DeduplicatorOpt {
+	return func(d *Deduplicator) {
+		d.now = now
+	}
+}
+
+// New returns a new Deduplicator.
+func New(opts ...DeduplicatorOpt) *Deduplicator {
+	d := &Deduplicator{
+		window:       5 * time.Minute,
+		maxEntries:   100000,
+		gapThreshold: 90 * time.Second,
+		instanceTTL:  time.Hour,
+		now:          time.Now,
+		seen:         make(map[string]struct{}),
+		instances:    make(map[instanceKey]*instance),
+	}
+
+	for _, o := range opts {
+		o(d)
+	}
+
+	d.lastSweep = d.now()
+
+	return d
+}
+
+// Filter returns false if the event was already received within the
+// window.
+func (d *Deduplicator) Filter(event *definitions.Event) (*definitions.Event, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	d.expire(now)
+
+	keys := eventKeys(event)
+	for _, key := range keys {
+		if _, ok := d.seen[key]; ok {
+			duplicatesCounter.WithLabelValues(d.director, event.GetDeployment()).Inc()
+			return nil, false
+		}
+	}
+	for _, key := range keys {
+		d.seen[key] = struct{}{}
+		d.order = append(d.order, seenKey{key: key, seen: now})
+	}
+
+	d.detectGap(event, now)
+
+	return event, true
+}
+
+// detectGap counts a gap if the heartbeat is further apart from the
+// previous heartbeat of its instance than the gap threshold.
+func (d *Deduplicator) detectGap(event *definitions.Event, now time.Time) {
+	hb := event.GetHeartbeat()
+	if d.gapThreshold <= 0 || hb == nil {
+		return
+	}
+
+	k := instanceKey{deployment: event.GetDeployment(), id: hb.GetInstanceId()}
+	i, ok := d.instances[k]
+	if !ok {
+		d.instances[k] = &instance{timestamp: event.GetTimestamp(), lastSeen: now}
+		return
+	}
+	i.lastSeen = now
+
+	// Heartbeats may arrive out of order after a reconnect. Only newer
+	// heartbeats move the instance forward.
+	if event.GetTimestamp() <= i.timestamp {
+		return
+	}
+
+	if time.Duration(event.GetTimestamp()-i.timestamp)*time.Second > d.gapThreshold {
+		gapsCounter.WithLabelValues(d.director, event.GetDeployment()).Inc()
+	}
+	i.timestamp = event.GetTimestamp()
+}
+
+// expire forgets the events received before the window and the oldest
+// events beyond the max entries. Instances not seen within the instance
+// ttl are forgotten at most once per minute.
+func (d *Deduplicator) expire(now time.Time) {
+	cutoff := now.Add(-d.window)
+	n := 0
+	for n < len(d.order) && (d.order[n].seen.Before(cutoff) || len(d.order)-n >= d.maxEntries) {
+		delete(d.seen, d.order[n].key)
+		n++
+	}
+	d.order = d.order[n:]
+
+	if now.Sub(d.lastSweep) < time.Minute {
+		return
+	}
+	d.lastSweep = now
+
+	cutoff = now.Add(-d.instanceTTL)
+	for k, i := range d.instances {
+		if i.lastSeen.Before(cutoff) {
+			delete(d.instances, k)
+		}
+	}
+}
+
+func eventKeys(event *definitions.Event) []string {
+	var keys []string
+	if event.GetId() != "" {
+		keys = append(keys, "id/"+event.GetId())
+	}
+
+	var source string
+	switch m := event.GetMessage().(type) {
+	case *definitions.Event_Heartbeat:
+		source = m.Heartbeat.GetInstanceId()
+	case *definitions.Event_Alert:
+		source = m.Alert.GetSource() + "/" + m.Alert.GetTitle()
+	}
+
+	return append(keys, fmt.Sprintf("event/%s/%s/%d", event.GetDeployment(), source, event.GetTimestamp()))
+}
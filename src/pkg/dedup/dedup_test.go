@@ -0,0 +1,90 @@
+package dedup_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/dedup"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/definitions"
+	. "github.com/onsi/gomega"
+)
+
+func TestFilterDropsDuplicateIDs(t *testing.T) {
+	RegisterTestingT(t)
+
+	d := dedup.New()
+
+	event, ok := d.Filter(heartbeat("event-1", "id-1", 1499293724))
+	Expect(ok).To(BeTrue())
+	Expect(event.GetId()).To(Equal("event-1"))
+
+	_, ok = d.Filter(heartbeat("event-1", "id-1", 1499293754))
+	Expect(ok).To(BeFalse())
+
+	_, ok = d.Filter(heartbeat("event-2", "id-1", 1499293784))
+	Expect(ok).To(BeTrue())
+}
+
+func TestFilterDropsDuplicateInstanceTimestamps(t *testing.T) {
+	RegisterTestingT(t)
+
+	d := dedup.New()
+
+	_, ok := d.Filter(heartbeat("", "id-1", 1499293724))
+	Expect(ok).To(BeTrue())
+
+	_, ok = d.Filter(heartbeat("event-2", "id-1", 1499293724))
+	Expect(ok).To(BeFalse())
+
+	_, ok = d.Filter(heartbeat("", "id-2", 1499293724))
+	Expect(ok).To(BeTrue())
+}
+
+func TestFilterForgetsEventsAfterWindow(t *testing.T) {
+	RegisterTestingT(t)
+
+	now := time.Unix(1499293724, 0)
+	d := dedup.New(
+		dedup.WithWindow(time.Minute),
+		dedup.WithClock(func() time.Time { return now }),
+	)
+
+	_, ok := d.Filter(heartbeat("event-1", "id-1", 1499293724))
+	Expect(ok).To(BeTrue())
+
+	now = now.Add(2 * time.Minute)
+	_, ok = d.Filter(heartbeat("event-1", "id-1", 1499293724))
+	Expect(ok).To(BeTrue())
+}
+
+func TestFilterForgetsOldestEventsBeyondMaxEntries(t *testing.T) {
+	RegisterTestingT(t)
+
+	d := dedup.New(dedup.WithMaxEntries(4))
+
+	_, ok := d.Filter(heartbeat("event-1", "id-1", 1499293724))
+	Expect(ok).To(BeTrue())
+	_, ok = d.Filter(heartbeat("event-2", "id-1", 1499293754))
+	Expect(ok).To(BeTrue())
+	_, ok = d.Filter(heartbeat("event-3", "id-1", 1499293784))
+	Expect(ok).To(BeTrue())
+
+	_, ok = d.Filter(heartbeat("event-1", "id-1", 1499293724))
+	Expect(ok).To(BeTrue())
+	_, ok = d.Filter(heartbeat("event-3", "id-1", 1499293784))
+	Expect(ok).To(BeFalse())
+}
+
+func heartbeat(eventID, instanceID string, timestamp int64) *definitions.Event {
+	return &definitions.Event{
+		Id:         eventID,
+		Timestamp:  timestamp,
+		Deployment: "cf",
+		Message: &definitions.Event_Heartbeat{
+			Heartbeat: &definitions.Heartbeat{
+				Job:        "router",
+				InstanceId: instanceID,
+			},
+		},
+	}
+}
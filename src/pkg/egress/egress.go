@@ -1,7 +1,8 @@
 package egress
 
 import (
-	"log"
+	"log/slog"
+	"sync/atomic"
 	"time"
 
 	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/loggregator_v2"
@@ -23,6 +24,21 @@ type Egress struct {
 	messages <-chan *loggregator_v2.Envelope
 	client   client
 	retry    chan *loggregator_v2.Envelope
+	logger   *slog.Logger
+
+	sent       atomic.Int64
+	dropped    atomic.Int64
+	sendErrors atomic.Int64
+	connected  atomic.Bool
+}
+
+// Stats are the totals of an Egress since it was created.
+type Stats struct {
+	Sent       int64 `json:"sent"`
+	Dropped    int64 `json:"dropped"`
+	SendErrors int64 `json:"send_errors"`
+	Connected  bool  `json:"connected"`
+	Retrying   int   `json:"retrying"`
 }
 
 var (
@@ -50,86 +66,105 @@ func init() {
 }
 
 // New returns a new Egress.
-func New(c client, m <-chan *loggregator_v2.Envelope) *Egress {
+func New(c client, m <-chan *loggregator_v2.Envelope, l *slog.Logger) *Egress {
 	return &Egress{
 		client:   c,
 		messages: m,
 		retry:    make(chan *loggregator_v2.Envelope, 1),
+		logger:   l,
 	}
 }
 
-// Start spins up a go routine that sends envelopes to Loggregator.
-// It returns a shutdown function which blocks until all messages
-// are drained.
+// Stats returns the totals of the Egress.
+func (e *Egress) Stats() Stats {
+	return Stats{
+		Sent:       e.sent.Load(),
+		Dropped:    e.dropped.Load(),
+		SendErrors: e.sendErrors.Load(),
+		Connected:  e.connected.Load(),
+		Retrying:   len(e.retry),
+	}
+}
+
+// Run sends envelopes to Loggregator until messages is closed and all of
+// them are sent.
 // If a message fails to send it will reconnect to Loggregator and
 // retry sending that message.
-func (e *Egress) Start() func() {
-	log.Println("Starting forwarder...")
-
-	done := make(chan struct{})
-	stop := make(chan struct{})
-
-	go func() {
-		defer close(done)
-
-		var (
-			snd loggregator_v2.Ingress_SenderClient
-			err error
-		)
-
-		for {
-			select {
-			case <-stop:
-				if snd != nil {
-					snd.CloseAndRecv()
-				}
-				return
-			default:
-			}
+// It returns nil once messages is drained, or the error of ctx if ctx is
+// done before.
+func (e *Egress) Run(ctx context.Context) error {
+	e.logger.Info("starting forwarder")
 
-			snd, err = e.client.Sender(context.Background())
-			if err != nil {
-				log.Printf("error creating stream connection to metron: %s", err)
-				sendErrCounter.Inc()
-				time.Sleep(100 * time.Millisecond)
-				continue
-			}
+	var attempt int
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
-			log.Println("metron stream created")
+		snd, err := e.client.Sender(ctx)
+		if err != nil {
+			attempt++
+			e.logger.Error("error creating stream connection to metron", "error", err, "attempt", attempt)
+			sendErrCounter.Inc()
+			e.sendErrors.Add(1)
+			sleep(ctx, 100*time.Millisecond)
+			continue
+		}
 
-			err = e.processMessages(snd)
-			if err != nil {
-				log.Printf("error sending to log agent: %s\n", err)
-				sendErrCounter.Inc()
-				time.Sleep(100 * time.Millisecond)
-			}
+		e.logger.Info("metron stream created")
 
+		e.connected.Store(true)
+		sent, err := e.processMessages(ctx, snd)
+		e.connected.Store(false)
+		if err == nil {
+			snd.CloseAndRecv()
+			return nil
 		}
-	}()
-
-	return func() {
-		close(stop)
-		<-done
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if sent > 0 {
+			attempt = 0
+		}
+		attempt++
+		e.logger.Error("error sending to log agent", "error", err, "attempt", attempt)
+		sendErrCounter.Inc()
+		e.sendErrors.Add(1)
+		sleep(ctx, 100*time.Millisecond)
 	}
 }
 
-func (e *Egress) processMessages(snd loggregator_v2.Ingress_SenderClient) error {
-	err := e.processRetries(snd)
+// processMessages sends envelopes until sending fails, ctx is done or the
+// messages are closed. It returns the number of envelopes sent and nil
+// once the messages are closed.
+func (e *Egress) processMessages(ctx context.Context, snd loggregator_v2.Ingress_SenderClient) (int, error) {
+	sent, err := e.processRetries(snd)
 	if err != nil {
-		return err
+		return sent, err
 	}
 
-	for envelope := range e.messages {
+	for {
+		var envelope *loggregator_v2.Envelope
+		select {
+		case <-ctx.Done():
+			return sent, ctx.Err()
+		case m, ok := <-e.messages:
+			if !ok {
+				return sent, nil
+			}
+			envelope = m
+		}
+
 		err := snd.Send(envelope)
 		if err != nil {
 			e.retryLater(envelope)
-			return err
+			return sent, err
 		}
 
+		sent++
 		sentCounter.Inc()
+		e.sent.Add(1)
 	}
-
-	return nil
 }
 
 func (e *Egress) retryLater(envelope *loggregator_v2.Envelope) {
@@ -137,22 +172,38 @@ func (e *Egress) retryLater(envelope *loggregator_v2.Envelope) {
 	case e.retry <- envelope:
 	default:
 		droppedCounter.Inc()
+		e.dropped.Add(1)
 	}
 }
 
-func (e *Egress) processRetries(snd sender) error {
+func (e *Egress) processRetries(snd sender) (int, error) {
+	var sent int
 	for {
 		select {
 		case envelope := <-e.retry:
 			err := snd.Send(envelope)
 			if err != nil {
 				droppedCounter.Inc()
-				return err
+				e.dropped.Add(1)
+				return sent, err
 			}
 
+			sent++
 			sentCounter.Inc()
+			e.sent.Add(1)
 		default:
-			return nil
+			return sent, nil
 		}
 	}
 }
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
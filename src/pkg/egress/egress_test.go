@@ -2,47 +2,44 @@ package egress_test
 
 import (
 	"errors"
-	"io/ioutil"
-	"log"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
-	. "github.com/onsi/gomega"
 	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/egress"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/logging"
 	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/loggregator_v2"
+	. "github.com/onsi/gomega"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 )
 
-func TestStartProcessesEvents(t *testing.T) {
+func TestRunProcessesEvents(t *testing.T) {
 	RegisterTestingT(t)
-	log.SetOutput(ioutil.Discard)
 
 	sender := newSpySender()
 	client := newSpyEgressClient(sender, nil)
 	messages := make(chan *loggregator_v2.Envelope)
 
-	egress := egress.New(client, messages)
-	egress.Start()
+	egress := egress.New(client, messages, logging.Discard())
+	run(t, egress)
 
 	messages <- envelope
 
 	Eventually(sender.SentEnvelopes).Should(Receive(Equal(envelope)))
 }
 
-func TestStartDoesNotDropMessageWhenConnectionDies(t *testing.T) {
+func TestRunDoesNotDropMessageWhenConnectionDies(t *testing.T) {
 	RegisterTestingT(t)
-	log.SetOutput(ioutil.Discard)
 
 	sender := newSpySender()
 	sender.SendError(errors.New("some error"))
 	client := newSpyEgressClient(sender, nil)
 	messages := make(chan *loggregator_v2.Envelope)
 
-	egress := egress.New(client, messages)
-	egress.Start()
+	egress := egress.New(client, messages, logging.Discard())
+	run(t, egress)
 
 	messages <- envelope
 
@@ -53,64 +50,114 @@ func TestStartDoesNotDropMessageWhenConnectionDies(t *testing.T) {
 	Eventually(sender.SentEnvelopes).Should(Receive(Equal(envelope)))
 }
 
-func TestStopDrainsMessagesBeforeClosing(t *testing.T) {
+func TestRunDrainsMessagesBeforeReturning(t *testing.T) {
 	RegisterTestingT(t)
-	log.SetOutput(ioutil.Discard)
 
 	sender := newSpySender()
 	client := newSpyEgressClient(sender, nil)
 	messages := make(chan *loggregator_v2.Envelope, 100)
-	egress := egress.New(client, messages)
+	egress := egress.New(client, messages, logging.Discard())
 
 	for i := 0; i < 100; i++ {
 		messages <- envelope
 	}
 
-	stop := egress.Start()
+	done := run(t, egress)
 
 	Eventually(client.SenderCallCount).Should(BeNumerically(">", 0))
-	Expect(len(messages)).To(BeNumerically(">", 0))
 
 	close(messages)
-	stop()
 
+	Eventually(done, "5s").Should(Receive(BeNil()))
 	Expect(messages).To(HaveLen(0))
 	Expect(sender.CloseAndRecvCallCount()).To(BeNumerically("==", 1))
 }
 
-func TestStartReconnectsWhenClientUnableToCreateSender(t *testing.T) {
+func TestRunReconnectsWhenClientUnableToCreateSender(t *testing.T) {
 	RegisterTestingT(t)
-	log.SetOutput(ioutil.Discard)
 
 	client := newSpyEgressClient(nil, errors.New("metron is down"))
 	messages := make(chan *loggregator_v2.Envelope, 100)
-	egress := egress.New(client, messages)
+	egress := egress.New(client, messages, logging.Discard())
 
-	egress.Start()
+	run(t, egress)
 
 	messages <- envelope
 
 	Eventually(client.SenderCallCount).Should(BeNumerically(">", 1))
 }
 
-func TestStartReconnectsOnSendError(t *testing.T) {
+func TestRunReconnectsOnSendError(t *testing.T) {
 	RegisterTestingT(t)
-	log.SetOutput(ioutil.Discard)
 
 	sender := newSpySender()
 	sender.SendError(errors.New("some error"))
 
 	client := newSpyEgressClient(sender, nil)
 	messages := make(chan *loggregator_v2.Envelope, 100)
-	egress := egress.New(client, messages)
+	egress := egress.New(client, messages, logging.Discard())
 
-	egress.Start()
+	run(t, egress)
 
 	messages <- envelope
 
 	Eventually(client.SenderCallCount).Should(BeNumerically(">", 1))
 }
 
+func TestStatsCountsSentEnvelopesAndErrors(t *testing.T) {
+	RegisterTestingT(t)
+
+	sender := newSpySender()
+	sender.SendError(errors.New("some error"))
+	client := newSpyEgressClient(sender, nil)
+	messages := make(chan *loggregator_v2.Envelope)
+
+	e := egress.New(client, messages, logging.Discard())
+	run(t, e)
+
+	messages <- envelope
+
+	Eventually(func() int64 { return e.Stats().SendErrors }).Should(BeNumerically(">", 0))
+
+	sender.SendError(nil)
+
+	Eventually(func() int64 { return e.Stats().Sent }).Should(Equal(int64(1)))
+	Eventually(func() bool { return e.Stats().Connected }).Should(BeTrue())
+}
+
+func TestRunReturnsWhenContextIsDone(t *testing.T) {
+	RegisterTestingT(t)
+
+	client := newSpyEgressClient(nil, errors.New("metron is down"))
+	messages := make(chan *loggregator_v2.Envelope, 100)
+	e := egress.New(client, messages, logging.Discard())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- e.Run(ctx)
+	}()
+
+	Eventually(client.SenderCallCount).Should(BeNumerically(">", 0))
+	cancel()
+
+	Eventually(done).Should(Receive(Equal(context.Canceled)))
+}
+
+// run runs e until the test ends. It returns a channel receiving the result
+// of the run.
+func run(t *testing.T, e *egress.Egress) <-chan error {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- e.Run(ctx)
+	}()
+
+	return done
+}
+
 type spyEgressClient struct {
 	senderCallCount int32
 	spySender       *spySender
@@ -192,10 +239,10 @@ func (s *spySender) CloseAndRecvCallCount() int32 {
 var envelope = &loggregator_v2.Envelope{
 	Timestamp: 1499293724,
 	Tags: map[string]string{
-		"job": "consul",
-		"index": "4",
-		"id": "6f60a3ce-9e4d-477f-ba45-7d29bcfab5b9",
-		"origin": "bosh-system-metrics-forwarder",
+		"job":        "consul",
+		"index":      "4",
+		"id":         "6f60a3ce-9e4d-477f-ba45-7d29bcfab5b9",
+		"origin":     "bosh-system-metrics-forwarder",
 		"deployment": "loggregator",
 	},
 	Message: &loggregator_v2.Envelope_Gauge{
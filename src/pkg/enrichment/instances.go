@@ -0,0 +1,254 @@
+package enrichment
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/definitions"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	refreshErrCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "enrichment",
+		Name:      "instances_refresh_err",
+		Help:      "Tracks errors when fetching instances from the director",
+	}, []string{"director"})
+	instancesGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "enrichment",
+		Name:      "instances",
+		Help:      "Number of instances known from the director",
+	}, []string{"director"})
+)
+
+func init() {
+	prometheus.MustRegister(refreshErrCounter)
+	prometheus.MustRegister(instancesGauge)
+}
+
+type tokener interface {
+	Token() (string, error)
+}
+
+// Instance is the metadata the director holds about an instance.
+// It has no vm type, which the instances endpoint of the director does not
+// return.
+type Instance struct {
+	Deployment string
+	Job        string
+	ID         string
+	AZ         string
+	VMCID      string
+	Stemcell   string
+	IPs        []string
+}
+
+type deploymentResponse struct {
+	Name      string `json:"name"`
+	Stemcells []struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"stemcells"`
+}
+
+type instanceResponse struct {
+	ID  string   `json:"id"`
+	Job string   `json:"job"`
+	AZ  string   `json:"az"`
+	CID string   `json:"cid"`
+	IPs []string `json:"ips"`
+}
+
+// InstanceCache periodically fetches the instances of every deployment
+// from the director and tags envelopes with their metadata.
+type InstanceCache struct {
+	directorURL string
+	httpClient  *http.Client
+	auth        tokener
+	logger      *slog.Logger
+	director    string
+
+	mu        sync.RWMutex
+	instances map[string]Instance
+}
+
+type InstanceCacheOpt func(*InstanceCache)
+
+// WithDirector sets the name of the director the instances are fetched
+// from. The name is used to label the enrichment metrics.
+func WithDirector(name string) InstanceCacheOpt {
+	return func(c *InstanceCache) {
+		c.director = name
+	}
+}
+
+// NewInstanceCache returns a new InstanceCache that requests the director
+// at directorURL using tokens provided by auth.
+func NewInstanceCache(directorURL string, tlsConfig *tls.Config, auth tokener, l *slog.Logger, opts ...InstanceCacheOpt) *InstanceCache {
+	c := &InstanceCache{
+		directorURL: directorURL,
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: tlsConfig,
+			},
+			Timeout: 30 * time.Second,
+		},
+		auth:      auth,
+		logger:    l,
+		instances: make(map[string]Instance),
+	}
+
+	for _, o := range opts {
+		o(c)
+	}
+
+	return c
+}
+
+// Start spins a new go routine that refreshes the instances every
+// interval, starting immediately.
+// It returns a shutdown function that blocks until the go routine has
+// exited.
+func (c *InstanceCache) Start(interval time.Duration) func() {
+	done := make(chan struct{})
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		for {
+			err := c.Refresh()
+			if err != nil {
+				refreshErrCounter.WithLabelValues(c.director).Inc()
+				c.logger.Warn("unable to refresh instances from director", "error", err)
+			}
+
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// Refresh replaces the cached instances with the instances of every
+// deployment currently known to the director.
+// It returns an error if any of the requests fail, in which case the
+// cached instances are left untouched.
+func (c *InstanceCache) Refresh() error {
+	token, err := c.auth.Token()
+	if err != nil {
+		return err
+	}
+
+	var deployments []deploymentResponse
+	err = c.get(token, "/deployments", &deployments)
+	if err != nil {
+		return err
+	}
+
+	instances := make(map[string]Instance)
+	for _, d := range deployments {
+		var stemcell string
+		if len(d.Stemcells) == 1 {
+			stemcell = fmt.Sprintf("%s/%s", d.Stemcells[0].Name, d.Stemcells[0].Version)
+		}
+
+		var resp []instanceResponse
+		err = c.get(token, fmt.Sprintf("/deployments/%s/instances", url.PathEscape(d.Name)), &resp)
+		if err != nil {
+			return fmt.Errorf("deployment %s: %w", d.Name, err)
+		}
+
+		for _, i := range resp {
+			instances[i.ID] = Instance{
+				Deployment: d.Name,
+				Job:        i.Job,
+				ID:         i.ID,
+				AZ:         i.AZ,
+				VMCID:      i.CID,
+				Stemcell:   stemcell,
+				IPs:        i.IPs,
+			}
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.instances = instances
+	instancesGauge.WithLabelValues(c.director).Set(float64(len(instances)))
+
+	return nil
+}
+
+// Instance returns the cached metadata of the instance with the given id.
+func (c *InstanceCache) Instance(id string) (Instance, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	i, ok := c.instances[id]
+	return i, ok
+}
+
+// Tags returns the az, vm_cid, stemcell and ip tags of the
+// instance that emitted the event.
+// It returns no tags if the instance is unknown.
+func (c *InstanceCache) Tags(event *definitions.Event) map[string]string {
+	i, ok := c.Instance(event.GetHeartbeat().GetInstanceId())
+	if !ok || i.Deployment != event.GetDeployment() {
+		return nil
+	}
+
+	tags := make(map[string]string)
+	setTag(tags, "az", i.AZ)
+	setTag(tags, "vm_cid", i.VMCID)
+	setTag(tags, "stemcell", i.Stemcell)
+	if len(i.IPs) > 0 {
+		tags["ip"] = i.IPs[0]
+		tags["ips"] = strings.Join(i.IPs, ",")
+	}
+
+	return tags
+}
+
+func (c *InstanceCache) get(token, path string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, c.directorURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned bad status code: %d", path, resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func setTag(tags map[string]string, k, v string) {
+	if v != "" {
+		tags[k] = v
+	}
+}
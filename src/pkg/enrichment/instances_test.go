@@ -0,0 +1,165 @@
+package enrichment_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/enrichment"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/logging"
+	. "github.com/onsi/gomega"
+)
+
+func TestInstanceCacheTagsKnownInstances(t *testing.T) {
+	RegisterTestingT(t)
+
+	director := newSpyDirector()
+	server := httptest.NewServer(director)
+	defer server.Close()
+
+	c := enrichment.NewInstanceCache(server.URL, nil, &spyTokener{token: "some-token"}, logger)
+	Expect(c.Refresh()).To(Succeed())
+
+	Expect(c.Tags(heartbeat("cf", "6f60a3ce-9e4d-477f-ba45-7d29bcfab5b9"))).To(Equal(map[string]string{
+		"az":       "z1",
+		"vm_cid":   "vm-1234",
+		"stemcell": "bosh-warden-boshlite-ubuntu-jammy-go_agent/1.95",
+		"ip":       "10.244.0.2",
+		"ips":      "10.244.0.2,10.244.1.2",
+	}))
+	Expect(director.Authorization()).To(Equal("Bearer some-token"))
+}
+
+func TestInstanceCacheDoesNotTagUnknownInstances(t *testing.T) {
+	RegisterTestingT(t)
+
+	director := newSpyDirector()
+	server := httptest.NewServer(director)
+	defer server.Close()
+
+	c := enrichment.NewInstanceCache(server.URL, nil, &spyTokener{token: "some-token"}, logger)
+	Expect(c.Refresh()).To(Succeed())
+
+	Expect(c.Tags(heartbeat("cf", "unknown-id"))).To(BeEmpty())
+	Expect(c.Tags(heartbeat("other-deployment", "6f60a3ce-9e4d-477f-ba45-7d29bcfab5b9"))).To(BeEmpty())
+}
+
+func TestInstanceCacheKeepsInstancesWhenRefreshFails(t *testing.T) {
+	RegisterTestingT(t)
+
+	director := newSpyDirector()
+	server := httptest.NewServer(director)
+	defer server.Close()
+
+	c := enrichment.NewInstanceCache(server.URL, nil, &spyTokener{token: "some-token"}, logger)
+	Expect(c.Refresh()).To(Succeed())
+
+	director.SetStatus(http.StatusInternalServerError)
+	Expect(c.Refresh()).ToNot(Succeed())
+
+	_, ok := c.Instance("6f60a3ce-9e4d-477f-ba45-7d29bcfab5b9")
+	Expect(ok).To(BeTrue())
+}
+
+func TestInstanceCacheRefreshWithFailingTokener(t *testing.T) {
+	RegisterTestingT(t)
+
+	c := enrichment.NewInstanceCache("unused", nil, &spyTokener{err: errors.New("some-error")}, logger)
+
+	Expect(c.Refresh()).ToNot(Succeed())
+}
+
+func TestInstanceCacheStartRefreshesPeriodically(t *testing.T) {
+	RegisterTestingT(t)
+
+	director := newSpyDirector()
+	server := httptest.NewServer(director)
+	defer server.Close()
+
+	c := enrichment.NewInstanceCache(server.URL, nil, &spyTokener{token: "some-token"}, logger)
+	stop := c.Start(time.Millisecond)
+	defer stop()
+
+	Eventually(director.DeploymentsCallCount).Should(BeNumerically(">", 1))
+	_, ok := c.Instance("6f60a3ce-9e4d-477f-ba45-7d29bcfab5b9")
+	Expect(ok).To(BeTrue())
+}
+
+func heartbeat(deployment, instanceID string) *definitions.Event {
+	return &definitions.Event{
+		Deployment: deployment,
+		Message: &definitions.Event_Heartbeat{
+			Heartbeat: &definitions.Heartbeat{
+				Job:        "router",
+				InstanceId: instanceID,
+			},
+		},
+	}
+}
+
+type spyDirector struct {
+	mu                   sync.Mutex
+	status               int
+	authorization        string
+	deploymentsCallCount int
+}
+
+func newSpyDirector() *spyDirector {
+	return &spyDirector{
+		status: http.StatusOK,
+	}
+}
+
+func (d *spyDirector) SetStatus(status int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.status = status
+}
+
+func (d *spyDirector) Authorization() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.authorization
+}
+
+func (d *spyDirector) DeploymentsCallCount() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.deploymentsCallCount
+}
+
+func (d *spyDirector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.authorization = r.Header.Get("Authorization")
+	if d.status != http.StatusOK {
+		w.WriteHeader(d.status)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/deployments":
+		d.deploymentsCallCount++
+		w.Write([]byte(`[{"name":"cf","cloud_config":"latest","releases":[{"name":"routing","version":"0.297.0"}],"stemcells":[{"name":"bosh-warden-boshlite-ubuntu-jammy-go_agent","version":"1.95"}],"teams":[]}]`))
+	case "/deployments/cf/instances":
+		w.Write([]byte(`[{"agent_id":"2accd102","cid":"vm-1234","job":"router","index":0,"id":"6f60a3ce-9e4d-477f-ba45-7d29bcfab5b9","az":"z1","ips":["10.244.0.2","10.244.1.2"],"vm_created_at":"2024-05-02T09:41:17Z","expects_vm":true}]`))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+type spyTokener struct {
+	token string
+	err   error
+}
+
+func (t *spyTokener) Token() (string, error) {
+	return t.token, t.err
+}
+
+var logger = logging.Discard()
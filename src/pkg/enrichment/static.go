@@ -0,0 +1,170 @@
+package enrichment
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sync"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/definitions"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	unmatchedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "enrichment",
+		Name:      "static_unmatched",
+		Help:      "Tracks events that matched no static enrichment rule",
+	})
+	reloadErrCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "enrichment",
+		Name:      "static_reload_err",
+		Help:      "Tracks errors when reloading the static enrichment file",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(unmatchedCounter)
+	prometheus.MustRegister(reloadErrCounter)
+}
+
+type staticRuleConfig struct {
+	Deployment      string            `json:"deployment"`
+	DeploymentRegex string            `json:"deployment_regex"`
+	JobRegex        string            `json:"job_regex"`
+	Tags            map[string]string `json:"tags"`
+}
+
+type staticFile struct {
+	Rules []staticRuleConfig `json:"rules"`
+}
+
+type staticRule struct {
+	deployment      string
+	deploymentRegex *regexp.Regexp
+	jobRegex        *regexp.Regexp
+	tags            map[string]string
+}
+
+func (r staticRule) matches(deployment, job string) bool {
+	if r.deployment != "" && r.deployment != deployment {
+		return false
+	}
+	if r.deploymentRegex != nil && !r.deploymentRegex.MatchString(deployment) {
+		return false
+	}
+	if r.jobRegex != nil && !r.jobRegex.MatchString(job) {
+		return false
+	}
+
+	return true
+}
+
+// StaticTable tags envelopes using a file of rules that map deployment
+// names, or regular expressions over deployment and job names, to tags.
+type StaticTable struct {
+	path string
+
+	mu    sync.RWMutex
+	rules []staticRule
+}
+
+// NewStaticTable returns a new StaticTable loaded from the json file at
+// path.
+// It returns an error if the file cannot be loaded.
+func NewStaticTable(path string) (*StaticTable, error) {
+	t := &StaticTable{
+		path: path,
+	}
+
+	err := t.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// Reload reads the rules from the file again.
+// It returns an error if the file cannot be read or any rule is invalid,
+// in which case the previous rules are kept.
+func (t *StaticTable) Reload() error {
+	rules, err := loadStaticRules(t.path)
+	if err != nil {
+		reloadErrCounter.Inc()
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rules = rules
+
+	return nil
+}
+
+// Tags returns the merged tags of every rule matching the event.
+// Rules are applied in order so later rules override earlier ones.
+func (t *StaticTable) Tags(event *definitions.Event) map[string]string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var tags map[string]string
+	for _, r := range t.rules {
+		if !r.matches(event.GetDeployment(), event.GetHeartbeat().GetJob()) {
+			continue
+		}
+
+		if tags == nil {
+			tags = make(map[string]string, len(r.tags))
+		}
+		for k, v := range r.tags {
+			tags[k] = v
+		}
+	}
+
+	if tags == nil {
+		unmatchedCounter.Inc()
+	}
+
+	return tags
+}
+
+func loadStaticRules(path string) ([]staticRule, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f staticFile
+	err = json.Unmarshal(b, &f)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode static enrichment file %s: %s", path, err)
+	}
+
+	rules := make([]staticRule, 0, len(f.Rules))
+	for i, rc := range f.Rules {
+		r := staticRule{
+			deployment: rc.Deployment,
+			tags:       rc.Tags,
+		}
+
+		if rc.DeploymentRegex != "" {
+			r.deploymentRegex, err = regexp.Compile(rc.DeploymentRegex)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: invalid deployment_regex: %s", i, err)
+			}
+		}
+
+		if rc.JobRegex != "" {
+			r.jobRegex, err = regexp.Compile(rc.JobRegex)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: invalid job_regex: %s", i, err)
+			}
+		}
+
+		rules = append(rules, r)
+	}
+
+	return rules, nil
+}
@@ -0,0 +1,105 @@
+package enrichment_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/enrichment"
+	. "github.com/onsi/gomega"
+)
+
+func TestStaticTableTagsMatchingDeployment(t *testing.T) {
+	RegisterTestingT(t)
+
+	path := writeFile(t, `{"rules": [
+		{"deployment": "cf", "tags": {"team": "platform", "cost_center": "1234"}},
+		{"deployment": "redis", "tags": {"team": "data"}}
+	]}`)
+
+	table, err := enrichment.NewStaticTable(path)
+	Expect(err).ToNot(HaveOccurred())
+
+	Expect(table.Tags(heartbeat("cf", "some-id"))).To(Equal(map[string]string{
+		"team":        "platform",
+		"cost_center": "1234",
+	}))
+}
+
+func TestStaticTableMergesMatchingRulesInOrder(t *testing.T) {
+	RegisterTestingT(t)
+
+	path := writeFile(t, `{"rules": [
+		{"deployment_regex": "^c", "tags": {"team": "platform", "cost_center": "1234"}},
+		{"deployment_regex": "^cf$", "job_regex": "^rout", "tags": {"team": "routing"}},
+		{"deployment_regex": "^cf$", "job_regex": "^diego", "tags": {"team": "diego"}}
+	]}`)
+
+	table, err := enrichment.NewStaticTable(path)
+	Expect(err).ToNot(HaveOccurred())
+
+	Expect(table.Tags(heartbeat("cf", "some-id"))).To(Equal(map[string]string{
+		"team":        "routing",
+		"cost_center": "1234",
+	}))
+}
+
+func TestStaticTableReturnsNoTagsWithoutMatch(t *testing.T) {
+	RegisterTestingT(t)
+
+	path := writeFile(t, `{"rules": [{"deployment": "redis", "tags": {"team": "data"}}]}`)
+
+	table, err := enrichment.NewStaticTable(path)
+	Expect(err).ToNot(HaveOccurred())
+
+	Expect(table.Tags(heartbeat("cf", "some-id"))).To(BeEmpty())
+}
+
+func TestStaticTableReload(t *testing.T) {
+	RegisterTestingT(t)
+
+	path := writeFile(t, `{"rules": [{"deployment": "cf", "tags": {"team": "platform"}}]}`)
+
+	table, err := enrichment.NewStaticTable(path)
+	Expect(err).ToNot(HaveOccurred())
+
+	err = os.WriteFile(path, []byte(`{"rules": [{"deployment": "cf", "tags": {"team": "routing"}}]}`), 0600)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(table.Reload()).To(Succeed())
+
+	Expect(table.Tags(heartbeat("cf", "some-id"))).To(Equal(map[string]string{"team": "routing"}))
+}
+
+func TestStaticTableKeepsRulesWhenReloadFails(t *testing.T) {
+	RegisterTestingT(t)
+
+	path := writeFile(t, `{"rules": [{"deployment": "cf", "tags": {"team": "platform"}}]}`)
+
+	table, err := enrichment.NewStaticTable(path)
+	Expect(err).ToNot(HaveOccurred())
+
+	err = os.WriteFile(path, []byte(`{"rules": [{"deployment_regex": "(", "tags": {"team": "routing"}}]}`), 0600)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(table.Reload()).ToNot(Succeed())
+
+	Expect(table.Tags(heartbeat("cf", "some-id"))).To(Equal(map[string]string{"team": "platform"}))
+}
+
+func TestNewStaticTableWithUnparseableFile(t *testing.T) {
+	RegisterTestingT(t)
+
+	path := writeFile(t, "wont-parse-json")
+
+	_, err := enrichment.NewStaticTable(path)
+	Expect(err).To(HaveOccurred())
+}
+
+func writeFile(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "enrichment.json")
+	err := os.WriteFile(path, []byte(contents), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
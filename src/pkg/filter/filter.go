@@ -0,0 +1,241 @@
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/definitions"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	filteredCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "filter",
+		Name:      "filtered",
+		Help:      "Tracks the number of heartbeat metrics removed by each filter rule",
+	}, []string{"rule"})
+	droppedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "filter",
+		Name:      "dropped",
+		Help:      "Tracks the number of events dropped because all of their metrics were filtered",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(filteredCounter)
+	prometheus.MustRegister(droppedCounter)
+}
+
+const (
+	actionAllow = "allow"
+	actionDeny  = "deny"
+
+	defaultRuleName = "default"
+)
+
+type ruleConfig struct {
+	Name       string `json:"name"`
+	Action     string `json:"action"`
+	Regex      bool   `json:"regex"`
+	Deployment string `json:"deployment"`
+	Job        string `json:"job"`
+	Instance   string `json:"instance"`
+	Metric     string `json:"metric"`
+}
+
+type fileConfig struct {
+	Default string       `json:"default"`
+	Rules   []ruleConfig `json:"rules"`
+}
+
+type matcher func(string) bool
+
+type rule struct {
+	name  string
+	allow bool
+
+	deployment matcher
+	job        matcher
+	instance   matcher
+	metric     matcher
+}
+
+func (r rule) matches(deployment, job, instance, metric string) bool {
+	return matchOrAny(r.deployment, deployment) &&
+		matchOrAny(r.job, job) &&
+		matchOrAny(r.instance, instance) &&
+		matchOrAny(r.metric, metric)
+}
+
+func matchOrAny(m matcher, s string) bool {
+	return m == nil || m(s)
+}
+
+// Filter decides which heartbeat metrics are forwarded using an ordered
+// list of allow and deny rules.
+// Every metric is evaluated against the rules in order and the first rule
+// matching its deployment, job, instance and metric name decides. Metrics
+// not matched by any rule get the default action.
+type Filter struct {
+	allowByDefault bool
+	rules          []rule
+}
+
+// Load returns a new Filter configured with the json file at path.
+// Rule patterns are globs unless the rule sets regex.
+// It returns an error if the file cannot be read or a rule is invalid.
+func Load(path string) (*Filter, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var c fileConfig
+	err = json.Unmarshal(b, &c)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode filter config %s: %s", path, err)
+	}
+
+	f := &Filter{}
+	f.allowByDefault, err = isAllow(c.Default, true)
+	if err != nil {
+		return nil, fmt.Errorf("default: %s", err)
+	}
+
+	for i, rc := range c.Rules {
+		r, err := newRule(rc)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %s", i, err)
+		}
+		f.rules = append(f.rules, r)
+	}
+
+	return f, nil
+}
+
+// Filter returns the event with the metrics that are denied removed.
+// It returns false if no metric is left and the event should be dropped.
+func (f *Filter) Filter(event *definitions.Event) (*definitions.Event, bool) {
+	hb := event.GetHeartbeat()
+	if hb == nil {
+		allowed, ruleName := f.evaluate(event.GetDeployment(), "", "", "")
+		if !allowed {
+			filteredCounter.WithLabelValues(ruleName).Inc()
+			droppedCounter.Inc()
+		}
+		return event, allowed
+	}
+
+	metrics := make([]*definitions.Heartbeat_Metric, 0, len(hb.GetMetrics()))
+	for _, m := range hb.GetMetrics() {
+		allowed, ruleName := f.evaluate(event.GetDeployment(), hb.GetJob(), hb.GetInstanceId(), m.GetName())
+		if !allowed {
+			filteredCounter.WithLabelValues(ruleName).Inc()
+			continue
+		}
+		metrics = append(metrics, m)
+	}
+
+	if len(metrics) == len(hb.GetMetrics()) {
+		return event, true
+	}
+
+	if len(metrics) == 0 {
+		droppedCounter.Inc()
+		return nil, false
+	}
+
+	filtered := *hb
+	filtered.Metrics = metrics
+	return &definitions.Event{
+		Timestamp:  event.GetTimestamp(),
+		Id:         event.GetId(),
+		Deployment: event.GetDeployment(),
+		Message:    &definitions.Event_Heartbeat{Heartbeat: &filtered},
+	}, true
+}
+
+func (f *Filter) evaluate(deployment, job, instance, metric string) (bool, string) {
+	for _, r := range f.rules {
+		if r.matches(deployment, job, instance, metric) {
+			return r.allow, r.name
+		}
+	}
+
+	return f.allowByDefault, defaultRuleName
+}
+
+func newRule(rc ruleConfig) (rule, error) {
+	if rc.Name == "" {
+		return rule{}, fmt.Errorf("name is required")
+	}
+
+	allow, err := isAllow(rc.Action, false)
+	if err != nil {
+		return rule{}, err
+	}
+
+	r := rule{
+		name:  rc.Name,
+		allow: allow,
+	}
+
+	for _, p := range []struct {
+		pattern string
+		m       *matcher
+	}{
+		{rc.Deployment, &r.deployment},
+		{rc.Job, &r.job},
+		{rc.Instance, &r.instance},
+		{rc.Metric, &r.metric},
+	} {
+		if p.pattern == "" {
+			continue
+		}
+
+		*p.m, err = newMatcher(p.pattern, rc.Regex)
+		if err != nil {
+			return rule{}, err
+		}
+	}
+
+	return r, nil
+}
+
+func newMatcher(pattern string, regex bool) (matcher, error) {
+	if regex {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	}
+
+	_, err := path.Match(pattern, "")
+	if err != nil {
+		return nil, fmt.Errorf("invalid glob %q: %s", pattern, err)
+	}
+
+	return func(s string) bool {
+		ok, _ := path.Match(pattern, s)
+		return ok
+	}, nil
+}
+
+func isAllow(action string, emptyAllowed bool) (bool, error) {
+	switch action {
+	case actionAllow:
+		return true, nil
+	case actionDeny:
+		return false, nil
+	case "":
+		if emptyAllowed {
+			return true, nil
+		}
+	}
+
+	return false, fmt.Errorf("action must be %q or %q", actionAllow, actionDeny)
+}
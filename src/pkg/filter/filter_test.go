@@ -0,0 +1,151 @@
+package filter_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/filter"
+	. "github.com/onsi/gomega"
+)
+
+func TestFilterAllowsByDefault(t *testing.T) {
+	RegisterTestingT(t)
+
+	f := loadFilter(t, `{"rules": []}`)
+
+	event := heartbeat("cf", "router", "some-id", "system.healthy", "system.cpu.user")
+	filtered, ok := f.Filter(event)
+	Expect(ok).To(BeTrue())
+	Expect(filtered).To(Equal(event))
+}
+
+func TestFilterDeniesDeploymentsMatchingGlob(t *testing.T) {
+	RegisterTestingT(t)
+
+	f := loadFilter(t, `{"rules": [{"name": "no-compilation", "action": "deny", "deployment": "compilation-*"}]}`)
+
+	_, ok := f.Filter(heartbeat("compilation-1234", "compiler", "some-id", "system.healthy"))
+	Expect(ok).To(BeFalse())
+
+	_, ok = f.Filter(heartbeat("cf", "router", "some-id", "system.healthy"))
+	Expect(ok).To(BeTrue())
+}
+
+func TestFilterDeniesByDefault(t *testing.T) {
+	RegisterTestingT(t)
+
+	f := loadFilter(t, `{"default": "deny", "rules": [
+		{"name": "only-cf", "action": "allow", "regex": true, "deployment": "^cf(-.*)?$"}
+	]}`)
+
+	_, ok := f.Filter(heartbeat("cf-test", "router", "some-id", "system.healthy"))
+	Expect(ok).To(BeTrue())
+
+	_, ok = f.Filter(heartbeat("redis", "redis", "some-id", "system.healthy"))
+	Expect(ok).To(BeFalse())
+}
+
+func TestFilterRemovesDeniedMetrics(t *testing.T) {
+	RegisterTestingT(t)
+
+	f := loadFilter(t, `{"rules": [
+		{"name": "no-router-cpu", "action": "deny", "job": "router", "metric": "system.cpu.*"}
+	]}`)
+
+	event := heartbeat("cf", "router", "some-id", "system.healthy", "system.cpu.user", "system.cpu.sys")
+	filtered, ok := f.Filter(event)
+	Expect(ok).To(BeTrue())
+	Expect(metricNames(filtered)).To(Equal([]string{"system.healthy"}))
+	Expect(filtered.GetDeployment()).To(Equal("cf"))
+	Expect(filtered.GetHeartbeat().GetJob()).To(Equal("router"))
+
+	Expect(metricNames(event)).To(HaveLen(3))
+}
+
+func TestFilterUsesFirstMatchingRule(t *testing.T) {
+	RegisterTestingT(t)
+
+	f := loadFilter(t, `{"rules": [
+		{"name": "keep-healthy", "action": "allow", "metric": "system.healthy"},
+		{"name": "no-test-envs", "action": "deny", "deployment": "test-*"}
+	]}`)
+
+	filtered, ok := f.Filter(heartbeat("test-1", "router", "some-id", "system.healthy", "system.cpu.user"))
+	Expect(ok).To(BeTrue())
+	Expect(metricNames(filtered)).To(Equal([]string{"system.healthy"}))
+}
+
+func TestFilterMatchesInstance(t *testing.T) {
+	RegisterTestingT(t)
+
+	f := loadFilter(t, `{"rules": [{"name": "noisy-instance", "action": "deny", "instance": "6f60a3ce-*"}]}`)
+
+	_, ok := f.Filter(heartbeat("cf", "router", "6f60a3ce-9e4d-477f-ba45-7d29bcfab5b9", "system.healthy"))
+	Expect(ok).To(BeFalse())
+
+	_, ok = f.Filter(heartbeat("cf", "router", "2accd102-37e7-4dd6-b337-b3f87da97914", "system.healthy"))
+	Expect(ok).To(BeTrue())
+}
+
+func TestLoadWithInvalidConfig(t *testing.T) {
+	RegisterTestingT(t)
+
+	for _, c := range []string{
+		"wont-parse-json",
+		`{"default": "maybe"}`,
+		`{"rules": [{"action": "deny", "deployment": "cf"}]}`,
+		`{"rules": [{"name": "no-action", "deployment": "cf"}]}`,
+		`{"rules": [{"name": "bad-glob", "action": "deny", "deployment": "["}]}`,
+		`{"rules": [{"name": "bad-regex", "action": "deny", "regex": true, "deployment": "("}]}`,
+	} {
+		_, err := filter.Load(writeFile(t, c))
+		Expect(err).To(HaveOccurred(), c)
+	}
+}
+
+func loadFilter(t *testing.T, config string) *filter.Filter {
+	f, err := filter.Load(writeFile(t, config))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return f
+}
+
+func writeFile(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "filter.json")
+	err := os.WriteFile(path, []byte(contents), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func heartbeat(deployment, job, instanceID string, metrics ...string) *definitions.Event {
+	hb := &definitions.Heartbeat{
+		Job:        job,
+		InstanceId: instanceID,
+	}
+	for _, m := range metrics {
+		hb.Metrics = append(hb.Metrics, &definitions.Heartbeat_Metric{Name: m, Value: 1})
+	}
+
+	return &definitions.Event{
+		Id:         "some-event-id",
+		Timestamp:  1499293724,
+		Deployment: deployment,
+		Message:    &definitions.Event_Heartbeat{Heartbeat: hb},
+	}
+}
+
+func metricNames(event *definitions.Event) []string {
+	var names []string
+	for _, m := range event.GetHeartbeat().GetMetrics() {
+		names = append(names, m.GetName())
+	}
+
+	return names
+}
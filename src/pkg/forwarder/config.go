@@ -0,0 +1,214 @@
+package forwarder
+
+import (
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/auth"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/config"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/loggregator_v2"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/mapper"
+)
+
+// TokenSource retrieves the tokens used to subscribe to a metrics server.
+// If it also has an Expiry() time.Time method, the expiry is reported by
+// the admin api.
+type TokenSource interface {
+	Token() (string, error)
+}
+
+// Config configures a forwarder. Start from DefaultConfig to get the
+// defaults of the forwarder command.
+type Config struct {
+	// Directors are the directors whose metrics are forwarded.
+	Directors []config.Director
+
+	// MetronPort, MetronCACert, MetronCertPath and MetronKeyPath configure
+	// the connection to the local metron agent. They are only used when
+	// Sinks is empty.
+	MetronPort     int
+	MetronCACert   string
+	MetronCertPath string
+	MetronKeyPath  string
+
+	// Sinks consume the forwarded envelopes by name. Every sink receives
+	// every envelope. Defaults to a single metron sink.
+	Sinks map[string]Sink
+
+	// TokenSource returns the token source of a director. Defaults to the
+	// UAA client of the director, see NewAuth.
+	TokenSource func(d config.Director, tlsConfig *tls.Config) TokenSource
+
+	// ValidateToken checks that the tokens of the UAA clients are not
+	// expired, grant the system metrics scope and, when TokenAudience is
+	// set, are issued for the audience. VerifyTokenSignature also verifies
+	// them against the token keys of the UAA. They are ignored when
+	// TokenSource is set.
+	ValidateToken        bool
+	TokenAudience        string
+	VerifyTokenSignature bool
+
+	// UAAURLTTL is how long the UAA urls advertised by a director are used
+	// before they are discovered again. 0 caches them until the director
+	// info is refreshed.
+	UAAURLTTL time.Duration
+
+	// Mapper converts events to envelopes for all directors. Defaults to
+	// a mapper configured with the tagging and unit settings below, which
+	// are ignored when it is set.
+	Mapper func(event *definitions.Event) (*loggregator_v2.Envelope, error)
+
+	Logger *slog.Logger
+
+	// LogLevel is the level changed through the admin api.
+	LogLevel *slog.LevelVar
+
+	StreamIdleTimeout time.Duration
+
+	// DrainTimeout bounds how long the queued envelopes are drained to the
+	// sinks when Run returns. 0 waits until they are drained.
+	DrainTimeout time.Duration
+
+	EnvelopeIPTag       string
+	UnitMode            mapper.UnitMode
+	DirectorInfoTags    bool
+	DirectorInfoRefresh time.Duration
+
+	InstanceMetadataTags    bool
+	InstanceMetadataRefresh time.Duration
+
+	// Taggers add tags to the envelopes of all directors.
+	Taggers []mapper.Tagger
+
+	// DedupWindow is how long events are remembered to drop duplicates.
+	// 0 disables deduplication.
+	DedupWindow       time.Duration
+	DedupGapThreshold time.Duration
+
+	FilterConfig string
+
+	DeploymentRateLimit float64
+	DeploymentRateBurst int
+	InstanceRateLimit   float64
+	InstanceRateBurst   int
+	MaxMetricNames      int
+	MaxTagValues        int
+
+	AggregateInterval time.Duration
+	AggregateMetrics  []string
+	AggregateSourceID string
+
+	LivenessMissedIntervals   int
+	LivenessHeartbeatInterval time.Duration
+	LivenessForgetAfter       time.Duration
+
+	AlertConfig      string
+	AlertLog         bool
+	AlertForgetAfter time.Duration
+
+	DiskPrediction           bool
+	DiskPredictionWindow     time.Duration
+	DiskPredictionMinSamples int
+
+	ShardIndex   int
+	ShardTotal   int
+	ShardStandby bool
+
+	Tap        bool
+	TapMaxRate float64
+
+	// HealthPort, PprofPort and AdminPort serve the health metrics, the
+	// pprof profiler and the admin api on localhost. 0 disables the
+	// endpoint.
+	HealthPort int
+	PprofPort  int
+	AdminPort  int
+
+	// AdminConfig is shown by the admin api. Secrets must be redacted.
+	// Defaults to the redacted directors.
+	AdminConfig any
+}
+
+// DefaultConfig returns the defaults of the forwarder command.
+func DefaultConfig() Config {
+	return Config{
+		MetronPort:        3458,
+		StreamIdleTimeout: 2 * time.Minute,
+		DrainTimeout:      15 * time.Second,
+		ValidateToken:     true,
+		UAAURLTTL:         auth.DefaultAddrTTL,
+
+		DirectorInfoRefresh:     5 * time.Minute,
+		InstanceMetadataRefresh: 5 * time.Minute,
+
+		DedupGapThreshold: 90 * time.Second,
+
+		DeploymentRateBurst: 100,
+		InstanceRateBurst:   10,
+
+		AggregateMetrics:  []string{"system.cpu.user", "system.mem.percent", "system.disk.persistent.percent"},
+		AggregateSourceID: "bosh-system-metrics-aggregator",
+
+		LivenessHeartbeatInterval: 30 * time.Second,
+		LivenessForgetAfter:       time.Hour,
+
+		AlertForgetAfter: time.Hour,
+
+		DiskPredictionWindow:     time.Hour,
+		DiskPredictionMinSamples: 5,
+
+		ShardTotal: 1,
+
+		TapMaxRate: 10,
+	}
+}
+
+func (c Config) validate() error {
+	if len(c.Directors) == 0 {
+		return errors.New("at least one director is required")
+	}
+
+	if c.StreamIdleTimeout <= 0 {
+		return errors.New("stream idle timeout must be positive")
+	}
+
+	if c.DirectorInfoTags && c.DirectorInfoRefresh <= 0 {
+		return errors.New("director info refresh interval must be positive")
+	}
+
+	if c.InstanceMetadataTags && c.InstanceMetadataRefresh <= 0 {
+		return errors.New("instance metadata refresh interval must be positive")
+	}
+
+	if c.LivenessMissedIntervals > 0 && c.LivenessHeartbeatInterval <= 0 {
+		return errors.New("liveness heartbeat interval must be positive")
+	}
+
+	// a standby takes over shards through the /shards endpoint of the
+	// health server.
+	if c.ShardStandby && c.HealthPort == 0 {
+		return errors.New("shard standby requires the health port")
+	}
+
+	return nil
+}
+
+// authOpts returns the options of the UAA client of the director
+// validating its tokens.
+func (c Config) authOpts(d config.Director, l *slog.Logger) []auth.AuthOpt {
+	opts := []auth.AuthOpt{auth.WithDirector(d.Name), auth.WithLogger(l)}
+	if c.ValidateToken {
+		opts = append(opts, auth.WithValidation(auth.Requirements{
+			Scope:    auth.SystemMetricsScope,
+			Audience: c.TokenAudience,
+		}))
+	}
+	if c.VerifyTokenSignature {
+		opts = append(opts, auth.WithSignatureVerification())
+	}
+
+	return opts
+}
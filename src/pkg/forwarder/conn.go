@@ -0,0 +1,197 @@
+package forwarder
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/auth"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/config"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/ingress"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/loggregator_v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+)
+
+// NewAuth returns the UAA client of the director configured with its
+// client auth method and refresh token, and the additional opts.
+func NewAuth(a *auth.AddressProvider, d config.Director, tlsConfig *tls.Config, opts ...auth.AuthOpt) (*auth.Auth, error) {
+	switch d.ClientAuthMethod {
+	case "", auth.ClientSecretPost:
+	case auth.ClientSecretBasic:
+		opts = append(opts, auth.WithClientSecretBasic())
+	default:
+		return nil, fmt.Errorf("invalid client auth method %q, expected %s or %s", d.ClientAuthMethod, auth.ClientSecretPost, auth.ClientSecretBasic)
+	}
+
+	if d.RefreshToken != "" {
+		opts = append(opts, auth.WithRefreshToken(d.RefreshToken))
+	}
+
+	return auth.New(a, d.ClientIdentity, d.ClientSecret, tlsConfig, opts...), nil
+}
+
+// NewMetronClient returns a client of the metron agent listening on the
+// given localhost port and a function closing its connection.
+func NewMetronClient(port int, caCert, certPath, keyPath string) (loggregator_v2.IngressClient, func() error, error) {
+	c, err := NewTLSConfig(caCert, certPath, keyPath, "metron")
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read metron tls certs: %s", err)
+	}
+
+	conn, err := grpc.NewClient(
+		fmt.Sprintf("localhost:%d", port),
+		grpc.WithTransportCredentials(credentials.NewTLS(c)),
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to connect to metron: %s", err)
+	}
+
+	return loggregator_v2.NewIngressClient(conn), conn.Close, nil
+}
+
+// NewMetricsServerClient returns a client of the metrics server of the
+// director and a function closing its connections. When the director has
+// several metrics server addresses the client fails over between them.
+func NewMetricsServerClient(d config.Director) (definitions.EgressClient, func() error, error) {
+	serverTLSConf := &tls.Config{
+		ServerName: d.MetricsServerCN,
+	}
+	err := SetCACert(serverTLSConf, d.MetricsServerCACert)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read metrics server ca cert: %s", err)
+	}
+
+	addrs, err := MetricsServerAddrs(d.MetricsServerAddr, d.MetricsServerResolve)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to resolve metrics server addr: %s", err)
+	}
+
+	var (
+		endpoints []ingress.Endpoint
+		closers   []func() error
+	)
+	closeAll := func() error {
+		var errs []error
+		for _, c := range closers {
+			errs = append(errs, c())
+		}
+		return errors.Join(errs...)
+	}
+
+	for _, addr := range addrs {
+		serverConn, err := grpc.NewClient(
+			addr,
+			grpc.WithTransportCredentials(credentials.NewTLS(serverTLSConf)),
+			grpc.WithKeepaliveParams(keepalive.ClientParameters{
+				Time:                10 * time.Second,
+				Timeout:             20 * time.Second,
+				PermitWithoutStream: true,
+			}),
+		)
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("unable to connect to metrics server %s: %s", addr, err)
+		}
+
+		endpoints = append(endpoints, ingress.Endpoint{
+			Addr:   addr,
+			Client: definitions.NewEgressClient(serverConn),
+		})
+		closers = append(closers, serverConn.Close)
+	}
+
+	if len(endpoints) == 1 {
+		return endpoints[0].Client, closeAll, nil
+	}
+
+	var opts []ingress.FailoverOpt
+	if d.MetricsServerPreferPrimary {
+		opts = append(opts, ingress.WithPreferPrimary())
+	}
+
+	return ingress.NewFailoverClient(endpoints, opts...), closeAll, nil
+}
+
+// MetricsServerAddrs splits the comma separated list of metrics server
+// addresses. When resolve is set each host is replaced by all of the
+// addresses it resolves to.
+func MetricsServerAddrs(addrList string, resolve bool) ([]string, error) {
+	var addrs []string
+	for _, addr := range splitList(addrList) {
+		if !resolve {
+			addrs = append(addrs, addr)
+			continue
+		}
+
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		ips, err := net.LookupHost(host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(ip, port))
+		}
+	}
+
+	if len(addrs) == 0 {
+		return nil, errors.New("no metrics server addr configured")
+	}
+
+	return addrs, nil
+}
+
+// NewTLSConfig returns a client tls config presenting the key pair and
+// trusting the PEM encoded caCert.
+func NewTLSConfig(caCert, certPath, keyPath, cn string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         cn,
+		Certificates:       []tls.Certificate{cert},
+		InsecureSkipVerify: false,
+	}
+
+	err = SetCACert(tlsConfig, caCert)
+	if err != nil {
+		return nil, err
+	}
+
+	return tlsConfig, nil
+}
+
+// SetCACert makes tlsConfig trust only the PEM encoded caCert.
+func SetCACert(tlsConfig *tls.Config, caCert string) error {
+	caCertPool := x509.NewCertPool()
+	if ok := caCertPool.AppendCertsFromPEM([]byte(caCert)); !ok {
+		return errors.New("cannot parse ca cert")
+	}
+
+	tlsConfig.RootCAs = caCertPool
+
+	return nil
+}
+
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
@@ -0,0 +1,572 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/admin"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/aggregate"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/alert"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/auth"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/config"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/dedup"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/enrichment"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/filter"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/ingress"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/liveness"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/logging"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/loggregator_v2"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/mapper"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/monitor"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/predict"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/ratelimit"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/shard"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/supervisor"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/tap"
+)
+
+// queueSize is the capacity of the queue between the directors and the
+// sinks.
+const queueSize = 1024
+
+type expirer interface {
+	Expiry() time.Time
+}
+
+// Run forwards the metrics of the directors to the sinks until ctx is
+// done or a component fails. It then stops receiving, drains the queued
+// envelopes to the sinks within the drain timeout and returns.
+// It returns a *SetupError without forwarding anything if the forwarder
+// cannot be set up, and the error of the first failed component otherwise.
+func Run(ctx context.Context, c Config) error {
+	err := c.validate()
+	if err != nil {
+		return &SetupError{Err: err}
+	}
+
+	l := c.Logger
+	if l == nil {
+		l = logging.Discard()
+	}
+
+	// the ports are bound before anything is set up so that a port in use
+	// fails the setup.
+	lis, err := listen(c)
+	if err != nil {
+		return &SetupError{Err: err}
+	}
+	defer lis.close()
+
+	// the subscription ids are rewritten when sharding.
+	directors := append([]config.Director(nil), c.Directors...)
+
+	messages := make(chan *loggregator_v2.Envelope, queueSize)
+
+	ingressOpts := []ingress.IngressOpt{ingress.WithIdleTimeout(c.StreamIdleTimeout)}
+	var healthOpts []monitor.HealthOpt
+
+	pause := &admin.Pause{}
+	if c.AdminPort != 0 {
+		ingressOpts = append(ingressOpts, ingress.WithPauser(pause))
+	}
+	var sharder *shard.Sharder
+	if c.ShardTotal > 1 {
+		var shardOpts []shard.SharderOpt
+		if c.ShardStandby {
+			shardOpts = append(shardOpts, shard.WithStandby())
+		}
+		sharder, err = shard.New(c.ShardIndex, c.ShardTotal, shardOpts...)
+		if err != nil {
+			return setupErrorf("invalid shard settings: %s", err)
+		}
+		healthOpts = append(healthOpts, monitor.WithHandler("/shards", sharder))
+
+		// every shard needs the events of all deployments, so each uses
+		// its own subscription.
+		for i := range directors {
+			directors[i].SubscriptionID = fmt.Sprintf("%s-shard-%d", directors[i].SubscriptionID, c.ShardIndex)
+		}
+	}
+
+	if c.FilterConfig != "" {
+		f, err := filter.Load(c.FilterConfig)
+		if err != nil {
+			return setupErrorf("unable to load filter config: %s", err)
+		}
+		ingressOpts = append(ingressOpts, ingress.WithFilter(f))
+	}
+
+	var alerts *alert.Engine
+	if c.AlertConfig != "" {
+		alertOpts := []alert.EngineOpt{alert.WithForgetAfter(c.AlertForgetAfter)}
+		if c.AlertLog {
+			alertOpts = append(alertOpts, alert.WithLogger(l))
+		}
+		alerts, err = alert.Load(c.AlertConfig, messages, alertOpts...)
+		if err != nil {
+			return setupErrorf("unable to load alert config: %s", err)
+		}
+		healthOpts = append(healthOpts, monitor.WithHandler("/alerts", alerts))
+	}
+
+	var eventTap *tap.Tap
+	if c.Tap {
+		eventTap = tap.New(tap.WithMaxRate(c.TapMaxRate))
+		healthOpts = append(healthOpts, monitor.WithHandler("/tap", eventTap))
+	}
+
+	var ingresses []*directorIngress
+	closeIngresses := func() {
+		for _, di := range ingresses {
+			di.close()
+		}
+	}
+	for _, d := range directors {
+		di, err := setupIngress(d, c, l, eventTap, sharder, alerts, ingressOpts, messages)
+		if err != nil {
+			closeIngresses()
+			return setupErrorf("unable to set up director %s: %s", d.Name, err)
+		}
+		ingresses = append(ingresses, di)
+	}
+
+	sinks := c.Sinks
+	if len(sinks) == 0 {
+		metron, err := NewMetronSink(c.MetronPort, c.MetronCACert, c.MetronCertPath, c.MetronKeyPath, l)
+		if err != nil {
+			closeIngresses()
+			return &SetupError{Err: err}
+		}
+		sinks = map[string]Sink{"metron": metron}
+	}
+
+	sup := supervisor.New(ctx, l)
+
+	// producers write to messages and must all have returned before it is
+	// closed.
+	var producers sync.WaitGroup
+	produce := func(name string, run func(ctx context.Context) error) {
+		producers.Add(1)
+		sup.Go(name, func(ctx context.Context) error {
+			defer producers.Done()
+			return run(ctx)
+		})
+	}
+	for _, di := range ingresses {
+		di.run(produce)
+	}
+
+	// the sinks keep draining messages after ctx is done, so they do not
+	// use the context of the supervisor.
+	drainCtx, cancelDrain := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelDrain()
+	var sinkPause pauser
+	if c.AdminPort != 0 {
+		sinkPause = pause
+	}
+	drained := runSinks(drainCtx, sup, sinks, messages, sinkPause)
+
+	sup.Go("queue", func(ctx context.Context) error {
+		<-ctx.Done()
+		l.Info("process shutting down, stop accepting messages from system metrics server")
+		producers.Wait()
+		close(messages)
+
+		l.Info("draining remaining messages")
+		var timeout <-chan time.Time
+		if c.DrainTimeout > 0 {
+			timeout = time.After(c.DrainTimeout)
+		}
+		select {
+		case <-drained:
+		case <-timeout:
+			l.Warn("unable to drain messages within the drain timeout, dropping the remaining messages", "drain_timeout", c.DrainTimeout)
+			cancelDrain()
+		}
+
+		return nil
+	})
+
+	if lis.health != nil {
+		sup.Go("health", monitor.NewHealth(lis.health, l, healthOpts...).Serve)
+	}
+	if lis.pprof != nil {
+		sup.Go("pprof", monitor.NewProfiler(lis.pprof, l).Serve)
+	}
+	if lis.admin != nil {
+		adminServer := newAdmin(c, l, pause, directors, ingresses, sinks, messages)
+		sup.Go("admin", monitor.NewServer("admin", lis.admin, adminServer.Handler(), l).Serve)
+	}
+
+	err = sup.Wait()
+	closeIngresses()
+
+	l.Info("shutdown complete")
+
+	return err
+}
+
+// SetupError is returned by Run if the forwarder cannot be set up from
+// its Config. Nothing has been forwarded when it is returned.
+type SetupError struct {
+	Err error
+}
+
+func (e *SetupError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *SetupError) Unwrap() error {
+	return e.Err
+}
+
+func setupErrorf(format string, args ...any) error {
+	return &SetupError{Err: fmt.Errorf(format, args...)}
+}
+
+// listeners are the listeners of the localhost endpoints. A listener is
+// nil if its endpoint is disabled.
+type listeners struct {
+	health net.Listener
+	pprof  net.Listener
+	admin  net.Listener
+}
+
+// listen listens on the ports of the enabled endpoints.
+// It returns an error if a port cannot be bound.
+func listen(c Config) (listeners, error) {
+	var lis listeners
+	for _, l := range []struct {
+		name string
+		port int
+		lis  *net.Listener
+	}{
+		{"health", c.HealthPort, &lis.health},
+		{"pprof", c.PprofPort, &lis.pprof},
+		{"admin", c.AdminPort, &lis.admin},
+	} {
+		if l.port == 0 {
+			continue
+		}
+
+		var err error
+		*l.lis, err = monitor.Listen(uint32(l.port))
+		if err != nil {
+			lis.close()
+			return listeners{}, fmt.Errorf("unable to listen on %s port: %s", l.name, err)
+		}
+	}
+
+	return lis, nil
+}
+
+// close closes the listeners. Listeners of servers that were shut down
+// are already closed.
+func (lis listeners) close() {
+	for _, l := range []net.Listener{lis.health, lis.pprof, lis.admin} {
+		if l != nil {
+			l.Close()
+		}
+	}
+}
+
+// untilDone adapts a component started with a function returning its stop
+// function to run until ctx is done.
+func untilDone(start func() func()) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		stop := start()
+		<-ctx.Done()
+		stop()
+
+		return nil
+	}
+}
+
+// directorStatus is the state of a director as reported by the admin api.
+type directorStatus struct {
+	Stream      ingress.StreamStatus `json:"stream"`
+	TokenExpiry time.Time            `json:"token_expiry"`
+}
+
+// queueStatus is the state of a queue as reported by the admin api.
+type queueStatus struct {
+	Depth    int `json:"depth"`
+	Capacity int `json:"capacity"`
+}
+
+func newAdmin(
+	c Config,
+	l *slog.Logger,
+	pause *admin.Pause,
+	directors []config.Director,
+	ingresses []*directorIngress,
+	sinks map[string]Sink,
+	messages chan *loggregator_v2.Envelope,
+) *admin.Server {
+	adminConfig := c.AdminConfig
+	if adminConfig == nil {
+		redacted := make([]config.Director, 0, len(directors))
+		for _, d := range directors {
+			redacted = append(redacted, d.Redacted())
+		}
+		adminConfig = map[string]any{"directors": redacted}
+	}
+
+	return admin.New(
+		l,
+		admin.WithConfig(adminConfig),
+		admin.WithLogLevel(c.LogLevel),
+		admin.WithPause(pause),
+		admin.WithStatus("directors", func() any {
+			statuses := make([]directorStatus, 0, len(ingresses))
+			for _, di := range ingresses {
+				statuses = append(statuses, di.status())
+			}
+			return statuses
+		}),
+		admin.WithStatus("queues", func() any {
+			return map[string]queueStatus{
+				"messages": {Depth: len(messages), Capacity: cap(messages)},
+			}
+		}),
+		admin.WithStatus("sinks", func() any {
+			statuses := make(map[string]any, len(sinks))
+			for name, s := range sinks {
+				if s, ok := s.(statuser); ok {
+					statuses[name] = s.Status()
+				}
+			}
+			return statuses
+		}),
+	)
+}
+
+// directorIngress is the Ingress forwarding the metrics of a director
+// along with the background refreshers and liveness tracking of the
+// director.
+type directorIngress struct {
+	name      string
+	ingress   *ingress.Ingress
+	tokens    TokenSource
+	starters  map[string]func() func()
+	closeConn func() error
+}
+
+// run runs the background refreshers and the Ingress with produce.
+func (di *directorIngress) run(produce func(name string, run func(ctx context.Context) error)) {
+	prefix := ""
+	if di.name != "" {
+		prefix = di.name + " "
+	}
+
+	for name, start := range di.starters {
+		produce(prefix+name, untilDone(start))
+	}
+	produce(prefix+"ingress", di.ingress.Run)
+}
+
+// close closes the connections to the metrics server.
+func (di *directorIngress) close() {
+	di.closeConn()
+}
+
+func (di *directorIngress) status() directorStatus {
+	s := directorStatus{Stream: di.ingress.Status()}
+	if e, ok := di.tokens.(expirer); ok {
+		s.TokenExpiry = e.Expiry()
+	}
+
+	return s
+}
+
+// setupIngress wires up an Ingress which forwards the metrics of the given
+// director to messages. Nothing runs until the returned directorIngress
+// is run.
+func setupIngress(
+	d config.Director,
+	c Config,
+	l *slog.Logger,
+	eventTap *tap.Tap,
+	sharder *shard.Sharder,
+	alerts *alert.Engine,
+	opts []ingress.IngressOpt,
+	messages chan *loggregator_v2.Envelope,
+) (*directorIngress, error) {
+	directorTLSConf := &tls.Config{}
+	err := SetCACert(directorTLSConf, d.CACert)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read director ca cert: %s", err)
+	}
+
+	mapperOpts := []mapper.MapperOpt{mapper.WithUnitMode(c.UnitMode)}
+	if d.Name != "" {
+		l = l.With("director", d.Name)
+		mapperOpts = append(mapperOpts, mapper.WithTags(map[string]string{"director": d.Name}))
+	}
+
+	addressProvider := auth.NewAddressProvider(d.URL, directorTLSConf, auth.WithAddrTTL(c.UAAURLTTL))
+	var tokens TokenSource
+	if c.TokenSource != nil {
+		tokens = c.TokenSource(d, directorTLSConf)
+	} else {
+		tokens, err = NewAuth(addressProvider, d, directorTLSConf, c.authOpts(d, l)...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	di := &directorIngress{
+		name:     d.Name,
+		tokens:   tokens,
+		starters: make(map[string]func() func()),
+	}
+
+	// the tags are only added by the default mapper.
+	tagging := c.Mapper == nil
+
+	if tagging && c.DirectorInfoTags {
+		di.starters["director info"] = func() func() {
+			return addressProvider.Start(c.DirectorInfoRefresh, l)
+		}
+		mapperOpts = append(mapperOpts, mapper.WithTagger(directorInfoTagger(addressProvider)))
+	}
+
+	for _, t := range c.Taggers {
+		mapperOpts = append(mapperOpts, mapper.WithTagger(t))
+	}
+
+	var instances *enrichment.InstanceCache
+	if (tagging && c.InstanceMetadataTags) || c.LivenessMissedIntervals > 0 {
+		instances = enrichment.NewInstanceCache(d.URL, directorTLSConf, tokens, l, enrichment.WithDirector(d.Name))
+	}
+
+	if tagging && c.InstanceMetadataTags {
+		di.starters["instance metadata"] = func() func() {
+			return instances.Start(c.InstanceMetadataRefresh)
+		}
+		mapperOpts = append(mapperOpts, mapper.WithTagger(instances))
+	}
+
+	ingressOpts := []ingress.IngressOpt{ingress.WithDirector(d.Name)}
+	if sharder != nil {
+		ingressOpts = append(ingressOpts, ingress.WithFilter(sharder.Director(d.Name)))
+	}
+	ingressOpts = append(ingressOpts, opts...)
+
+	// event ids and deployments are only unique per director, so each
+	// director is deduplicated and limited on its own.
+	if c.DedupWindow > 0 {
+		ingressOpts = append(ingressOpts, ingress.WithFilter(dedup.New(
+			dedup.WithWindow(c.DedupWindow),
+			dedup.WithGapThreshold(c.DedupGapThreshold),
+			dedup.WithDirector(d.Name),
+		)))
+	}
+	if c.DeploymentRateLimit > 0 || c.InstanceRateLimit > 0 || c.MaxMetricNames > 0 || c.MaxTagValues > 0 {
+		ingressOpts = append(ingressOpts, ingress.WithLimiter(ratelimit.New(
+			ratelimit.WithDeploymentLimit(c.DeploymentRateLimit, c.DeploymentRateBurst),
+			ratelimit.WithInstanceLimit(c.InstanceRateLimit, c.InstanceRateBurst),
+			ratelimit.WithMaxMetricNames(c.MaxMetricNames),
+			ratelimit.WithMaxTagValues(c.MaxTagValues),
+			ratelimit.WithDirector(d.Name),
+			ratelimit.WithLogger(l),
+		)))
+	}
+
+	if c.AggregateInterval > 0 {
+		aggregateOpts := []aggregate.AggregatorOpt{
+			aggregate.WithMetrics(c.AggregateMetrics),
+			aggregate.WithSourceID(c.AggregateSourceID),
+			aggregate.WithUnitMode(c.UnitMode),
+		}
+		if d.Name != "" {
+			aggregateOpts = append(aggregateOpts, aggregate.WithTags(map[string]string{"director": d.Name}))
+		}
+		aggregator := aggregate.New(messages, aggregateOpts...)
+		di.starters["aggregator"] = func() func() {
+			return aggregator.Start(c.AggregateInterval)
+		}
+		ingressOpts = append(ingressOpts, ingress.WithObserver(aggregator))
+	}
+
+	if c.DiskPrediction {
+		predictOpts := []predict.DiskPredictorOpt{
+			predict.WithWindow(c.DiskPredictionWindow),
+			predict.WithMinSamples(c.DiskPredictionMinSamples),
+		}
+		if d.Name != "" {
+			predictOpts = append(predictOpts, predict.WithTags(map[string]string{"director": d.Name}))
+		}
+		ingressOpts = append(ingressOpts, ingress.WithObserver(predict.New(messages, predictOpts...)))
+	}
+
+	if alerts != nil {
+		ingressOpts = append(ingressOpts, ingress.WithObserver(alerts.Director(d.Name)))
+	}
+
+	if c.LivenessMissedIntervals > 0 {
+		livenessOpts := []liveness.TrackerOpt{
+			liveness.WithHeartbeatInterval(c.LivenessHeartbeatInterval),
+			liveness.WithMissedIntervals(c.LivenessMissedIntervals),
+			liveness.WithForgetAfter(c.LivenessForgetAfter),
+			liveness.WithInstanceLister(instances),
+		}
+		if d.Name != "" {
+			livenessOpts = append(livenessOpts, liveness.WithTags(map[string]string{"director": d.Name}))
+		}
+		tracker := liveness.New(messages, livenessOpts...)
+		di.starters["liveness"] = tracker.Start
+		// rate limited heartbeats still show the instance is alive.
+		ingressOpts = append(ingressOpts, ingress.WithPreLimitObserver(tracker))
+	}
+
+	convert := c.Mapper
+	if convert == nil {
+		convert = mapper.New(c.EnvelopeIPTag, mapperOpts...)
+	}
+	if eventTap != nil {
+		convert = eventTap.Wrap(d.Name, convert)
+	}
+
+	serverClient, closeConn, err := NewMetricsServerClient(d)
+	if err != nil {
+		return nil, err
+	}
+	di.closeConn = closeConn
+
+	di.ingress = ingress.New(
+		serverClient,
+		convert,
+		messages,
+		tokens,
+		d.SubscriptionID,
+		l,
+		ingressOpts...,
+	)
+
+	return di, nil
+}
+
+// directorInfoTagger tags envelopes with the metadata of the director once
+// it is known. The name reported by the director is tagged as
+// director_name, the director tag is the configured name.
+func directorInfoTagger(a *auth.AddressProvider) mapper.Tagger {
+	return mapper.TaggerFunc(func(*definitions.Event) map[string]string {
+		info := a.Info()
+		if info.UUID == "" {
+			return nil
+		}
+
+		return map[string]string{
+			"director_name": info.Name,
+			"director_uuid": info.UUID,
+			"bosh_version":  info.Version,
+		}
+	})
+}
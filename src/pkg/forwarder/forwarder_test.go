@@ -0,0 +1,466 @@
+package forwarder_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/config"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/forwarder"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/loggregator_v2"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+func TestRunForwardsEventsToAllSinks(t *testing.T) {
+	RegisterTestingT(t)
+
+	caCert, addr := startMetricsServer(t)
+	metron := newSpySink()
+	other := newSpySink()
+
+	c := forwarder.DefaultConfig()
+	c.Directors = []config.Director{{
+		CACert:              caCert,
+		MetricsServerAddr:   addr,
+		MetricsServerCACert: caCert,
+		MetricsServerCN:     "metrics-server",
+		SubscriptionID:      "sub-id",
+	}}
+	c.Sinks = map[string]forwarder.Sink{"metron": metron, "other": other}
+	c.TokenSource = func(config.Director, *tls.Config) forwarder.TokenSource {
+		return spyTokenSource{}
+	}
+	c.Mapper = func(event *definitions.Event) (*loggregator_v2.Envelope, error) {
+		return &loggregator_v2.Envelope{SourceId: event.GetDeployment()}, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- forwarder.Run(ctx, c)
+	}()
+
+	Eventually(metron.sourceIDs).Should(ContainElement("cf"))
+	Eventually(other.sourceIDs).Should(ContainElement("cf"))
+
+	cancel()
+	Eventually(done, 5).Should(Receive(BeNil()))
+	Expect(metron.isStopped()).To(BeTrue())
+	Expect(other.isStopped()).To(BeTrue())
+}
+
+func TestRunReturnsSetupErrors(t *testing.T) {
+	RegisterTestingT(t)
+
+	c := forwarder.DefaultConfig()
+	Expect(forwarder.Run(context.Background(), c)).To(MatchError(ContainSubstring("director is required")))
+
+	c.Directors = []config.Director{{Name: "bosh", CACert: "invalid"}}
+	c.Sinks = map[string]forwarder.Sink{"spy": newSpySink()}
+	err := forwarder.Run(context.Background(), c)
+	Expect(err).To(MatchError(ContainSubstring("director ca cert")))
+	var setupErr *forwarder.SetupError
+	Expect(errors.As(err, &setupErr)).To(BeTrue())
+
+	c.ShardTotal = 2
+	c.ShardStandby = true
+	Expect(forwarder.Run(context.Background(), c)).To(MatchError(ContainSubstring("shard standby requires the health port")))
+}
+
+func TestRunReturnsComponentFailures(t *testing.T) {
+	RegisterTestingT(t)
+
+	caCert, addr := startMetricsServer(t)
+	sink := newSpySink()
+
+	c := forwarder.DefaultConfig()
+	c.Directors = []config.Director{{
+		Name:                "bosh",
+		CACert:              caCert,
+		MetricsServerAddr:   addr,
+		MetricsServerCACert: caCert,
+		MetricsServerCN:     "metrics-server",
+	}}
+	c.Sinks = map[string]forwarder.Sink{"spy": sink}
+	c.TokenSource = func(config.Director, *tls.Config) forwarder.TokenSource {
+		return spyTokenSource{err: errors.New("uaa is down")}
+	}
+
+	err := forwarder.Run(context.Background(), c)
+	Expect(err).To(MatchError(ContainSubstring("bosh ingress: unable to get token: uaa is down")))
+	var setupErr *forwarder.SetupError
+	Expect(errors.As(err, &setupErr)).To(BeFalse())
+	Expect(sink.isStopped()).To(BeTrue())
+}
+
+func TestRunStopsDrainingAfterDrainTimeout(t *testing.T) {
+	RegisterTestingT(t)
+
+	caCert, addr := startMetricsServer(t)
+
+	c := forwarder.DefaultConfig()
+	c.Directors = []config.Director{{
+		CACert:              caCert,
+		MetricsServerAddr:   addr,
+		MetricsServerCACert: caCert,
+		MetricsServerCN:     "metrics-server",
+	}}
+	c.Sinks = map[string]forwarder.Sink{"stuck": stuckSink{}}
+	c.TokenSource = func(config.Director, *tls.Config) forwarder.TokenSource {
+		return spyTokenSource{}
+	}
+	c.DrainTimeout = 50 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- forwarder.Run(ctx, c)
+	}()
+
+	cancel()
+	Eventually(done).Should(Receive(BeNil()))
+}
+
+func TestRunAggregatesPerDirector(t *testing.T) {
+	RegisterTestingT(t)
+
+	sink := newSpySink()
+	c := forwarder.DefaultConfig()
+	for _, name := range []string{"bosh-1", "bosh-2"} {
+		caCert, addr := startMetricsServer(t)
+		c.Directors = append(c.Directors, config.Director{
+			Name:                name,
+			CACert:              caCert,
+			MetricsServerAddr:   addr,
+			MetricsServerCACert: caCert,
+			MetricsServerCN:     "metrics-server",
+		})
+	}
+	c.Sinks = map[string]forwarder.Sink{"spy": sink}
+	c.TokenSource = func(config.Director, *tls.Config) forwarder.TokenSource {
+		return spyTokenSource{}
+	}
+	c.AggregateInterval = 10 * time.Millisecond
+	// both metrics servers send the same event id.
+	c.DedupWindow = time.Minute
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go forwarder.Run(ctx, c)
+
+	rollupDirectors := func() []string {
+		var directors []string
+		for _, e := range sink.all() {
+			if e.GetSourceId() == c.AggregateSourceID && e.GetTags()["job"] == "" {
+				Expect(e.GetGauge().GetMetrics()["instances"].GetValue()).To(Equal(1.0))
+				directors = append(directors, e.GetTags()["director"])
+			}
+		}
+		return directors
+	}
+	Eventually(rollupDirectors).Should(ContainElements("bosh-1", "bosh-2"))
+}
+
+func TestRunLimitsPerDirector(t *testing.T) {
+	RegisterTestingT(t)
+
+	sink := newSpySink()
+	c := forwarder.DefaultConfig()
+	for _, name := range []string{"bosh-1", "bosh-2"} {
+		caCert, addr := startMetricsServer(t)
+		c.Directors = append(c.Directors, config.Director{
+			Name:                name,
+			CACert:              caCert,
+			MetricsServerAddr:   addr,
+			MetricsServerCACert: caCert,
+			MetricsServerCN:     "metrics-server",
+		})
+	}
+	c.Sinks = map[string]forwarder.Sink{"spy": sink}
+	c.TokenSource = func(config.Director, *tls.Config) forwarder.TokenSource {
+		return spyTokenSource{}
+	}
+	// both metrics servers send a heartbeat of the deployment cf.
+	c.DeploymentRateLimit = 0.001
+	c.DeploymentRateBurst = 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go forwarder.Run(ctx, c)
+
+	heartbeatDirectors := func() []string {
+		var directors []string
+		for _, e := range sink.all() {
+			if e.GetTags()["job"] == "router" {
+				directors = append(directors, e.GetTags()["director"])
+			}
+		}
+		return directors
+	}
+	Eventually(heartbeatDirectors).Should(ConsistOf("bosh-1", "bosh-2"))
+}
+
+func TestRunServesEndpointsUntilContextIsDone(t *testing.T) {
+	RegisterTestingT(t)
+
+	caCert, addr := startMetricsServer(t)
+	port := freePort(t)
+
+	c := forwarder.DefaultConfig()
+	c.Directors = []config.Director{{
+		CACert:              caCert,
+		MetricsServerAddr:   addr,
+		MetricsServerCACert: caCert,
+		MetricsServerCN:     "metrics-server",
+	}}
+	c.Sinks = map[string]forwarder.Sink{"spy": newSpySink()}
+	c.TokenSource = func(config.Director, *tls.Config) forwarder.TokenSource {
+		return spyTokenSource{}
+	}
+	c.HealthPort = port
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- forwarder.Run(ctx, c)
+	}()
+
+	metricsURL := fmt.Sprintf("http://localhost:%d/metrics", port)
+	Eventually(func() error {
+		resp, err := http.Get(metricsURL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}).Should(Succeed())
+
+	cancel()
+	Eventually(done, 5).Should(Receive(BeNil()))
+
+	lis, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+	Expect(err).ToNot(HaveOccurred())
+	lis.Close()
+}
+
+func TestRunDoesNotForwardWhilePaused(t *testing.T) {
+	RegisterTestingT(t)
+
+	caCert, addr := startMetricsServer(t)
+	port := freePort(t)
+	sink := newSpySink()
+
+	c := forwarder.DefaultConfig()
+	c.Directors = []config.Director{{
+		CACert:              caCert,
+		MetricsServerAddr:   addr,
+		MetricsServerCACert: caCert,
+		MetricsServerCN:     "metrics-server",
+	}}
+	c.Sinks = map[string]forwarder.Sink{"spy": sink}
+	c.TokenSource = func(config.Director, *tls.Config) forwarder.TokenSource {
+		return spyTokenSource{}
+	}
+	c.AdminPort = port
+	// the aggregator keeps producing envelopes without any events.
+	c.AggregateInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go forwarder.Run(ctx, c)
+
+	forwarded := func() int { return len(sink.all()) }
+	Eventually(forwarded).Should(BeNumerically(">", 0))
+
+	pauseURL := fmt.Sprintf("http://localhost:%d/pause", port)
+	send := func(method string) {
+		req, err := http.NewRequest(method, pauseURL, nil)
+		Expect(err).ToNot(HaveOccurred())
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).ToNot(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+	}
+
+	send(http.MethodPut)
+	// envelopes queued before the pause are still delivered.
+	time.Sleep(50 * time.Millisecond)
+	n := forwarded()
+	Consistently(forwarded, "200ms").Should(Equal(n))
+
+	send(http.MethodDelete)
+	Eventually(forwarded).Should(BeNumerically(">", n))
+}
+
+func TestRunReturnsSetupErrorWhenPortIsInUse(t *testing.T) {
+	RegisterTestingT(t)
+
+	lis, err := net.Listen("tcp", "localhost:0")
+	Expect(err).ToNot(HaveOccurred())
+	defer lis.Close()
+
+	c := forwarder.DefaultConfig()
+	c.Directors = []config.Director{{Name: "bosh"}}
+	c.AdminPort = lis.Addr().(*net.TCPAddr).Port
+
+	err = forwarder.Run(context.Background(), c)
+	Expect(err).To(MatchError(ContainSubstring("unable to listen on admin port")))
+	var setupErr *forwarder.SetupError
+	Expect(errors.As(err, &setupErr)).To(BeTrue())
+}
+
+func freePort(t *testing.T) int {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	return lis.Addr().(*net.TCPAddr).Port
+}
+
+type spyTokenSource struct {
+	err error
+}
+
+func (s spyTokenSource) Token() (string, error) {
+	return "bearer token", s.err
+}
+
+type spySink struct {
+	mu        sync.Mutex
+	envelopes []*loggregator_v2.Envelope
+	stopped   bool
+}
+
+func newSpySink() *spySink {
+	return &spySink{}
+}
+
+func (s *spySink) Run(ctx context.Context, messages <-chan *loggregator_v2.Envelope) error {
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.stopped = true
+	}()
+
+	for e := range messages {
+		s.mu.Lock()
+		s.envelopes = append(s.envelopes, e)
+		s.mu.Unlock()
+	}
+
+	return nil
+}
+
+func (s *spySink) sourceIDs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ids []string
+	for _, e := range s.envelopes {
+		ids = append(ids, e.GetSourceId())
+	}
+	return ids
+}
+
+func (s *spySink) all() []*loggregator_v2.Envelope {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]*loggregator_v2.Envelope(nil), s.envelopes...)
+}
+
+func (s *spySink) isStopped() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.stopped
+}
+
+// stuckSink never consumes an envelope, like a sink whose destination is
+// down.
+type stuckSink struct{}
+
+func (stuckSink) Run(ctx context.Context, _ <-chan *loggregator_v2.Envelope) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+type spyMetricsServer struct{}
+
+func (spyMetricsServer) BoshMetrics(_ *definitions.EgressRequest, stream definitions.Egress_BoshMetricsServer) error {
+	err := stream.Send(&definitions.Event{
+		Id:         "event-1",
+		Timestamp:  time.Now().Unix(),
+		Deployment: "cf",
+		Message: &definitions.Event_Heartbeat{
+			Heartbeat: &definitions.Heartbeat{Job: "router", InstanceId: "id-1"},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	<-stream.Context().Done()
+	return nil
+}
+
+// startMetricsServer starts a metrics server sending a single heartbeat on
+// every stream. It returns the PEM encoded cert the server presents for
+// metrics-server and its address.
+func startMetricsServer(t *testing.T) (string, string) {
+	cert := newServerCert(t, "metrics-server")
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := grpc.NewServer(grpc.Creds(credentials.NewServerTLSFromCert(&cert)))
+	definitions.RegisterEgressServer(s, spyMetricsServer{})
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})), lis.Addr().String()
+}
+
+func newServerCert(t *testing.T, name string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
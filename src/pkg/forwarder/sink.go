@@ -0,0 +1,171 @@
+package forwarder
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/egress"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/loggregator_v2"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/supervisor"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Sink consumes the forwarded envelopes.
+// Run consumes messages until it is closed and drained, and returns nil.
+// If ctx is done before, it returns the error of ctx. Envelopes are shared
+// between sinks and must not be modified.
+// If a Sink also has a Status() any method, its status is reported by the
+// admin api.
+type Sink interface {
+	Run(ctx context.Context, messages <-chan *loggregator_v2.Envelope) error
+}
+
+type statuser interface {
+	Status() any
+}
+
+type pauser interface {
+	Paused() bool
+}
+
+var (
+	sinkDroppedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "forwarder",
+		Name:      "sink_dropped",
+		Help:      "Envelopes dropped because the queue of a sink was full",
+	}, []string{"sink"})
+	pausedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "forwarder",
+		Name:      "paused",
+		Help:      "Envelopes discarded because forwarding was paused",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(sinkDroppedCounter)
+	prometheus.MustRegister(pausedCounter)
+}
+
+// sinkQueueSize is the capacity of the queue of each sink when there are
+// several sinks.
+const sinkQueueSize = 1024
+
+type metronSink struct {
+	client    loggregator_v2.IngressClient
+	connClose func() error
+	logger    *slog.Logger
+	egress    atomic.Pointer[egress.Egress]
+}
+
+// NewMetronSink returns a Sink sending envelopes to the metron agent
+// listening on the given localhost port. caCert is the PEM encoded CA
+// cert of metron.
+func NewMetronSink(port int, caCert, certPath, keyPath string, l *slog.Logger) (Sink, error) {
+	client, connClose, err := NewMetronClient(port, caCert, certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &metronSink{
+		client:    client,
+		connClose: connClose,
+		logger:    l,
+	}, nil
+}
+
+func (s *metronSink) Run(ctx context.Context, messages <-chan *loggregator_v2.Envelope) error {
+	defer s.connClose()
+
+	e := egress.New(s.client, messages, s.logger)
+	s.egress.Store(e)
+
+	return e.Run(ctx)
+}
+
+func (s *metronSink) Status() any {
+	e := s.egress.Load()
+	if e == nil {
+		return egress.Stats{}
+	}
+
+	return e.Stats()
+}
+
+// runSinks runs the sinks consuming messages with sup. With several sinks
+// every envelope is copied to the queue of each sink and dropped for sinks
+// whose queue is full, so a slow sink does not hold back the others.
+// Envelopes are discarded while pause is paused, whichever component
+// produced them. pause may be nil.
+// The returned channel is closed once all sinks returned.
+func runSinks(ctx context.Context, sup *supervisor.Supervisor, sinks map[string]Sink, messages <-chan *loggregator_v2.Envelope, pause pauser) <-chan struct{} {
+	var wg sync.WaitGroup
+	consume := func(name string, run func() error) {
+		wg.Add(1)
+		sup.Go(name, func(context.Context) error {
+			defer wg.Done()
+			return run()
+		})
+	}
+
+	names := make([]string, 0, len(sinks))
+	for name := range sinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if len(names) == 1 && pause == nil {
+		consume("sink "+names[0], func() error {
+			return sinks[names[0]].Run(ctx, messages)
+		})
+	} else {
+		queues := make([]chan *loggregator_v2.Envelope, len(names))
+		for i, name := range names {
+			queue := make(chan *loggregator_v2.Envelope, sinkQueueSize)
+			queues[i] = queue
+			consume("sink "+name, func() error {
+				return sinks[name].Run(ctx, queue)
+			})
+		}
+
+		consume("fan out", func() error {
+			defer func() {
+				for _, q := range queues {
+					close(q)
+				}
+			}()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case envelope, ok := <-messages:
+					if !ok {
+						return nil
+					}
+					if pause != nil && pause.Paused() {
+						pausedCounter.Inc()
+						continue
+					}
+					for i, q := range queues {
+						select {
+						case q <- envelope:
+						default:
+							sinkDroppedCounter.WithLabelValues(names[i]).Inc()
+						}
+					}
+				}
+			}
+		})
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+
+	return drained
+}
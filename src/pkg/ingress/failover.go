@@ -0,0 +1,267 @@
+package ingress
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/definitions"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	endpointErrCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "ingress",
+		Name:      "endpoint_err",
+		Help:      "Tracks errors per metrics server endpoint",
+	}, []string{"addr"})
+	endpointActiveGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "ingress",
+		Name:      "endpoint_active",
+		Help:      "Whether the metrics server endpoint was used for the latest stream",
+	}, []string{"addr"})
+)
+
+func init() {
+	prometheus.MustRegister(endpointErrCounter)
+	prometheus.MustRegister(endpointActiveGauge)
+}
+
+// Endpoint is a metrics server address and the client connected to it.
+type Endpoint struct {
+	Addr   string
+	Client definitions.EgressClient
+}
+
+type endpoint struct {
+	Endpoint
+	unhealthyUntil time.Time
+}
+
+// FailoverClient is a definitions.EgressClient that establishes streams
+// to one of several metrics server endpoints.
+// An endpoint that fails to establish a stream, or whose stream fails, is
+// considered unhealthy for the cooldown period and the next healthy
+// endpoint is used instead.
+type FailoverClient struct {
+	cooldown      time.Duration
+	preferPrimary bool
+
+	mu        sync.Mutex
+	endpoints []*endpoint
+	current   int
+}
+
+type FailoverOpt func(*FailoverClient)
+
+// WithCooldown sets how long a failed endpoint is skipped for.
+func WithCooldown(d time.Duration) FailoverOpt {
+	return func(c *FailoverClient) {
+		c.cooldown = d
+	}
+}
+
+// WithPreferPrimary makes the client favour the first endpoint.
+// Once the primary endpoint has cooled down it is tried first again, so
+// the client moves back to it once it recovers. While a stream to another
+// endpoint is established the primary endpoint is probed every cooldown
+// period, and the stream is moved to it as soon as it accepts one.
+func WithPreferPrimary() FailoverOpt {
+	return func(c *FailoverClient) {
+		c.preferPrimary = true
+	}
+}
+
+// NewFailoverClient returns a new FailoverClient.
+// The endpoints are tried in order.
+func NewFailoverClient(endpoints []Endpoint, opts ...FailoverOpt) *FailoverClient {
+	c := &FailoverClient{
+		cooldown: 30 * time.Second,
+	}
+
+	for _, e := range endpoints {
+		c.endpoints = append(c.endpoints, &endpoint{Endpoint: e})
+	}
+
+	for _, o := range opts {
+		o(c)
+	}
+
+	return c
+}
+
+// BoshMetrics establishes a stream to the first healthy endpoint.
+// When every endpoint is unhealthy it tries them all anyway.
+// It returns the error of the last endpoint tried if none of them succeed.
+func (c *FailoverClient) BoshMetrics(ctx context.Context, in *definitions.EgressRequest, opts ...grpc.CallOption) (definitions.Egress_BoshMetricsClient, error) {
+	err := errors.New("no metrics server endpoints configured")
+	for _, idx := range c.candidates() {
+		e := c.endpoints[idx]
+
+		// the stream has its own context so that it can be cancelled
+		// when it is moved back to the primary endpoint.
+		streamCtx, cancel := context.WithCancel(ctx)
+		var stream definitions.Egress_BoshMetricsClient
+		stream, err = e.Client.BoshMetrics(streamCtx, in, opts...)
+		if status.Code(err) == codes.PermissionDenied {
+			cancel()
+			// All endpoints share the token, trying others won't help.
+			return nil, err
+		}
+		if err != nil {
+			cancel()
+			c.markUnhealthy(idx)
+			continue
+		}
+
+		c.activate(idx)
+		s := &failoverStream{
+			Egress_BoshMetricsClient: stream,
+			ctx:                      ctx,
+			client:                   c,
+			idx:                      idx,
+			cancel:                   cancel,
+		}
+		if c.preferPrimary && idx != 0 {
+			go c.failback(ctx, s, in, opts...)
+		}
+
+		return s, nil
+	}
+
+	return nil, err
+}
+
+// failback probes the primary endpoint once it has cooled down until it
+// accepts a stream or ctx is done. The stream of s is then moved to the
+// primary endpoint.
+func (c *FailoverClient) failback(ctx context.Context, s *failoverStream, in *definitions.EgressRequest, opts ...grpc.CallOption) {
+	primary := c.endpoints[0]
+	for {
+		c.mu.Lock()
+		wait := time.Until(primary.unhealthyUntil)
+		c.mu.Unlock()
+
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+
+		streamCtx, cancel := context.WithCancel(ctx)
+		stream, err := primary.Client.BoshMetrics(streamCtx, in, opts...)
+		if err != nil {
+			cancel()
+			c.markUnhealthy(0)
+			continue
+		}
+
+		c.activate(0)
+		s.failback(stream, cancel)
+		return
+	}
+}
+
+// candidates returns the indices of the endpoints in the order they should
+// be tried, healthy endpoints first.
+func (c *FailoverClient) candidates() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	start := c.current
+	if c.preferPrimary {
+		start = 0
+	}
+
+	now := time.Now()
+	var healthy, unhealthy []int
+	for n := 0; n < len(c.endpoints); n++ {
+		idx := (start + n) % len(c.endpoints)
+		if now.Before(c.endpoints[idx].unhealthyUntil) {
+			unhealthy = append(unhealthy, idx)
+			continue
+		}
+		healthy = append(healthy, idx)
+	}
+
+	return append(healthy, unhealthy...)
+}
+
+func (c *FailoverClient) markUnhealthy(idx int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := c.endpoints[idx]
+	e.unhealthyUntil = time.Now().Add(c.cooldown)
+	endpointErrCounter.WithLabelValues(e.Addr).Inc()
+}
+
+func (c *FailoverClient) activate(idx int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	endpointActiveGauge.WithLabelValues(c.endpoints[c.current].Addr).Set(0)
+	c.current = idx
+	endpointActiveGauge.WithLabelValues(c.endpoints[idx].Addr).Set(1)
+}
+
+// failoverStream is a stream to one of the endpoints that can be moved to
+// the primary endpoint.
+type failoverStream struct {
+	definitions.Egress_BoshMetricsClient
+	ctx    context.Context
+	client *FailoverClient
+
+	mu      sync.Mutex
+	idx     int
+	cancel  context.CancelFunc
+	pending definitions.Egress_BoshMetricsClient
+	// pendingCancel cancels the pending stream.
+	pendingCancel context.CancelFunc
+}
+
+// failback cancels the current stream so that Recv continues with the
+// stream to the primary endpoint.
+func (s *failoverStream) failback(stream definitions.Egress_BoshMetricsClient, cancel context.CancelFunc) {
+	s.mu.Lock()
+	s.pending, s.pendingCancel = stream, cancel
+	current := s.cancel
+	s.mu.Unlock()
+
+	current()
+}
+
+func (s *failoverStream) Recv() (*definitions.Event, error) {
+	for {
+		s.mu.Lock()
+		stream, idx := s.Egress_BoshMetricsClient, s.idx
+		s.mu.Unlock()
+
+		event, err := stream.Recv()
+		if err == nil {
+			return event, nil
+		}
+
+		s.mu.Lock()
+		pending := s.pending
+		if pending != nil {
+			s.Egress_BoshMetricsClient, s.idx, s.cancel = pending, 0, s.pendingCancel
+			s.pending, s.pendingCancel = nil, nil
+		}
+		s.mu.Unlock()
+		if pending != nil {
+			continue
+		}
+
+		if s.ctx.Err() == nil && status.Code(err) != codes.PermissionDenied {
+			s.client.markUnhealthy(idx)
+		}
+		return nil, err
+	}
+}
@@ -0,0 +1,200 @@
+package ingress_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/ingress"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestFailoverClientUsesFirstEndpoint(t *testing.T) {
+	RegisterTestingT(t)
+
+	primary := newSpyEgressClient(newSpyReceiver(), nil)
+	secondary := newSpyEgressClient(newSpyReceiver(), nil)
+	c := ingress.NewFailoverClient([]ingress.Endpoint{
+		{Addr: "primary:25595", Client: primary},
+		{Addr: "secondary:25595", Client: secondary},
+	})
+
+	_, err := c.BoshMetrics(context.Background(), &definitions.EgressRequest{})
+	Expect(err).ToNot(HaveOccurred())
+
+	Expect(primary.BoshMetricsCallCount()).To(Equal(int32(1)))
+	Expect(secondary.BoshMetricsCallCount()).To(Equal(int32(0)))
+}
+
+func TestFailoverClientFailsOverWhenEstablishingStreamFails(t *testing.T) {
+	RegisterTestingT(t)
+
+	primary := newSpyEgressClient(newSpyReceiver(), errors.New("unavailable"))
+	secondary := newSpyEgressClient(newSpyReceiver(), nil)
+	c := ingress.NewFailoverClient([]ingress.Endpoint{
+		{Addr: "primary:25595", Client: primary},
+		{Addr: "secondary:25595", Client: secondary},
+	})
+
+	_, err := c.BoshMetrics(context.Background(), &definitions.EgressRequest{})
+	Expect(err).ToNot(HaveOccurred())
+	_, err = c.BoshMetrics(context.Background(), &definitions.EgressRequest{})
+	Expect(err).ToNot(HaveOccurred())
+
+	Expect(primary.BoshMetricsCallCount()).To(Equal(int32(1)))
+	Expect(secondary.BoshMetricsCallCount()).To(Equal(int32(2)))
+}
+
+func TestFailoverClientFailsOverWhenStreamFails(t *testing.T) {
+	RegisterTestingT(t)
+
+	receiver := newSpyReceiver()
+	receiver.RecvError(errors.New("connection reset"))
+	primary := newSpyEgressClient(receiver, nil)
+	secondary := newSpyEgressClient(newSpyReceiver(), nil)
+	c := ingress.NewFailoverClient([]ingress.Endpoint{
+		{Addr: "primary:25595", Client: primary},
+		{Addr: "secondary:25595", Client: secondary},
+	})
+
+	stream, err := c.BoshMetrics(context.Background(), &definitions.EgressRequest{})
+	Expect(err).ToNot(HaveOccurred())
+	_, err = stream.Recv()
+	Expect(err).To(HaveOccurred())
+
+	_, err = c.BoshMetrics(context.Background(), &definitions.EgressRequest{})
+	Expect(err).ToNot(HaveOccurred())
+	Expect(secondary.BoshMetricsCallCount()).To(Equal(int32(1)))
+}
+
+func TestFailoverClientReturnsErrorWhenAllEndpointsFail(t *testing.T) {
+	RegisterTestingT(t)
+
+	primary := newSpyEgressClient(newSpyReceiver(), errors.New("unavailable"))
+	secondary := newSpyEgressClient(newSpyReceiver(), errors.New("unavailable"))
+	c := ingress.NewFailoverClient([]ingress.Endpoint{
+		{Addr: "primary:25595", Client: primary},
+		{Addr: "secondary:25595", Client: secondary},
+	})
+
+	_, err := c.BoshMetrics(context.Background(), &definitions.EgressRequest{})
+	Expect(err).To(HaveOccurred())
+
+	_, err = c.BoshMetrics(context.Background(), &definitions.EgressRequest{})
+	Expect(err).To(HaveOccurred())
+	Expect(primary.BoshMetricsCallCount()).To(Equal(int32(2)))
+	Expect(secondary.BoshMetricsCallCount()).To(Equal(int32(2)))
+}
+
+func TestFailoverClientDoesNotFailOverUponPermissionDenied(t *testing.T) {
+	RegisterTestingT(t)
+
+	primary := newSpyEgressClient(newSpyReceiver(), status.Error(codes.PermissionDenied, "some-error"))
+	secondary := newSpyEgressClient(newSpyReceiver(), nil)
+	c := ingress.NewFailoverClient([]ingress.Endpoint{
+		{Addr: "primary:25595", Client: primary},
+		{Addr: "secondary:25595", Client: secondary},
+	})
+
+	_, err := c.BoshMetrics(context.Background(), &definitions.EgressRequest{})
+	Expect(status.Code(err)).To(Equal(codes.PermissionDenied))
+	Expect(secondary.BoshMetricsCallCount()).To(Equal(int32(0)))
+}
+
+func TestFailoverClientStaysOnSecondaryWithoutPreferPrimary(t *testing.T) {
+	RegisterTestingT(t)
+
+	primary := newSpyEgressClient(newSpyReceiver(), errors.New("unavailable"))
+	secondary := newSpyEgressClient(newSpyReceiver(), nil)
+	c := ingress.NewFailoverClient([]ingress.Endpoint{
+		{Addr: "primary:25595", Client: primary},
+		{Addr: "secondary:25595", Client: secondary},
+	}, ingress.WithCooldown(time.Millisecond))
+
+	_, err := c.BoshMetrics(context.Background(), &definitions.EgressRequest{})
+	Expect(err).ToNot(HaveOccurred())
+
+	time.Sleep(10 * time.Millisecond)
+	_, err = c.BoshMetrics(context.Background(), &definitions.EgressRequest{})
+	Expect(err).ToNot(HaveOccurred())
+
+	Expect(primary.BoshMetricsCallCount()).To(Equal(int32(1)))
+	Expect(secondary.BoshMetricsCallCount()).To(Equal(int32(2)))
+}
+
+func TestFailoverClientMovesBackToPrimaryOnceRecovered(t *testing.T) {
+	RegisterTestingT(t)
+
+	primary := newSpyEgressClient(newSpyReceiver(), errors.New("unavailable"))
+	secondary := newSpyEgressClient(newSpyReceiver(), nil)
+	c := ingress.NewFailoverClient([]ingress.Endpoint{
+		{Addr: "primary:25595", Client: primary},
+		{Addr: "secondary:25595", Client: secondary},
+	}, ingress.WithPreferPrimary(), ingress.WithCooldown(time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err := c.BoshMetrics(ctx, &definitions.EgressRequest{})
+	Expect(err).ToNot(HaveOccurred())
+	Expect(secondary.BoshMetricsCallCount()).To(Equal(int32(1)))
+	cancel()
+
+	time.Sleep(10 * time.Millisecond)
+	_, err = c.BoshMetrics(context.Background(), &definitions.EgressRequest{})
+	Expect(err).ToNot(HaveOccurred())
+
+	Expect(primary.BoshMetricsCallCount()).To(BeNumerically(">=", 2))
+}
+
+func TestFailoverClientMovesEstablishedStreamBackToPrimary(t *testing.T) {
+	RegisterTestingT(t)
+
+	primary := newSpyEgressClient(newSpyReceiver(), errors.New("unavailable"))
+	secondary := newSpyEgressClient(nil, nil)
+	secondary.receiver = &idleReceiver{client: secondary}
+	c := ingress.NewFailoverClient([]ingress.Endpoint{
+		{Addr: "primary:25595", Client: primary},
+		{Addr: "secondary:25595", Client: secondary},
+	}, ingress.WithPreferPrimary(), ingress.WithCooldown(10*time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := c.BoshMetrics(ctx, &definitions.EgressRequest{})
+	Expect(err).ToNot(HaveOccurred())
+
+	received := make(chan error, 1)
+	go func() {
+		_, err := stream.Recv()
+		received <- err
+	}()
+	Consistently(received, "50ms").ShouldNot(Receive())
+
+	primary.SetErr(nil)
+
+	Eventually(received).Should(Receive(BeNil()))
+	Expect(secondary.LatestContext().Err()).To(HaveOccurred())
+	Expect(ctx.Err()).ToNot(HaveOccurred())
+}
+
+func TestFailoverClientStopsProbingPrimaryOnceStreamIsDone(t *testing.T) {
+	RegisterTestingT(t)
+
+	primary := newSpyEgressClient(newSpyReceiver(), errors.New("unavailable"))
+	secondary := newSpyEgressClient(newSpyReceiver(), nil)
+	c := ingress.NewFailoverClient([]ingress.Endpoint{
+		{Addr: "primary:25595", Client: primary},
+		{Addr: "secondary:25595", Client: secondary},
+	}, ingress.WithPreferPrimary(), ingress.WithCooldown(time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err := c.BoshMetrics(ctx, &definitions.EgressRequest{})
+	Expect(err).ToNot(HaveOccurred())
+	cancel()
+
+	time.Sleep(10 * time.Millisecond)
+	calls := primary.BoshMetricsCallCount()
+	Consistently(primary.BoshMetricsCallCount, "50ms").Should(Equal(calls))
+}
@@ -2,10 +2,12 @@ package ingress
 
 import (
 	"errors"
-	"log"
+	"fmt"
+	"log/slog"
 	"time"
 
 	"sync"
+	"sync/atomic"
 
 	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/definitions"
 	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/loggregator_v2"
@@ -17,31 +19,52 @@ import (
 )
 
 var (
-	connErrCounter = prometheus.NewCounter(prometheus.CounterOpts{
+	connErrCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Subsystem: "ingress",
 		Name:      "stream_conn_err",
 		Help:      "Tracks errors when a stream needs to be established",
-	})
-	receiveErrCounter = prometheus.NewCounter(prometheus.CounterOpts{
+	}, []string{"director"})
+	receiveErrCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Subsystem: "ingress",
 		Name:      "stream_receive_err",
 		Help:      "Tracks errors when receiving events from metrics server",
-	})
-	convertErrCounter = prometheus.NewCounter(prometheus.CounterOpts{
+	}, []string{"director"})
+	convertErrCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Subsystem: "ingress",
 		Name:      "stream_convert_err",
 		Help:      "Tracks errors when converting an event to an envelope",
-	})
-	receivedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+	}, []string{"director"})
+	receivedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Subsystem: "ingress",
 		Name:      "received",
 		Help:      "Tracks total number of events received",
-	})
-	droppedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+	}, []string{"director"})
+	droppedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Subsystem: "ingress",
 		Name:      "dropped",
 		Help:      "Tracks the number of envelopes dropped if unable to queue the msg",
-	})
+	}, []string{"director"})
+	connectedGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "ingress",
+		Name:      "stream_connected",
+		Help:      "Whether a stream to the metrics server is currently established",
+	}, []string{"director"})
+	idleCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "ingress",
+		Name:      "stream_idle",
+		Help:      "Tracks the number of streams closed because no event was received within the idle timeout",
+	}, []string{"director"})
+	lifetimeHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Subsystem: "ingress",
+		Name:      "stream_lifetime_seconds",
+		Help:      "How long streams to the metrics server stayed established",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 10),
+	}, []string{"director"})
+	pausedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "ingress",
+		Name:      "paused_discarded",
+		Help:      "Tracks the number of events discarded while forwarding is paused",
+	}, []string{"director"})
 )
 
 func init() {
@@ -50,6 +73,10 @@ func init() {
 	prometheus.MustRegister(convertErrCounter)
 	prometheus.MustRegister(receivedCounter)
 	prometheus.MustRegister(droppedCounter)
+	prometheus.MustRegister(connectedGauge)
+	prometheus.MustRegister(idleCounter)
+	prometheus.MustRegister(lifetimeHistogram)
+	prometheus.MustRegister(pausedCounter)
 }
 
 type receiver interface {
@@ -66,18 +93,52 @@ type tokener interface {
 
 type mapper func(event *definitions.Event) (*loggregator_v2.Envelope, error)
 
+type eventFilter interface {
+	Filter(event *definitions.Event) (*definitions.Event, bool)
+}
+
+type eventObserver interface {
+	Observe(event *definitions.Event)
+}
+
+type pauser interface {
+	Paused() bool
+}
+
+const (
+	stateConnecting = "connecting"
+	stateConnected  = "connected"
+	stateStopped    = "stopped"
+)
+
+// StreamStatus is the state of the stream to the metrics server.
+type StreamStatus struct {
+	Director  string    `json:"director"`
+	State     string    `json:"state"`
+	Since     time.Time `json:"since"`
+	Streams   int       `json:"streams"`
+	LastEvent time.Time `json:"last_event"`
+}
+
 type Ingress struct {
 	auth           tokener
 	convert        mapper
 	messages       chan *loggregator_v2.Envelope
 	client         definitions.EgressClient
 	reconnectWait  time.Duration
-	streamTimeout  time.Duration
+	idleTimeout    time.Duration
 	subscriptionID string
-	logger         *log.Logger
-
-	mu                  sync.Mutex
-	metricsServerCancel context.CancelFunc
+	director       string
+	filters        []eventFilter
+	limiters       []eventFilter
+	preObservers   []eventObserver
+	observers      []eventObserver
+	pauser         pauser
+	logger         *slog.Logger
+
+	statusMu  sync.Mutex
+	status    StreamStatus
+	lastEvent atomic.Int64
 }
 
 type IngressOpt func(*Ingress)
@@ -88,9 +149,60 @@ func WithReconnectWait(d time.Duration) IngressOpt {
 	}
 }
 
-func WithStreamTimeout(d time.Duration) IngressOpt {
+// WithIdleTimeout sets how long a stream may go without receiving an
+// event before it is closed and reestablished.
+func WithIdleTimeout(d time.Duration) IngressOpt {
+	return func(i *Ingress) {
+		i.idleTimeout = d
+	}
+}
+
+// WithDirector sets the name of the director the Ingress consumes from.
+// The name is used to label the ingress metrics.
+func WithDirector(name string) IngressOpt {
 	return func(i *Ingress) {
-		i.streamTimeout = d
+		i.director = name
+	}
+}
+
+// WithFilter adds a filter that is applied to every event before it is
+// converted and queued. Filters are applied in the order they are added and
+// may return a modified event, or false to drop the event.
+func WithFilter(f eventFilter) IngressOpt {
+	return func(i *Ingress) {
+		i.filters = append(i.filters, f)
+	}
+}
+
+// WithLimiter adds a filter that is applied after the filters, once the
+// observers added with WithPreLimitObserver were notified of the event.
+func WithLimiter(f eventFilter) IngressOpt {
+	return func(i *Ingress) {
+		i.limiters = append(i.limiters, f)
+	}
+}
+
+// WithObserver adds an observer that is notified of every event that
+// passed the filters and limiters.
+func WithObserver(o eventObserver) IngressOpt {
+	return func(i *Ingress) {
+		i.observers = append(i.observers, o)
+	}
+}
+
+// WithPreLimitObserver adds an observer that is notified of every event
+// that passed the filters, including the events dropped by the limiters.
+func WithPreLimitObserver(o eventObserver) IngressOpt {
+	return func(i *Ingress) {
+		i.preObservers = append(i.preObservers, o)
+	}
+}
+
+// WithPauser makes the Ingress discard the events it receives while p is
+// paused. The stream stays established so forwarding resumes immediately.
+func WithPauser(p pauser) IngressOpt {
+	return func(i *Ingress) {
+		i.pauser = p
 	}
 }
 
@@ -101,144 +213,234 @@ func New(
 	messages chan *loggregator_v2.Envelope,
 	auth tokener,
 	sID string,
-	l *log.Logger,
+	l *slog.Logger,
 	opts ...IngressOpt,
 ) *Ingress {
 	i := &Ingress{
-		client:              s,
-		convert:             m,
-		messages:            messages,
-		auth:                auth,
-		subscriptionID:      sID,
-		logger:              l,
-		metricsServerCancel: func() {},
-		reconnectWait:       time.Second,
-		streamTimeout:       45 * time.Second,
+		client:         s,
+		convert:        m,
+		messages:       messages,
+		auth:           auth,
+		subscriptionID: sID,
+		logger:         l,
+		reconnectWait:  time.Second,
+		idleTimeout:    2 * time.Minute,
 	}
 
 	for _, o := range opts {
 		o(i)
 	}
+	i.status = StreamStatus{Director: i.director, State: stateStopped}
 
 	return i
 }
 
-// Start spins a new go routine that establishes a connection to
-// the Bosh System metrics Server.
-// It returns a shutdown function that blocks until the grpc stream client
-// has been successfully closed.
-func (i *Ingress) Start() func() {
-	i.logger.Println("Starting ingestor...")
-	done := make(chan struct{})
-	stop := make(chan struct{})
-
-	go func() {
-		defer close(done)
+// Status returns the state of the stream to the metrics server.
+func (i *Ingress) Status() StreamStatus {
+	i.statusMu.Lock()
+	defer i.statusMu.Unlock()
 
-		token, err := i.auth.Token()
-		if err != nil {
-			i.logger.Fatalf("unable to get token: %s", err)
-		}
-		for {
-			select {
-			case <-stop:
-				return
-			default:
-			}
-
-			metricsStreamClient, err := i.establishStream(token)
-			if err != nil {
-				newToken, tokenWasFetched := i.checkPermissionDeniedError(err)
+	s := i.status
+	if t := i.lastEvent.Load(); t != 0 {
+		s.LastEvent = time.Unix(0, t)
+	}
 
-				if tokenWasFetched {
-					token = newToken
-				}
+	return s
+}
 
-				connErrCounter.Inc()
-				i.logger.Printf("error creating stream connection to metrics server: %s\n", err)
-				time.Sleep(i.reconnectWait)
-				continue
-			}
+func (i *Ingress) setState(state string) {
+	i.statusMu.Lock()
+	defer i.statusMu.Unlock()
 
-			err = i.processMessages(metricsStreamClient)
-			if err != nil {
-				newToken, tokenWasFetched := i.checkPermissionDeniedError(err)
+	if i.status.State == state {
+		return
+	}
+	i.status.State = state
+	i.status.Since = time.Now()
+	if state == stateConnected {
+		i.status.Streams++
+	}
+}
 
-				if tokenWasFetched {
-					token = newToken
-				}
+// Run establishes a stream to the Bosh System Metrics Server and
+// forwards its events until ctx is done. Streams that fail are
+// reestablished.
+// It returns nil once ctx is done, or an error if no token can be
+// retrieved.
+func (i *Ingress) Run(ctx context.Context) error {
+	i.logger.Info("starting ingestor")
+	defer i.logger.Info("closing connection to metrics server")
+	defer i.setState(stateStopped)
+	i.setState(stateConnecting)
+
+	token, err := i.auth.Token()
+	if err != nil {
+		return fmt.Errorf("unable to get token: %w", err)
+	}
 
-				if !errors.Is(err, context.DeadlineExceeded) {
-					receiveErrCounter.Inc()
-					i.logger.Printf("error receiving from metrics server: %s\n", err)
-				}
-				time.Sleep(i.reconnectWait)
+	var attempt, stream int
+	for ctx.Err() == nil {
+		metricsStreamClient, cancel, err := i.establishStream(ctx, token)
+		if err != nil {
+			cancel()
+			var refreshErr error
+			token, refreshErr = i.refreshTokenUponPermissionDenied(err, token)
+			if refreshErr != nil {
+				return refreshErr
 			}
-		}
-	}()
 
-	return func() {
-		i.logger.Println("closing connection to metrics server")
+			attempt++
+			connErrCounter.WithLabelValues(i.director).Inc()
+			i.logger.Error("error creating stream connection to metrics server", "error", err, "attempt", attempt)
+			sleep(ctx, i.reconnectWait)
+			continue
+		}
+		attempt = 0
+		stream++
+
+		connectedGauge.WithLabelValues(i.director).Set(1)
+		i.setState(stateConnected)
+		established := time.Now()
+		err = i.processMessages(metricsStreamClient, cancel)
+		cancel()
+		lifetimeHistogram.WithLabelValues(i.director).Observe(time.Since(established).Seconds())
+		connectedGauge.WithLabelValues(i.director).Set(0)
+		i.setState(stateConnecting)
+		if ctx.Err() != nil {
+			break
+		}
 
-		i.mu.Lock()
-		defer i.mu.Unlock()
+		var refreshErr error
+		token, refreshErr = i.refreshTokenUponPermissionDenied(err, token)
+		if refreshErr != nil {
+			return refreshErr
+		}
 
-		close(stop)
-		i.metricsServerCancel()
-		<-done
+		if errors.Is(err, errIdle) {
+			idleCounter.WithLabelValues(i.director).Inc()
+			i.logger.Warn("no events received from metrics server, reconnecting", "idle_timeout", i.idleTimeout, "stream", stream)
+		} else {
+			receiveErrCounter.WithLabelValues(i.director).Inc()
+			i.logger.Error("error receiving from metrics server", "error", err, "stream", stream)
+		}
+		sleep(ctx, i.reconnectWait)
 	}
+
+	return nil
 }
 
-func (i *Ingress) checkPermissionDeniedError(sourceError error) (newToken string, tokenWasFetched bool) {
-	s, ok := status.FromError(sourceError)
-	if ok && s.Code() == codes.PermissionDenied {
-		i.logger.Printf("authorization failure, retrieving token: %s\n", sourceError)
-		token, err := i.auth.Token()
-		if err != nil {
-			i.logger.Fatalf("unable to refresh token: %s", err)
-		}
+// refreshTokenUponPermissionDenied returns a new token if the stream
+// failed with a permission denied error and the current token otherwise.
+// It returns an error if no new token can be retrieved.
+func (i *Ingress) refreshTokenUponPermissionDenied(streamErr error, token string) (string, error) {
+	s, ok := status.FromError(streamErr)
+	if !ok || s.Code() != codes.PermissionDenied {
+		return token, nil
+	}
 
-		return token, true
+	i.logger.Warn("authorization failure, retrieving token", "error", streamErr)
+	token, err := i.auth.Token()
+	if err != nil {
+		return "", fmt.Errorf("unable to refresh token: %w", err)
 	}
 
-	return "", false
+	return token, nil
 }
 
-func (i *Ingress) processMessages(client definitions.Egress_BoshMetricsClient) error {
+var errIdle = errors.New("stream idle")
+
+// processMessages receives events until the stream fails. The stream is
+// cancelled when no event is received within the idle timeout.
+func (i *Ingress) processMessages(client definitions.Egress_BoshMetricsClient, cancel context.CancelFunc) error {
+	var idle atomic.Bool
+	watchdog := time.AfterFunc(i.idleTimeout, func() {
+		idle.Store(true)
+		cancel()
+	})
+	defer watchdog.Stop()
+
 	for {
 		event, err := client.Recv()
 		if err != nil {
+			if idle.Load() {
+				return errIdle
+			}
 			return err
 		}
-		receivedCounter.Inc()
+		watchdog.Reset(i.idleTimeout)
+		receivedCounter.WithLabelValues(i.director).Inc()
+		i.lastEvent.Store(time.Now().UnixNano())
+
+		if i.pauser != nil && i.pauser.Paused() {
+			pausedCounter.WithLabelValues(i.director).Inc()
+			continue
+		}
+
+		event, ok := filter(i.filters, event)
+		if !ok {
+			continue
+		}
+
+		for _, o := range i.preObservers {
+			o.Observe(event)
+		}
+
+		event, ok = filter(i.limiters, event)
+		if !ok {
+			continue
+		}
+
+		for _, o := range i.observers {
+			o.Observe(event)
+		}
 
 		envelope, err := i.convert(event)
 		if err != nil {
-			convertErrCounter.Inc()
+			convertErrCounter.WithLabelValues(i.director).Inc()
 			continue
 		}
 
 		select {
 		case i.messages <- envelope:
 		default:
-			droppedCounter.Inc()
+			droppedCounter.WithLabelValues(i.director).Inc()
 		}
 	}
 }
 
-func (i *Ingress) establishStream(token string) (definitions.Egress_BoshMetricsClient, error) {
-	md := metadata.Pairs("authorization", token)
-	ctx := metadata.NewOutgoingContext(context.Background(), md)
-	metricsServerCtx, metricsServerCancel := context.WithTimeout(ctx, i.streamTimeout)
+func filter(filters []eventFilter, event *definitions.Event) (*definitions.Event, bool) {
+	for _, f := range filters {
+		var ok bool
+		event, ok = f.Filter(event)
+		if !ok {
+			return nil, false
+		}
+	}
 
-	i.mu.Lock()
-	defer i.mu.Unlock()
-	i.metricsServerCancel = metricsServerCancel
+	return event, true
+}
+
+func (i *Ingress) establishStream(ctx context.Context, token string) (definitions.Egress_BoshMetricsClient, context.CancelFunc, error) {
+	md := metadata.Pairs("authorization", token)
+	ctx, cancel := context.WithCancel(metadata.NewOutgoingContext(ctx, md))
 
-	return i.client.BoshMetrics(
-		metricsServerCtx,
+	client, err := i.client.BoshMetrics(
+		ctx,
 		&definitions.EgressRequest{
 			SubscriptionId: i.subscriptionID,
 		},
 	)
+
+	return client, cancel, err
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
 }
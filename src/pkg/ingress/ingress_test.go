@@ -7,14 +7,14 @@ import (
 	"testing"
 
 	"errors"
-	"io/ioutil"
-	"log"
+	"log/slog"
 	"sync"
 
 	"time"
 
 	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/definitions"
 	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/ingress"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/logging"
 	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/loggregator_v2"
 	. "github.com/onsi/gomega"
 	"golang.org/x/net/context"
@@ -24,7 +24,7 @@ import (
 	"google.golang.org/grpc/status"
 )
 
-func TestStartProcessesEvents(t *testing.T) {
+func TestRunProcessesEvents(t *testing.T) {
 	RegisterTestingT(t)
 
 	receiver := newSpyReceiver()
@@ -34,12 +34,12 @@ func TestStartProcessesEvents(t *testing.T) {
 	tokener := newSpyTokener()
 
 	i := ingress.New(client, mapper.F, messages, tokener, "sub-id", logger)
-	i.Start()
+	run(t, i)
 
 	Eventually(messages).Should(Receive(Equal(envelope)))
 }
 
-func TestStartRetriesUponReceiveError(t *testing.T) {
+func TestRunRetriesUponReceiveError(t *testing.T) {
 	RegisterTestingT(t)
 
 	receiver := newSpyReceiver()
@@ -50,7 +50,7 @@ func TestStartRetriesUponReceiveError(t *testing.T) {
 	tokener := newSpyTokener()
 
 	i := ingress.New(client, mapper.F, messages, tokener, "sub-id", logger, ingress.WithReconnectWait(time.Millisecond))
-	i.Start()
+	run(t, i)
 
 	Eventually(client.BoshMetricsCallCount).Should(BeNumerically(">", 1))
 
@@ -59,31 +59,50 @@ func TestStartRetriesUponReceiveError(t *testing.T) {
 	Eventually(messages).Should(Receive(Equal(envelope)))
 }
 
-func TestLogOutputWhenReconnectingAfterTimeout(t *testing.T) {
+func TestReconnectsWhenStreamIsIdle(t *testing.T) {
 	RegisterTestingT(t)
-	var buf bytes.Buffer
-	spyLogger := log.New(&buf, "", log.LstdFlags)
+	var buf syncBuffer
+	spyLogger := slog.New(slog.NewTextHandler(&buf, nil))
 
-	receiver := newSpyReceiver()
-	receiver.RecvError(context.DeadlineExceeded)
-	client := newSpyEgressClient(receiver, nil)
+	client := newSpyEgressClient(nil, nil)
+	client.receiver = &idleReceiver{client: client}
 	mapper := newSpyMapper(envelope, nil)
 	messages := make(chan *loggregator_v2.Envelope, 1)
 	tokener := newSpyTokener()
 
-	i := ingress.New(client, mapper.F, messages, tokener, "sub-id", spyLogger, ingress.WithReconnectWait(time.Millisecond))
-	i.Start()
+	i := ingress.New(
+		client, mapper.F, messages, tokener, "sub-id", spyLogger,
+		ingress.WithReconnectWait(time.Millisecond),
+		ingress.WithIdleTimeout(10*time.Millisecond),
+	)
+	run(t, i)
 
 	Eventually(client.BoshMetricsCallCount).Should(BeNumerically(">", 1))
+	Expect(buf.String()).To(ContainSubstring(`msg="no events received from metrics server, reconnecting" idle_timeout=10ms`))
+	Expect(buf.String()).ToNot(ContainSubstring("error receiving from metrics server"))
+}
 
-	receiver.RecvError(nil)
+func TestKeepsStreamOpenWhileEventsArrive(t *testing.T) {
+	RegisterTestingT(t)
 
-	Eventually(messages).Should(Receive(Equal(envelope)))
-	Expect(buf.String()).To(ContainSubstring("Starting ingestor..."))
-	Expect(buf.String()).ToNot(ContainSubstring("error receiving from metrics server"))
+	receiver := newSpyReceiver()
+	client := newSpyEgressClient(receiver, nil)
+	mapper := newSpyMapper(envelope, nil)
+	messages := make(chan *loggregator_v2.Envelope, 1)
+	tokener := newSpyTokener()
+
+	i := ingress.New(
+		client, mapper.F, messages, tokener, "sub-id", logger,
+		ingress.WithReconnectWait(time.Millisecond),
+		ingress.WithIdleTimeout(50*time.Millisecond),
+	)
+	run(t, i)
+
+	Eventually(client.BoshMetricsCallCount).Should(Equal(int32(1)))
+	Consistently(client.BoshMetricsCallCount, 200*time.Millisecond).Should(Equal(int32(1)))
 }
 
-func TestStartGetsToken(t *testing.T) {
+func TestRunGetsToken(t *testing.T) {
 	RegisterTestingT(t)
 
 	receiver := newSpyReceiver()
@@ -93,7 +112,7 @@ func TestStartGetsToken(t *testing.T) {
 	tokener := newSpyTokener()
 
 	i := ingress.New(client, mapper.F, messages, tokener, "sub-id", logger, ingress.WithReconnectWait(time.Millisecond))
-	i.Start()
+	run(t, i)
 
 	Eventually(tokener.TokenCallCount).Should(Equal(int32(1)))
 	Eventually(client.BoshMetricsCallCount).Should(Equal(int32(1)))
@@ -115,7 +134,7 @@ func TestEstablishStreamRefreshesTokenUponPermissionDeniedError(t *testing.T) {
 	tokener := newSpyTokener()
 
 	i := ingress.New(client, mapper.F, messages, tokener, "sub-id", logger, ingress.WithReconnectWait(time.Millisecond))
-	i.Start()
+	run(t, i)
 
 	Eventually(tokener.TokenCallCount).Should(BeNumerically(">", 1))
 	Eventually(client.BoshMetricsCallCount, "2s").Should(BeNumerically(">", 1))
@@ -136,7 +155,7 @@ func TestProcessMessagesRefreshesTokenUponPermissionDeniedError(t *testing.T) {
 	tokener := newSpyTokener()
 
 	i := ingress.New(client, mapper.F, messages, tokener, "sub-id", logger, ingress.WithReconnectWait(time.Millisecond))
-	i.Start()
+	run(t, i)
 
 	Eventually(tokener.TokenCallCount).Should(BeNumerically(">", 1))
 	Eventually(client.BoshMetricsCallCount, "2s").Should(BeNumerically(">", 1))
@@ -146,7 +165,7 @@ func TestProcessMessagesRefreshesTokenUponPermissionDeniedError(t *testing.T) {
 	Expect(md["authorization"][0]).ToNot(Equal("token0"))
 }
 
-func TestStartContinuesUponConversionError(t *testing.T) {
+func TestRunContinuesUponConversionError(t *testing.T) {
 	RegisterTestingT(t)
 
 	receiver := newSpyReceiver()
@@ -156,7 +175,7 @@ func TestStartContinuesUponConversionError(t *testing.T) {
 	tokener := newSpyTokener()
 
 	i := ingress.New(client, mapper.F, messages, tokener, "sub-id", logger, ingress.WithReconnectWait(time.Millisecond))
-	i.Start()
+	run(t, i)
 
 	Consistently(messages).ShouldNot(Receive())
 
@@ -165,7 +184,7 @@ func TestStartContinuesUponConversionError(t *testing.T) {
 	Eventually(messages).Should(Receive(Equal(envelope)))
 }
 
-func TestStartDoesNotBlockSendingEnvelopes(t *testing.T) {
+func TestRunDoesNotBlockSendingEnvelopes(t *testing.T) {
 	RegisterTestingT(t)
 
 	receiver := newSpyReceiver()
@@ -175,12 +194,12 @@ func TestStartDoesNotBlockSendingEnvelopes(t *testing.T) {
 	tokener := newSpyTokener()
 
 	i := ingress.New(client, mapper.F, messages, tokener, "sub-id", logger, ingress.WithReconnectWait(time.Millisecond))
-	i.Start()
+	run(t, i)
 
 	Eventually(receiver.RecvCallCount).Should(BeNumerically(">", 3))
 }
 
-func TestStartDoesNotReconnectAfterStopping(t *testing.T) {
+func TestRunDoesNotReconnectAfterStopping(t *testing.T) {
 	RegisterTestingT(t)
 
 	receiver := newSpyReceiver()
@@ -191,15 +210,219 @@ func TestStartDoesNotReconnectAfterStopping(t *testing.T) {
 	tokener := newSpyTokener()
 
 	i := ingress.New(client, mapper.F, messages, tokener, "sub-id", logger, ingress.WithReconnectWait(250*time.Millisecond))
-	stop := i.Start()
+	stop, done := run(t, i)
 
 	Eventually(client.BoshMetricsCallCount).Should(Equal(int32(1)))
 
 	stop()
 
+	Eventually(done).Should(Receive(BeNil()))
 	Consistently(client.BoshMetricsCallCount).Should(Equal(int32(1)))
 }
 
+func TestRunDropsFilteredEvents(t *testing.T) {
+	RegisterTestingT(t)
+
+	receiver := newSpyReceiver()
+	client := newSpyEgressClient(receiver, nil)
+	mapper := newSpyMapper(envelope, nil)
+	messages := make(chan *loggregator_v2.Envelope, 1)
+	tokener := newSpyTokener()
+	filter := newSpyFilter(false)
+
+	i := ingress.New(client, mapper.F, messages, tokener, "sub-id", logger, ingress.WithFilter(filter))
+	run(t, i)
+
+	Eventually(filter.FilterCallCount).Should(BeNumerically(">", 0))
+	Consistently(messages).ShouldNot(Receive())
+
+	filter.Allow(true)
+
+	Eventually(messages).Should(Receive(Equal(envelope)))
+}
+
+func TestRunNotifiesObservers(t *testing.T) {
+	RegisterTestingT(t)
+
+	receiver := newSpyReceiver()
+	client := newSpyEgressClient(receiver, nil)
+	mapper := newSpyMapper(envelope, nil)
+	messages := make(chan *loggregator_v2.Envelope, 1)
+	tokener := newSpyTokener()
+	observer := &spyObserver{}
+
+	i := ingress.New(client, mapper.F, messages, tokener, "sub-id", logger, ingress.WithObserver(observer))
+	run(t, i)
+
+	Eventually(observer.ObserveCallCount).Should(BeNumerically(">", 0))
+}
+
+func TestRunNotifiesPreLimitObserversOfLimitedEvents(t *testing.T) {
+	RegisterTestingT(t)
+
+	receiver := newSpyReceiver()
+	client := newSpyEgressClient(receiver, nil)
+	mapper := newSpyMapper(envelope, nil)
+	messages := make(chan *loggregator_v2.Envelope, 1)
+	tokener := newSpyTokener()
+	preObserver := &spyObserver{}
+	observer := &spyObserver{}
+
+	i := ingress.New(client, mapper.F, messages, tokener, "sub-id", logger,
+		ingress.WithLimiter(newSpyFilter(false)),
+		ingress.WithPreLimitObserver(preObserver),
+		ingress.WithObserver(observer),
+	)
+	run(t, i)
+
+	Eventually(preObserver.ObserveCallCount).Should(BeNumerically(">", 0))
+	Consistently(messages).ShouldNot(Receive())
+	Expect(observer.ObserveCallCount()).To(BeZero())
+}
+
+func TestRunDiscardsEventsWhilePaused(t *testing.T) {
+	RegisterTestingT(t)
+
+	receiver := newSpyReceiver()
+	client := newSpyEgressClient(receiver, nil)
+	mapper := newSpyMapper(envelope, nil)
+	messages := make(chan *loggregator_v2.Envelope, 1)
+	tokener := newSpyTokener()
+	pauser := &spyPauser{}
+	pauser.paused.Store(true)
+
+	i := ingress.New(client, mapper.F, messages, tokener, "sub-id", logger, ingress.WithPauser(pauser))
+	run(t, i)
+
+	Eventually(receiver.RecvCallCount).Should(BeNumerically(">", 1))
+	Consistently(messages).ShouldNot(Receive())
+	Expect(client.BoshMetricsCallCount()).To(Equal(int32(1)))
+
+	pauser.paused.Store(false)
+
+	Eventually(messages).Should(Receive(Equal(envelope)))
+}
+
+func TestStatusReportsStream(t *testing.T) {
+	RegisterTestingT(t)
+
+	receiver := newSpyReceiver()
+	client := newSpyEgressClient(receiver, nil)
+	mapper := newSpyMapper(envelope, nil)
+	messages := make(chan *loggregator_v2.Envelope, 1)
+	tokener := newSpyTokener()
+
+	i := ingress.New(client, mapper.F, messages, tokener, "sub-id", logger, ingress.WithDirector("director-1"))
+	Expect(i.Status().State).To(Equal("stopped"))
+
+	run(t, i)
+
+	Eventually(func() string { return i.Status().State }).Should(Equal("connected"))
+	status := i.Status()
+	Expect(status.Director).To(Equal("director-1"))
+	Expect(status.Streams).To(Equal(1))
+	Eventually(func() time.Time { return i.Status().LastEvent }).ShouldNot(BeZero())
+}
+
+func TestRunReturnsTokenError(t *testing.T) {
+	RegisterTestingT(t)
+
+	client := newSpyEgressClient(newSpyReceiver(), nil)
+	mapper := newSpyMapper(envelope, nil)
+	messages := make(chan *loggregator_v2.Envelope, 1)
+	tokener := newSpyTokener(WithError("uaa is down"))
+
+	i := ingress.New(client, mapper.F, messages, tokener, "sub-id", logger)
+	_, done := run(t, i)
+
+	Eventually(done).Should(Receive(MatchError(ContainSubstring("uaa is down"))))
+	Expect(client.BoshMetricsCallCount()).To(Equal(int32(0)))
+	Expect(i.Status().State).To(Equal("stopped"))
+}
+
+func TestRunReturnsWhenContextIsDone(t *testing.T) {
+	RegisterTestingT(t)
+
+	client := newSpyEgressClient(nil, nil)
+	client.receiver = &idleReceiver{client: client}
+	mapper := newSpyMapper(envelope, nil)
+	messages := make(chan *loggregator_v2.Envelope, 1)
+	tokener := newSpyTokener()
+
+	i := ingress.New(client, mapper.F, messages, tokener, "sub-id", logger)
+	stop, done := run(t, i)
+
+	Eventually(func() string { return i.Status().State }).Should(Equal("connected"))
+
+	stop()
+
+	Eventually(done).Should(Receive(BeNil()))
+	Expect(i.Status().State).To(Equal("stopped"))
+}
+
+// run runs i until the test ends. It returns a function stopping the run
+// early and a channel receiving the result of the run.
+func run(t *testing.T, i *ingress.Ingress) (context.CancelFunc, <-chan error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- i.Run(ctx)
+	}()
+
+	return cancel, done
+}
+
+type spyPauser struct {
+	paused atomic.Bool
+}
+
+func (p *spyPauser) Paused() bool {
+	return p.paused.Load()
+}
+
+type spyObserver struct {
+	observeCallCount int32
+}
+
+func (o *spyObserver) Observe(event *definitions.Event) {
+	atomic.AddInt32(&o.observeCallCount, 1)
+}
+
+func (o *spyObserver) ObserveCallCount() int32 {
+	return atomic.LoadInt32(&o.observeCallCount)
+}
+
+type spyFilter struct {
+	mu              sync.Mutex
+	allow           bool
+	filterCallCount int32
+}
+
+func newSpyFilter(allow bool) *spyFilter {
+	return &spyFilter{
+		allow: allow,
+	}
+}
+
+func (f *spyFilter) Allow(allow bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.allow = allow
+}
+
+func (f *spyFilter) Filter(event *definitions.Event) (*definitions.Event, bool) {
+	atomic.AddInt32(&f.filterCallCount, 1)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return event, f.allow
+}
+
+func (f *spyFilter) FilterCallCount() int32 {
+	return atomic.LoadInt32(&f.filterCallCount)
+}
+
 type spyEgressClient struct {
 	boshMetricsCallCount int32
 	receiver             definitions.Egress_BoshMetricsClient
@@ -224,6 +447,12 @@ func (c *spyEgressClient) BoshMetrics(ctx context.Context, r *definitions.Egress
 	return c.receiver, c.err
 }
 
+func (c *spyEgressClient) SetErr(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = err
+}
+
 func (c *spyEgressClient) LatestContext() context.Context {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -266,6 +495,35 @@ func (r *spyReceiver) RecvCallCount() int32 {
 	return atomic.LoadInt32(&r.recvCallCount)
 }
 
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// idleReceiver never receives an event and fails once the stream is
+// cancelled.
+type idleReceiver struct {
+	client *spyEgressClient
+	grpc.ClientStream
+}
+
+func (r *idleReceiver) Recv() (*definitions.Event, error) {
+	<-r.client.LatestContext().Done()
+	return nil, status.Error(codes.Canceled, "context canceled")
+}
+
 type spyMapper struct {
 	mu           sync.Mutex
 	convertError error
@@ -317,14 +575,14 @@ func newSpyTokener(opts ...spyTokenOpt) *spyTokener {
 func (t *spyTokener) Token() (string, error) {
 	token := fmt.Sprintf("token%d", atomic.LoadInt32(&t.tokenCallCount))
 	atomic.AddInt32(&t.tokenCallCount, 1)
-	return token, nil
+	return token, t.err
 }
 
 func (t *spyTokener) TokenCallCount() int32 {
 	return atomic.LoadInt32(&t.tokenCallCount)
 }
 
-var logger = log.New(ioutil.Discard, "", log.LstdFlags)
+var logger = logging.Discard()
 
 var envelope = &loggregator_v2.Envelope{
 	Timestamp: 1499293724,
@@ -0,0 +1,315 @@
+package liveness
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/enrichment"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/loggregator_v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var droppedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+	Subsystem: "liveness",
+	Name:      "dropped",
+	Help:      "Tracks the number of liveness envelopes dropped if unable to queue the msg",
+})
+
+func init() {
+	prometheus.MustRegister(droppedCounter)
+}
+
+const missingMetric = "instance.heartbeat_missing"
+
+type instanceLister interface {
+	Refresh() error
+	Instance(id string) (enrichment.Instance, bool)
+}
+
+type instanceKey struct {
+	deployment string
+	id         string
+}
+
+type instance struct {
+	job      string
+	lastSeen time.Time
+	missing  bool
+}
+
+// Tracker tracks the heartbeats of every instance and reports instances
+// that stop sending heartbeats.
+// An instance is missing once no heartbeat has been received for the
+// configured number of heartbeat intervals. While it is missing a
+// heartbeat_missing gauge of 1 is emitted, and an event is emitted when it
+// goes missing and when its heartbeats resume.
+type Tracker struct {
+	messages    chan<- *loggregator_v2.Envelope
+	interval    time.Duration
+	missed      int
+	forgetAfter time.Duration
+	tags        map[string]string
+	lister      instanceLister
+	now         func() time.Time
+
+	mu        sync.Mutex
+	instances map[instanceKey]*instance
+	lastEvent time.Time
+}
+
+type TrackerOpt func(*Tracker)
+
+// WithHeartbeatInterval sets the interval at which instances are expected
+// to send heartbeats.
+func WithHeartbeatInterval(d time.Duration) TrackerOpt {
+	return func(t *Tracker) {
+		t.interval = d
+	}
+}
+
+// WithMissedIntervals sets how many heartbeat intervals may pass without a
+// heartbeat before an instance is missing.
+func WithMissedIntervals(n int) TrackerOpt {
+	return func(t *Tracker) {
+		t.missed = n
+	}
+}
+
+// WithForgetAfter sets how long an instance is tracked after its last
+// heartbeat.
+func WithForgetAfter(d time.Duration) TrackerOpt {
+	return func(t *Tracker) {
+		t.forgetAfter = d
+	}
+}
+
+// WithTags adds the given tags to every envelope.
+func WithTags(tags map[string]string) TrackerOpt {
+	return func(t *Tracker) {
+		for k, v := range tags {
+			t.tags[k] = v
+		}
+	}
+}
+
+// WithInstanceLister sets where the instances known to the director are
+// looked up. Instances the director no longer knows about are forgotten
+// instead of being reported missing, so instances deleted by a deploy do
+// not raise false alarms.
+func WithInstanceLister(l instanceLister) TrackerOpt {
+	return func(t *Tracker) {
+		t.lister = l
+	}
+}
+
+// WithClock sets the function used to tell the current time.
+func WithClock(now func() time.Time) TrackerOpt {
+	return func(t *Tracker) {
+		t.now = now
+	}
+}
+
+// New returns a new Tracker that writes envelopes to messages.
+func New(messages chan<- *loggregator_v2.Envelope, opts ...TrackerOpt) *Tracker {
+	t := &Tracker{
+		messages:    messages,
+		interval:    30 * time.Second,
+		missed:      3,
+		forgetAfter: time.Hour,
+		tags:        make(map[string]string),
+		now:         time.Now,
+		instances:   make(map[instanceKey]*instance),
+	}
+
+	for _, o := range opts {
+		o(t)
+	}
+
+	return t
+}
+
+// Observe records the heartbeat of an instance. If the instance was
+// missing its heartbeats are reported to have resumed.
+func (t *Tracker) Observe(event *definitions.Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	t.lastEvent = now
+
+	hb := event.GetHeartbeat()
+	if hb == nil {
+		return
+	}
+
+	k := instanceKey{deployment: event.GetDeployment(), id: hb.GetInstanceId()}
+	i, ok := t.instances[k]
+	if !ok {
+		i = &instance{}
+		t.instances[k] = i
+	}
+	i.job = hb.GetJob()
+	i.lastSeen = now
+
+	if i.missing {
+		i.missing = false
+		t.send(
+			t.event(k, i, "instance heartbeat resumed", fmt.Sprintf("heartbeats from %s/%s/%s resumed", k.deployment, i.job, k.id)),
+			t.gauge(k, i, 0),
+		)
+	}
+}
+
+// Start spins a new go routine that checks for missing instances every
+// heartbeat interval.
+// It returns a shutdown function that blocks until the go routine has
+// exited.
+func (t *Tracker) Start() func() {
+	done := make(chan struct{})
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(t.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				t.Check()
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// Check reports the instances that went missing since the last check and
+// emits the heartbeat_missing gauge for every missing instance.
+// Nothing is reported while no events are received at all, as that is a
+// problem with the stream rather than the instances.
+func (t *Tracker) Check() {
+	refreshed := false
+	if t.lister != nil && t.silentInstances() {
+		refreshed = t.lister.Refresh() == nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	threshold := t.threshold()
+	if now.Sub(t.lastEvent) > threshold {
+		return
+	}
+
+	for k, i := range t.instances {
+		silence := now.Sub(i.lastSeen)
+		if silence > t.forgetAfter {
+			delete(t.instances, k)
+			continue
+		}
+
+		if silence <= threshold {
+			continue
+		}
+
+		if !i.missing {
+			if refreshed && t.deleted(k) {
+				delete(t.instances, k)
+				continue
+			}
+
+			i.missing = true
+			t.send(t.event(k, i, "instance heartbeat missing", fmt.Sprintf(
+				"no heartbeat received from %s/%s/%s since %s",
+				k.deployment, i.job, k.id, i.lastSeen.UTC().Format(time.RFC3339),
+			)))
+		}
+
+		t.send(t.gauge(k, i, 1))
+	}
+}
+
+// silentInstances reports whether any instance that is not yet missing
+// has exceeded the threshold.
+func (t *Tracker) silentInstances() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	for _, i := range t.instances {
+		if !i.missing && now.Sub(i.lastSeen) > t.threshold() {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t *Tracker) threshold() time.Duration {
+	return time.Duration(t.missed) * t.interval
+}
+
+func (t *Tracker) deleted(k instanceKey) bool {
+	i, ok := t.lister.Instance(k.id)
+	return !ok || i.Deployment != k.deployment
+}
+
+func (t *Tracker) send(envelopes ...*loggregator_v2.Envelope) {
+	for _, e := range envelopes {
+		select {
+		case t.messages <- e:
+		default:
+			droppedCounter.Inc()
+		}
+	}
+}
+
+func (t *Tracker) gauge(k instanceKey, i *instance, value float64) *loggregator_v2.Envelope {
+	return &loggregator_v2.Envelope{
+		Timestamp: t.now().UnixNano(),
+		Tags:      t.envelopeTags(k, i),
+		Message: &loggregator_v2.Envelope_Gauge{
+			Gauge: &loggregator_v2.Gauge{
+				Metrics: map[string]*loggregator_v2.GaugeValue{
+					missingMetric: {Value: value, Unit: "b"},
+				},
+			},
+		},
+	}
+}
+
+func (t *Tracker) event(k instanceKey, i *instance, title, body string) *loggregator_v2.Envelope {
+	return &loggregator_v2.Envelope{
+		Timestamp: t.now().UnixNano(),
+		Tags:      t.envelopeTags(k, i),
+		Message: &loggregator_v2.Envelope_Event{
+			Event: &loggregator_v2.Event{
+				Title: title,
+				Body:  body,
+			},
+		},
+	}
+}
+
+func (t *Tracker) envelopeTags(k instanceKey, i *instance) map[string]string {
+	tags := make(map[string]string, len(t.tags)+4)
+	for k, v := range t.tags {
+		tags[k] = v
+	}
+	tags["deployment"] = k.deployment
+	tags["job"] = i.job
+	tags["id"] = k.id
+	tags["origin"] = "bosh-system-metrics-forwarder"
+
+	return tags
+}
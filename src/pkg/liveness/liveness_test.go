@@ -0,0 +1,243 @@
+package liveness_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/enrichment"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/liveness"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/loggregator_v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestCheckReportsMissingInstances(t *testing.T) {
+	RegisterTestingT(t)
+
+	now := time.Unix(1499293724, 0)
+	messages := make(chan *loggregator_v2.Envelope, 10)
+	tr := liveness.New(
+		messages,
+		liveness.WithHeartbeatInterval(time.Minute),
+		liveness.WithMissedIntervals(2),
+		liveness.WithTags(map[string]string{"director": "some-director"}),
+		liveness.WithClock(func() time.Time { return now }),
+	)
+
+	tr.Observe(heartbeat("cf", "router", "id-1"))
+	now = now.Add(3 * time.Minute)
+	tr.Observe(heartbeat("cf", "router", "id-2"))
+
+	tr.Check()
+
+	envelopes := receiveAll(messages)
+	Expect(envelopes).To(HaveLen(2))
+	Expect(envelopes[0].GetEvent().GetTitle()).To(Equal("instance heartbeat missing"))
+	Expect(envelopes[0].GetEvent().GetBody()).To(ContainSubstring("cf/router/id-1"))
+	Expect(envelopes[1].GetTags()).To(Equal(map[string]string{
+		"director":   "some-director",
+		"deployment": "cf",
+		"job":        "router",
+		"id":         "id-1",
+		"origin":     "bosh-system-metrics-forwarder",
+	}))
+	Expect(envelopes[1].GetGauge().GetMetrics()).To(Equal(map[string]*loggregator_v2.GaugeValue{
+		"instance.heartbeat_missing": {Value: 1, Unit: "b"},
+	}))
+
+	tr.Check()
+
+	envelopes = receiveAll(messages)
+	Expect(envelopes).To(HaveLen(1))
+	Expect(envelopes[0].GetGauge()).ToNot(BeNil())
+}
+
+func TestObserveClearsMissingInstances(t *testing.T) {
+	RegisterTestingT(t)
+
+	now := time.Unix(1499293724, 0)
+	messages := make(chan *loggregator_v2.Envelope, 10)
+	tr := liveness.New(
+		messages,
+		liveness.WithHeartbeatInterval(time.Minute),
+		liveness.WithMissedIntervals(2),
+		liveness.WithClock(func() time.Time { return now }),
+	)
+
+	tr.Observe(heartbeat("cf", "router", "id-1"))
+	now = now.Add(3 * time.Minute)
+	tr.Observe(heartbeat("cf", "router", "id-2"))
+	tr.Check()
+	receiveAll(messages)
+
+	tr.Observe(heartbeat("cf", "router", "id-1"))
+
+	envelopes := receiveAll(messages)
+	Expect(envelopes).To(HaveLen(2))
+	Expect(envelopes[0].GetEvent().GetTitle()).To(Equal("instance heartbeat resumed"))
+	Expect(envelopes[1].GetGauge().GetMetrics()).To(Equal(map[string]*loggregator_v2.GaugeValue{
+		"instance.heartbeat_missing": {Value: 0, Unit: "b"},
+	}))
+
+	tr.Check()
+	Expect(receiveAll(messages)).To(BeEmpty())
+}
+
+func TestCheckDoesNotReportWhenNoEventsAreReceived(t *testing.T) {
+	RegisterTestingT(t)
+
+	now := time.Unix(1499293724, 0)
+	messages := make(chan *loggregator_v2.Envelope, 10)
+	tr := liveness.New(
+		messages,
+		liveness.WithHeartbeatInterval(time.Minute),
+		liveness.WithClock(func() time.Time { return now }),
+	)
+
+	tr.Observe(heartbeat("cf", "router", "id-1"))
+	now = now.Add(10 * time.Minute)
+
+	tr.Check()
+	Expect(receiveAll(messages)).To(BeEmpty())
+}
+
+func TestCheckForgetsDeletedInstances(t *testing.T) {
+	RegisterTestingT(t)
+
+	now := time.Unix(1499293724, 0)
+	messages := make(chan *loggregator_v2.Envelope, 10)
+	lister := &spyLister{instances: map[string]enrichment.Instance{
+		"id-2": {Deployment: "cf", ID: "id-2"},
+		"id-3": {Deployment: "cf", ID: "id-3"},
+	}}
+	tr := liveness.New(
+		messages,
+		liveness.WithHeartbeatInterval(time.Minute),
+		liveness.WithMissedIntervals(2),
+		liveness.WithInstanceLister(lister),
+		liveness.WithClock(func() time.Time { return now }),
+	)
+
+	tr.Observe(heartbeat("cf", "router", "id-1"))
+	tr.Observe(heartbeat("cf", "router", "id-2"))
+	now = now.Add(3 * time.Minute)
+	tr.Observe(heartbeat("cf", "router", "id-3"))
+
+	tr.Check()
+
+	Expect(lister.refreshes).To(Equal(1))
+	envelopes := receiveAll(messages)
+	Expect(envelopes).To(HaveLen(2))
+	Expect(envelopes[0].GetTags()).To(HaveKeyWithValue("id", "id-2"))
+
+	tr.Check()
+	Expect(lister.refreshes).To(Equal(1))
+	Expect(receiveAll(messages)).To(HaveLen(1))
+}
+
+func TestCheckReportsInstancesWhenListerFails(t *testing.T) {
+	RegisterTestingT(t)
+
+	now := time.Unix(1499293724, 0)
+	messages := make(chan *loggregator_v2.Envelope, 10)
+	tr := liveness.New(
+		messages,
+		liveness.WithHeartbeatInterval(time.Minute),
+		liveness.WithMissedIntervals(2),
+		liveness.WithInstanceLister(&spyLister{err: errors.New("unavailable")}),
+		liveness.WithClock(func() time.Time { return now }),
+	)
+
+	tr.Observe(heartbeat("cf", "router", "id-1"))
+	now = now.Add(3 * time.Minute)
+	tr.Observe(heartbeat("cf", "router", "id-2"))
+
+	tr.Check()
+	Expect(receiveAll(messages)).To(HaveLen(2))
+}
+
+func TestCheckForgetsInstancesAfterForgetAfter(t *testing.T) {
+	RegisterTestingT(t)
+
+	now := time.Unix(1499293724, 0)
+	messages := make(chan *loggregator_v2.Envelope, 10)
+	tr := liveness.New(
+		messages,
+		liveness.WithHeartbeatInterval(time.Minute),
+		liveness.WithMissedIntervals(2),
+		liveness.WithForgetAfter(5*time.Minute),
+		liveness.WithClock(func() time.Time { return now }),
+	)
+
+	tr.Observe(heartbeat("cf", "router", "id-1"))
+	now = now.Add(6 * time.Minute)
+	tr.Observe(heartbeat("cf", "router", "id-2"))
+
+	tr.Check()
+	Expect(receiveAll(messages)).To(BeEmpty())
+}
+
+func TestCheckDoesNotBlockWhenMessagesAreFull(t *testing.T) {
+	RegisterTestingT(t)
+
+	now := time.Unix(1499293724, 0)
+	messages := make(chan *loggregator_v2.Envelope)
+	tr := liveness.New(
+		messages,
+		liveness.WithHeartbeatInterval(time.Minute),
+		liveness.WithClock(func() time.Time { return now }),
+	)
+
+	tr.Observe(heartbeat("cf", "router", "id-1"))
+	now = now.Add(4 * time.Minute)
+	tr.Observe(heartbeat("cf", "router", "id-2"))
+
+	done := make(chan struct{})
+	go func() {
+		tr.Check()
+		close(done)
+	}()
+
+	Eventually(done).Should(BeClosed())
+}
+
+type spyLister struct {
+	instances map[string]enrichment.Instance
+	err       error
+	refreshes int
+}
+
+func (s *spyLister) Refresh() error {
+	s.refreshes++
+	return s.err
+}
+
+func (s *spyLister) Instance(id string) (enrichment.Instance, bool) {
+	i, ok := s.instances[id]
+	return i, ok
+}
+
+func heartbeat(deployment, job, instanceID string) *definitions.Event {
+	return &definitions.Event{
+		Deployment: deployment,
+		Message: &definitions.Event_Heartbeat{
+			Heartbeat: &definitions.Heartbeat{
+				Job:        job,
+				InstanceId: instanceID,
+			},
+		},
+	}
+}
+
+func receiveAll(messages chan *loggregator_v2.Envelope) []*loggregator_v2.Envelope {
+	var envelopes []*loggregator_v2.Envelope
+	for {
+		select {
+		case e := <-messages:
+			envelopes = append(envelopes, e)
+		default:
+			return envelopes
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// New returns a logger that writes records at or above level to w in the
+// given format, either json or logfmt.
+// Warnings and errors repeating the same message are written at most once
+// per repeatInterval, if it is positive. The next record written after
+// repeats were suppressed carries their count.
+func New(w io.Writer, format string, level slog.Leveler, repeatInterval time.Duration) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+
+	var h slog.Handler
+	switch format {
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	case "logfmt":
+		h = slog.NewTextHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("invalid log format %q, expected json or logfmt", format)
+	}
+
+	if repeatInterval > 0 {
+		h = NewRateLimitHandler(h, repeatInterval)
+	}
+
+	return slog.New(h), nil
+}
+
+// Discard returns a logger that writes nothing.
+func Discard() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelError + 1}))
+}
+
+// RateLimitHandler is a slog.Handler that suppresses warnings and errors
+// repeated within an interval.
+// Records are repeats if they have the same level and message and were
+// logged by loggers with the same attributes and groups, so the attempt
+// or error of a record does not defeat the limit. Lower levels are never
+// suppressed.
+type RateLimitHandler struct {
+	next     slog.Handler
+	interval time.Duration
+	now      func() time.Time
+	scope    string
+	state    *limitState
+}
+
+type limitState struct {
+	mu   sync.Mutex
+	seen map[string]*repeat
+}
+
+type repeat struct {
+	last       time.Time
+	suppressed int
+}
+
+type RateLimitOpt func(*RateLimitHandler)
+
+// WithClock sets the function used to tell the current time.
+func WithClock(now func() time.Time) RateLimitOpt {
+	return func(h *RateLimitHandler) {
+		h.now = now
+	}
+}
+
+// NewRateLimitHandler returns a RateLimitHandler that writes to next.
+func NewRateLimitHandler(next slog.Handler, interval time.Duration, opts ...RateLimitOpt) *RateLimitHandler {
+	h := &RateLimitHandler{
+		next:     next,
+		interval: interval,
+		now:      time.Now,
+		state:    &limitState{seen: make(map[string]*repeat)},
+	}
+
+	for _, o := range opts {
+		o(h)
+	}
+
+	return h
+}
+
+// Enabled reports whether next handles records at level.
+func (h *RateLimitHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+// Handle writes r to next unless it repeats a record written within the
+// interval.
+func (h *RateLimitHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < slog.LevelWarn {
+		return h.next.Handle(ctx, r)
+	}
+
+	key := h.key(r)
+	now := h.now()
+
+	h.state.mu.Lock()
+	rep, ok := h.state.seen[key]
+	if ok && now.Sub(rep.last) < h.interval {
+		rep.suppressed++
+		h.state.mu.Unlock()
+		return nil
+	}
+
+	suppressed := 0
+	if ok {
+		suppressed = rep.suppressed
+	}
+	h.state.seen[key] = &repeat{last: now}
+	h.sweep(now)
+	h.state.mu.Unlock()
+
+	if suppressed > 0 {
+		r = r.Clone()
+		r.AddAttrs(slog.Int("suppressed", suppressed))
+	}
+
+	return h.next.Handle(ctx, r)
+}
+
+// sweep forgets the records last written more than an interval ago once
+// the number of remembered records grows large. The caller holds the lock.
+func (h *RateLimitHandler) sweep(now time.Time) {
+	if len(h.state.seen) < 1024 {
+		return
+	}
+
+	for k, rep := range h.state.seen {
+		if now.Sub(rep.last) >= h.interval {
+			delete(h.state.seen, k)
+		}
+	}
+}
+
+func (h *RateLimitHandler) key(r slog.Record) string {
+	return h.scope + r.Level.String() + "|" + r.Message
+}
+
+// WithAttrs returns a RateLimitHandler that writes to next with the given
+// attributes. Repeats are tracked separately for the attributes.
+func (h *RateLimitHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	scope := h.scope
+	for _, a := range attrs {
+		scope += a.String() + "|"
+	}
+
+	return &RateLimitHandler{
+		next:     h.next.WithAttrs(attrs),
+		interval: h.interval,
+		now:      h.now,
+		scope:    scope,
+		state:    h.state,
+	}
+}
+
+// WithGroup returns a RateLimitHandler that writes to next within the
+// given group.
+func (h *RateLimitHandler) WithGroup(name string) slog.Handler {
+	return &RateLimitHandler{
+		next:     h.next.WithGroup(name),
+		interval: h.interval,
+		now:      h.now,
+		scope:    h.scope + name + ".",
+		state:    h.state,
+	}
+}
@@ -0,0 +1,93 @@
+package logging_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/logging"
+	. "github.com/onsi/gomega"
+)
+
+func TestNewWritesJSON(t *testing.T) {
+	RegisterTestingT(t)
+
+	var buf bytes.Buffer
+	l, err := logging.New(&buf, "json", slog.LevelInfo, 0)
+	Expect(err).ToNot(HaveOccurred())
+
+	l.Debug("hidden")
+	l.Info("stream created", "director", "director-a")
+
+	var record map[string]interface{}
+	Expect(json.Unmarshal(buf.Bytes(), &record)).To(Succeed())
+	Expect(record).To(HaveKeyWithValue("level", "INFO"))
+	Expect(record).To(HaveKeyWithValue("msg", "stream created"))
+	Expect(record).To(HaveKeyWithValue("director", "director-a"))
+}
+
+func TestNewWritesLogfmt(t *testing.T) {
+	RegisterTestingT(t)
+
+	var buf bytes.Buffer
+	l, err := logging.New(&buf, "logfmt", slog.LevelDebug, 0)
+	Expect(err).ToNot(HaveOccurred())
+
+	l.Debug("stream created", "director", "director-a")
+
+	Expect(buf.String()).To(ContainSubstring(`level=DEBUG msg="stream created" director=director-a`))
+}
+
+func TestNewWithInvalidFormat(t *testing.T) {
+	RegisterTestingT(t)
+
+	_, err := logging.New(&bytes.Buffer{}, "xml", slog.LevelInfo, 0)
+	Expect(err).To(HaveOccurred())
+}
+
+func TestRateLimitHandlerSuppressesRepeatedErrors(t *testing.T) {
+	RegisterTestingT(t)
+
+	now := time.Unix(1499293724, 0)
+	var buf bytes.Buffer
+	l := slog.New(logging.NewRateLimitHandler(
+		slog.NewTextHandler(&buf, nil),
+		time.Minute,
+		logging.WithClock(func() time.Time { return now }),
+	))
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		l.Error("error sending to log agent", "error", errors.New("unavailable"), "attempt", attempt)
+	}
+	l.Info("metron stream created")
+	l.Info("metron stream created")
+	Expect(lines(buf.String())).To(HaveLen(3))
+
+	now = now.Add(time.Minute)
+	l.Error("error sending to log agent", "error", errors.New("unavailable"), "attempt", 4)
+
+	logged := lines(buf.String())
+	Expect(logged).To(HaveLen(4))
+	Expect(logged[3]).To(ContainSubstring("attempt=4 suppressed=2"))
+}
+
+func TestRateLimitHandlerTracksLoggersSeparately(t *testing.T) {
+	RegisterTestingT(t)
+
+	var buf bytes.Buffer
+	l := slog.New(logging.NewRateLimitHandler(slog.NewTextHandler(&buf, nil), time.Minute))
+
+	l.With("director", "director-a").Warn("stream idle")
+	l.With("director", "director-b").Warn("stream idle")
+	l.With("director", "director-a").Warn("stream idle")
+
+	Expect(lines(buf.String())).To(HaveLen(2))
+}
+
+func lines(s string) []string {
+	return strings.Split(strings.TrimSpace(s), "\n")
+}
@@ -2,48 +2,143 @@ package mapper
 
 import (
 	"errors"
+	"fmt"
 
 	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/definitions"
 	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/loggregator_v2"
 )
 
+// Tagger provides additional tags for the envelope created from an event.
+type Tagger interface {
+	Tags(event *definitions.Event) map[string]string
+}
+
+// TaggerFunc is an adapter to allow the use of ordinary functions as
+// Taggers.
+type TaggerFunc func(event *definitions.Event) map[string]string
+
+// Tags calls f(event).
+func (f TaggerFunc) Tags(event *definitions.Event) map[string]string {
+	return f(event)
+}
+
+// UnitMode selects the units of the envelope metrics.
+type UnitMode int
+
+const (
+	// CompatUnits keeps the values and unit strings forwarded by previous
+	// releases.
+	CompatUnits UnitMode = iota
+	// BaseUnits converts values to base units and uses the unit strings
+	// of other loggregator sources, e.g. kilobytes to bytes.
+	BaseUnits
+)
+
+// ParseUnitMode returns the UnitMode named compat or base.
+func ParseUnitMode(s string) (UnitMode, error) {
+	switch s {
+	case "compat":
+		return CompatUnits, nil
+	case "base":
+		return BaseUnits, nil
+	default:
+		return CompatUnits, fmt.Errorf("invalid unit mode %q, expected compat or base", s)
+	}
+}
+
+type mapper struct {
+	ipTag    string
+	tags     map[string]string
+	taggers  []Tagger
+	unitMode UnitMode
+}
+
+type MapperOpt func(*mapper)
+
+// WithTags adds the given tags to every envelope.
+// The tags override the tags of taggers but not the tags derived from the
+// event.
+func WithTags(tags map[string]string) MapperOpt {
+	return func(m *mapper) {
+		for k, v := range tags {
+			m.tags[k] = v
+		}
+	}
+}
+
+// WithTagger adds the tags provided by t to every envelope.
+// Taggers are applied in order after the ip tag, which they override.
+// They do not override the static tags or the tags derived from the event.
+func WithTagger(t Tagger) MapperOpt {
+	return func(m *mapper) {
+		m.taggers = append(m.taggers, t)
+	}
+}
+
+// WithUnitMode sets the units of the envelope metrics. It defaults to
+// CompatUnits.
+func WithUnitMode(mode UnitMode) MapperOpt {
+	return func(m *mapper) {
+		m.unitMode = mode
+	}
+}
+
 // New returns a function that converts a bosh Event to an envelope.
 // It only process heartbeat events.
 // It returns an error if it receives a message type isn't a heartbeat type.
 // It takes an IP tag which overrides the `ip` tag on the envelope.
-func New(ipTag string) func(event *definitions.Event) (*loggregator_v2.Envelope, error) {
+func New(ipTag string, opts ...MapperOpt) func(event *definitions.Event) (*loggregator_v2.Envelope, error) {
+	m := &mapper{
+		ipTag: ipTag,
+		tags:  make(map[string]string),
+	}
+
+	for _, o := range opts {
+		o(m)
+	}
+
 	return func(event *definitions.Event) (*loggregator_v2.Envelope, error) {
 		switch event.Message.(type) {
 		case *definitions.Event_Heartbeat:
-			return mapHeartbeat(event, ipTag), nil
+			return m.mapHeartbeat(event), nil
 		default:
 			return nil, errors.New("metric type not supported")
 		}
 	}
 }
 
-func mapHeartbeat(event *definitions.Event, ipTag string) *loggregator_v2.Envelope {
+func (m *mapper) mapHeartbeat(event *definitions.Event) *loggregator_v2.Envelope {
 
 	gaugeMetrics := make(map[string]*loggregator_v2.GaugeValue, len(event.GetHeartbeat().GetMetrics()))
 
 	for _, v := range event.GetHeartbeat().GetMetrics() {
-		gaugeMetrics[v.Name] = &loggregator_v2.GaugeValue{
-			Value: v.Value,
-			Unit:  eventNameToUnit[v.Name],
+		name, value, unit := Convert(m.unitMode, v.Name, v.Value)
+		gaugeMetrics[name] = &loggregator_v2.GaugeValue{
+			Value: value,
+			Unit:  unit,
 		}
 
 	}
 
+	tags := make(map[string]string, len(m.tags)+6)
+	tags["ip"] = m.ipTag
+	for _, t := range m.taggers {
+		for k, v := range t.Tags(event) {
+			tags[k] = v
+		}
+	}
+	for k, v := range m.tags {
+		tags[k] = v
+	}
+	tags["job"] = event.GetHeartbeat().GetJob()
+	tags["index"] = event.GetHeartbeat().GetInstanceId()
+	tags["id"] = event.GetHeartbeat().GetInstanceId()
+	tags["origin"] = "bosh-system-metrics-forwarder"
+	tags["deployment"] = event.GetDeployment()
+
 	return &loggregator_v2.Envelope{
 		Timestamp: event.Timestamp,
-		Tags: map[string]string{
-			"job": event.GetHeartbeat().GetJob(),
-			"index": event.GetHeartbeat().GetInstanceId(),
-			"id": event.GetHeartbeat().GetInstanceId(),
-			"origin": "bosh-system-metrics-forwarder",
-			"deployment": event.GetDeployment(),
-			"ip": ipTag,
-		},
+		Tags:      tags,
 		Message: &loggregator_v2.Envelope_Gauge{
 			Gauge: &loggregator_v2.Gauge{
 				Metrics: gaugeMetrics,
@@ -52,6 +147,58 @@ func mapHeartbeat(event *definitions.Event, ipTag string) *loggregator_v2.Envelo
 	}
 }
 
+// Unit returns the unit of the heartbeat metric with the given name.
+func Unit(name string) string {
+	return eventNameToUnit[name]
+}
+
+// Convert returns the name, value and unit of the heartbeat metric with
+// the given name in mode. Metrics whose name carries the unit are renamed
+// when they are converted, e.g. system.mem.kb becomes system.mem.bytes.
+func Convert(mode UnitMode, name string, value float64) (string, float64, string) {
+	if mode != BaseUnits {
+		return name, value, eventNameToUnit[name]
+	}
+
+	u, ok := eventNameToBaseUnit[name]
+	if !ok {
+		return name, value, eventNameToUnit[name]
+	}
+	if n, ok := eventNameToBaseName[name]; ok {
+		name = n
+	}
+
+	return name, value * u.scale, u.unit
+}
+
+type baseUnit struct {
+	unit  string
+	scale float64
+}
+
+var eventNameToBaseUnit = map[string]baseUnit{
+	"system.healthy":                       {"bool", 1},
+	"system.load.1m":                       {"load", 1},
+	"system.cpu.user":                      {"percentage", 1},
+	"system.cpu.sys":                       {"percentage", 1},
+	"system.cpu.wait":                      {"percentage", 1},
+	"system.disk.system.percent":           {"percentage", 1},
+	"system.disk.system.inode_percent":     {"percentage", 1},
+	"system.mem.percent":                   {"percentage", 1},
+	"system.swap.percent":                  {"percentage", 1},
+	"system.disk.ephemeral.percent":        {"percentage", 1},
+	"system.disk.ephemeral.inode_percent":  {"percentage", 1},
+	"system.disk.persistent.percent":       {"percentage", 1},
+	"system.disk.persistent.inode_percent": {"percentage", 1},
+	"system.mem.kb":                        {"bytes", 1024},
+	"system.swap.kb":                       {"bytes", 1024},
+}
+
+var eventNameToBaseName = map[string]string{
+	"system.mem.kb":  "system.mem.bytes",
+	"system.swap.kb": "system.swap.bytes",
+}
+
 var eventNameToUnit = map[string]string{
 	"system.healthy":                       "b",
 	"system.load.1m":                       "Load",
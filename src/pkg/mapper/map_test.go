@@ -49,6 +49,82 @@ func TestMapHeartbeat(t *testing.T) {
 	}))
 }
 
+func TestMapHeartbeatWithTags(t *testing.T) {
+	RegisterTestingT(t)
+
+	envelope, err := mapper.New("1.2.3.4", mapper.WithTags(map[string]string{
+		"director":   "director-a",
+		"deployment": "not-overridden",
+	}))(heartbeatEvent)
+	Expect(err).ToNot(HaveOccurred())
+
+	Expect(envelope.Tags).To(HaveKeyWithValue("director", "director-a"))
+	Expect(envelope.Tags).To(HaveKeyWithValue("deployment", "loggregator"))
+}
+
+func TestMapHeartbeatWithTaggers(t *testing.T) {
+	RegisterTestingT(t)
+
+	envelope, err := mapper.New(
+		"1.2.3.4",
+		mapper.WithTags(map[string]string{"director": "static-name"}),
+		mapper.WithTagger(mapper.TaggerFunc(func(e *definitions.Event) map[string]string {
+			return map[string]string{
+				"director":   "dynamic-name",
+				"ip":         "10.0.0.1",
+				"deployment": "not-overridden",
+				"source":     e.GetDeployment(),
+			}
+		})),
+	)(heartbeatEvent)
+	Expect(err).ToNot(HaveOccurred())
+
+	Expect(envelope.Tags).To(HaveKeyWithValue("director", "static-name"))
+	Expect(envelope.Tags).To(HaveKeyWithValue("ip", "10.0.0.1"))
+	Expect(envelope.Tags).To(HaveKeyWithValue("deployment", "loggregator"))
+	Expect(envelope.Tags).To(HaveKeyWithValue("source", "loggregator"))
+}
+
+func TestMapHeartbeatWithBaseUnits(t *testing.T) {
+	RegisterTestingT(t)
+
+	envelope, err := mapper.New("1.2.3.4", mapper.WithUnitMode(mapper.BaseUnits))(heartbeatEvent)
+	Expect(err).ToNot(HaveOccurred())
+
+	Expect(envelope.GetGauge().GetMetrics()).To(Equal(map[string]*loggregator_v2.GaugeValue{
+		"system.load.1m":                       {Value: 0.18, Unit: "load"},
+		"system.cpu.user":                      {Value: 2.5, Unit: "percentage"},
+		"system.cpu.sys":                       {Value: 3.2, Unit: "percentage"},
+		"system.cpu.wait":                      {Value: 0.0, Unit: "percentage"},
+		"system.mem.percent":                   {Value: 28, Unit: "percentage"},
+		"system.mem.bytes":                     {Value: 1139140 * 1024, Unit: "bytes"},
+		"system.swap.percent":                  {Value: 0, Unit: "percentage"},
+		"system.swap.bytes":                    {Value: 9788 * 1024, Unit: "bytes"},
+		"system.disk.system.percent":           {Value: 23, Unit: "percentage"},
+		"system.disk.system.inode_percent":     {Value: 14, Unit: "percentage"},
+		"system.disk.ephemeral.percent":        {Value: 4, Unit: "percentage"},
+		"system.disk.ephemeral.inode_percent":  {Value: 2, Unit: "percentage"},
+		"system.disk.persistent.percent":       {Value: 4, Unit: "percentage"},
+		"system.disk.persistent.inode_percent": {Value: 2, Unit: "percentage"},
+		"system.healthy":                       {Value: 1, Unit: "bool"},
+	}))
+}
+
+func TestParseUnitMode(t *testing.T) {
+	RegisterTestingT(t)
+
+	mode, err := mapper.ParseUnitMode("compat")
+	Expect(err).ToNot(HaveOccurred())
+	Expect(mode).To(Equal(mapper.CompatUnits))
+
+	mode, err = mapper.ParseUnitMode("base")
+	Expect(err).ToNot(HaveOccurred())
+	Expect(mode).To(Equal(mapper.BaseUnits))
+
+	_, err = mapper.ParseUnitMode("metric")
+	Expect(err).To(HaveOccurred())
+}
+
 func TestMapIgnoresAlerts(t *testing.T) {
 	RegisterTestingT(t)
 
@@ -1,33 +1,41 @@
 package monitor
 
 import (
-	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
+
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-// New creates a health metrics server
-func NewHealth(port uint32) Starter {
-	return &health{port}
-}
-
-type health struct {
-	port uint32
-}
+// NewHealth creates a health metrics server serving on lis.
+func NewHealth(lis net.Listener, l *slog.Logger, opts ...HealthOpt) *Server {
+	h := &health{
+		handlers: make(map[string]http.Handler),
+	}
 
-// Start initializes a monitor health server
-func (s *health) Start() {
-	lis, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", s.port))
-	if err != nil {
-		log.Printf("unable to start monitor endpoint: %s", err)
+	for _, o := range opts {
+		o(h)
 	}
 
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.Handler())
+	for path, h := range h.handlers {
+		mux.Handle(path, h)
+	}
 
-	log.Printf("starting monitor endpoint on http://%s/metrics\n", lis.Addr().String())
-	err = http.Serve(lis, mux)
-	log.Printf("error starting the monitor server: %s", err)
+	return NewServer("monitor", lis, mux, l)
+}
+
+type health struct {
+	handlers map[string]http.Handler
+}
+
+type HealthOpt func(*health)
+
+// WithHandler serves h on the given path alongside the metrics
+func WithHandler(path string, h http.Handler) HealthOpt {
+	return func(s *health) {
+		s.handlers[path] = h
+	}
 }
@@ -1,38 +1,20 @@
 package monitor
 
 import (
-	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
-	_ "net/http/pprof"
+	"net/http/pprof"
 )
 
-// Starter is something that can be started
-type Starter interface {
-	Start()
-}
-
-// New creates a monitor profiler
-func NewProfiler(port uint32) Starter {
-	return &profiler{port}
-}
-
-type profiler struct {
-	port uint32
-}
-
-// Start initializes a monitor profiler on a port
-func (s *profiler) Start() {
-	addr := fmt.Sprintf("localhost:%d", s.port)
-	lis, err := net.Listen("tcp", addr)
-	if err != nil {
-		log.Panicf("error creating pprof listener: %s", err)
-	}
+// NewProfiler creates a pprof profiler server serving on lis.
+func NewProfiler(lis net.Listener, l *slog.Logger) *Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 
-	log.Printf("starting pprof profiler on: %s", lis.Addr().String())
-	err = http.Serve(lis, nil)
-	if err != nil {
-		log.Panicf("error starting pprof profiler: %s", err)
-	}
+	return NewServer("pprof", lis, mux, l)
 }
@@ -0,0 +1,66 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// shutdownTimeout bounds how long a server waits for active requests,
+// such as streaming ones, when it is shut down.
+const shutdownTimeout = 5 * time.Second
+
+// Listen listens on the given localhost port.
+func Listen(port uint32) (net.Listener, error) {
+	return net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+}
+
+// Server serves an http handler on a listener until its context is done.
+type Server struct {
+	name   string
+	lis    net.Listener
+	server *http.Server
+	logger *slog.Logger
+}
+
+// NewServer returns a Server serving h on lis. The name identifies the
+// server in logs.
+func NewServer(name string, lis net.Listener, h http.Handler, l *slog.Logger) *Server {
+	return &Server{
+		name:   name,
+		lis:    lis,
+		server: &http.Server{Handler: h},
+		logger: l,
+	}
+}
+
+// Serve serves requests until ctx is done and then shuts the server down.
+// Requests still active after the shutdown timeout are closed.
+// It returns an error if serving fails before ctx is done.
+func (s *Server) Serve(ctx context.Context) error {
+	s.logger.Info("starting "+s.name+" endpoint", "addr", s.lis.Addr().String())
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.server.Serve(s.lis)
+	}()
+
+	select {
+	case err := <-errs:
+		return fmt.Errorf("error serving the %s endpoint: %s", s.name, err)
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err := s.server.Shutdown(shutdownCtx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return s.server.Close()
+	}
+
+	return err
+}
@@ -0,0 +1,273 @@
+package predict
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/loggregator_v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var droppedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+	Subsystem: "predict",
+	Name:      "dropped",
+	Help:      "Tracks the number of prediction envelopes dropped if unable to queue the msg",
+})
+
+func init() {
+	prometheus.MustRegister(droppedCounter)
+}
+
+const (
+	diskPrefix    = "system.disk."
+	percentSuffix = ".percent"
+	inodeSuffix   = ".inode_percent"
+)
+
+type instanceKey struct {
+	deployment string
+	id         string
+}
+
+type sample struct {
+	t     time.Time
+	value float64
+}
+
+type instance struct {
+	lastSeen time.Time
+	series   map[string][]sample
+}
+
+// DiskPredictor keeps a history of the disk and inode usage of every
+// instance and predicts when each disk becomes full.
+// For every disk with enough samples in the window a least squares trend
+// is fitted and a time_to_full_seconds gauge is emitted while the usage
+// is growing. Deployments are only unique per director, so every director
+// needs its own DiskPredictor.
+type DiskPredictor struct {
+	messages   chan<- *loggregator_v2.Envelope
+	window     time.Duration
+	minSamples int
+	tags       map[string]string
+	now        func() time.Time
+
+	mu        sync.Mutex
+	instances map[instanceKey]*instance
+	lastSweep time.Time
+}
+
+type DiskPredictorOpt func(*DiskPredictor)
+
+// WithWindow sets how long samples are kept for the trend.
+func WithWindow(d time.Duration) DiskPredictorOpt {
+	return func(p *DiskPredictor) {
+		p.window = d
+	}
+}
+
+// WithMinSamples sets how many samples are required in the window before
+// a prediction is made.
+func WithMinSamples(n int) DiskPredictorOpt {
+	return func(p *DiskPredictor) {
+		p.minSamples = n
+	}
+}
+
+// WithTags adds the given tags to every envelope.
+func WithTags(tags map[string]string) DiskPredictorOpt {
+	return func(p *DiskPredictor) {
+		for k, v := range tags {
+			p.tags[k] = v
+		}
+	}
+}
+
+// WithClock sets the function used to tell the current time.
+func WithClock(now func() time.Time) DiskPredictorOpt {
+	return func(p *DiskPredictor) {
+		p.now = now
+	}
+}
+
+// New returns a new DiskPredictor that writes envelopes to messages.
+func New(messages chan<- *loggregator_v2.Envelope, opts ...DiskPredictorOpt) *DiskPredictor {
+	p := &DiskPredictor{
+		messages:   messages,
+		window:     time.Hour,
+		minSamples: 5,
+		tags:       make(map[string]string),
+		now:        time.Now,
+		instances:  make(map[instanceKey]*instance),
+	}
+
+	for _, o := range opts {
+		o(p)
+	}
+
+	p.lastSweep = p.now()
+
+	return p
+}
+
+// Observe records the disk usage of the heartbeat and emits the predicted
+// time to full of its disks. Other events are ignored.
+func (p *DiskPredictor) Observe(event *definitions.Event) {
+	hb := event.GetHeartbeat()
+	if hb == nil {
+		return
+	}
+
+	envelope := p.predict(event.GetDeployment(), hb)
+	if envelope == nil {
+		return
+	}
+
+	select {
+	case p.messages <- envelope:
+	default:
+		droppedCounter.Inc()
+	}
+}
+
+func (p *DiskPredictor) predict(deployment string, hb *definitions.Heartbeat) *loggregator_v2.Envelope {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	p.sweep(now)
+
+	k := instanceKey{deployment: deployment, id: hb.GetInstanceId()}
+	i, ok := p.instances[k]
+	if !ok {
+		i = &instance{series: make(map[string][]sample)}
+		p.instances[k] = i
+	}
+	i.lastSeen = now
+
+	cutoff := now.Add(-p.window)
+	metrics := make(map[string]*loggregator_v2.GaugeValue)
+	for _, m := range hb.GetMetrics() {
+		name, ok := predictionName(m.GetName())
+		if !ok {
+			continue
+		}
+
+		series := append(trim(i.series[m.GetName()], cutoff), sample{t: now, value: m.GetValue()})
+		i.series[m.GetName()] = series
+
+		if len(series) < p.minSamples {
+			continue
+		}
+
+		ttf, ok := timeToFull(series)
+		if !ok {
+			continue
+		}
+		metrics[name] = &loggregator_v2.GaugeValue{Value: ttf, Unit: "s"}
+	}
+
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	tags := map[string]string{
+		"deployment": deployment,
+		"job":        hb.GetJob(),
+		"id":         hb.GetInstanceId(),
+		"origin":     "bosh-system-metrics-forwarder",
+	}
+	for k, v := range p.tags {
+		tags[k] = v
+	}
+
+	return &loggregator_v2.Envelope{
+		Timestamp: now.UnixNano(),
+		Tags:      tags,
+		Message: &loggregator_v2.Envelope_Gauge{
+			Gauge: &loggregator_v2.Gauge{
+				Metrics: metrics,
+			},
+		},
+	}
+}
+
+// sweep forgets the instances that have not been seen within the window.
+// It runs at most once per window.
+func (p *DiskPredictor) sweep(now time.Time) {
+	if now.Sub(p.lastSweep) < p.window {
+		return
+	}
+	p.lastSweep = now
+
+	cutoff := now.Add(-p.window)
+	for k, i := range p.instances {
+		if i.lastSeen.Before(cutoff) {
+			delete(p.instances, k)
+		}
+	}
+}
+
+// predictionName returns the name of the time to full gauge of a disk
+// usage metric, e.g. system.disk.persistent.time_to_full_seconds for
+// system.disk.persistent.percent and
+// system.disk.persistent.inode_time_to_full_seconds for
+// system.disk.persistent.inode_percent.
+func predictionName(metric string) (string, bool) {
+	if !strings.HasPrefix(metric, diskPrefix) {
+		return "", false
+	}
+
+	if disk, ok := strings.CutSuffix(metric, inodeSuffix); ok {
+		return disk + ".inode_time_to_full_seconds", true
+	}
+	if disk, ok := strings.CutSuffix(metric, percentSuffix); ok {
+		return disk + ".time_to_full_seconds", true
+	}
+
+	return "", false
+}
+
+func trim(series []sample, cutoff time.Time) []sample {
+	for len(series) > 0 && series[0].t.Before(cutoff) {
+		series = series[1:]
+	}
+
+	return series
+}
+
+// timeToFull fits a least squares line through the samples and returns the
+// seconds until it reaches 100 percent, measured from the latest sample.
+// It returns false if the usage is not growing.
+func timeToFull(series []sample) (float64, bool) {
+	origin := series[0].t
+	n := float64(len(series))
+
+	var sumX, sumY, sumXY, sumXX float64
+	for _, s := range series {
+		x := s.t.Sub(origin).Seconds()
+		sumX += x
+		sumY += s.value
+		sumXY += x * s.value
+		sumXX += x * x
+	}
+
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0, false
+	}
+
+	slope := (n*sumXY - sumX*sumY) / denominator
+	if slope <= 0 {
+		return 0, false
+	}
+
+	latest := series[len(series)-1].value
+	if latest >= 100 {
+		return 0, true
+	}
+
+	return (100 - latest) / slope, true
+}
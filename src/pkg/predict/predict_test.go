@@ -0,0 +1,170 @@
+package predict_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/loggregator_v2"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/predict"
+	. "github.com/onsi/gomega"
+)
+
+func TestObserveEmitsTimeToFull(t *testing.T) {
+	RegisterTestingT(t)
+
+	now := time.Unix(1499293724, 0)
+	messages := make(chan *loggregator_v2.Envelope, 10)
+	p := predict.New(
+		messages,
+		predict.WithMinSamples(3),
+		predict.WithClock(func() time.Time { return now }),
+	)
+
+	p.Observe(heartbeat("cf", "router", "id-1", 50, 10))
+	now = now.Add(time.Minute)
+	p.Observe(heartbeat("cf", "router", "id-1", 51, 10))
+	Expect(messages).To(BeEmpty())
+
+	now = now.Add(time.Minute)
+	p.Observe(heartbeat("cf", "router", "id-1", 52, 10))
+
+	Expect(messages).To(HaveLen(1))
+	envelope := <-messages
+	Expect(envelope.GetTimestamp()).To(Equal(now.UnixNano()))
+	Expect(envelope.GetTags()).To(Equal(map[string]string{
+		"deployment": "cf",
+		"job":        "router",
+		"id":         "id-1",
+		"origin":     "bosh-system-metrics-forwarder",
+	}))
+	Expect(envelope.GetGauge().GetMetrics()).To(Equal(map[string]*loggregator_v2.GaugeValue{
+		"system.disk.persistent.time_to_full_seconds": {Value: 48 * 60, Unit: "s"},
+	}))
+}
+
+func TestObserveAddsTags(t *testing.T) {
+	RegisterTestingT(t)
+
+	now := time.Unix(1499293724, 0)
+	messages := make(chan *loggregator_v2.Envelope, 10)
+	p := predict.New(
+		messages,
+		predict.WithMinSamples(2),
+		predict.WithTags(map[string]string{"director": "bosh-1"}),
+		predict.WithClock(func() time.Time { return now }),
+	)
+
+	p.Observe(heartbeat("cf", "router", "id-1", 50, 10))
+	now = now.Add(time.Minute)
+	p.Observe(heartbeat("cf", "router", "id-1", 51, 10))
+
+	Expect(messages).To(HaveLen(1))
+	envelope := <-messages
+	Expect(envelope.GetTags()).To(HaveKeyWithValue("director", "bosh-1"))
+	Expect(envelope.GetTags()).To(HaveKeyWithValue("deployment", "cf"))
+}
+
+func TestObserveEmitsInodeTimeToFull(t *testing.T) {
+	RegisterTestingT(t)
+
+	now := time.Unix(1499293724, 0)
+	messages := make(chan *loggregator_v2.Envelope, 10)
+	p := predict.New(
+		messages,
+		predict.WithMinSamples(2),
+		predict.WithClock(func() time.Time { return now }),
+	)
+
+	p.Observe(heartbeat("cf", "router", "id-1", 50, 10))
+	now = now.Add(time.Second)
+	p.Observe(heartbeat("cf", "router", "id-1", 50, 20))
+
+	envelope := <-messages
+	Expect(envelope.GetGauge().GetMetrics()).To(Equal(map[string]*loggregator_v2.GaugeValue{
+		"system.disk.persistent.inode_time_to_full_seconds": {Value: 8, Unit: "s"},
+	}))
+}
+
+func TestObserveDropsSamplesOutsideWindow(t *testing.T) {
+	RegisterTestingT(t)
+
+	now := time.Unix(1499293724, 0)
+	messages := make(chan *loggregator_v2.Envelope, 10)
+	p := predict.New(
+		messages,
+		predict.WithWindow(90*time.Second),
+		predict.WithMinSamples(2),
+		predict.WithClock(func() time.Time { return now }),
+	)
+
+	p.Observe(heartbeat("cf", "router", "id-1", 10, 0))
+	now = now.Add(time.Minute)
+	p.Observe(heartbeat("cf", "router", "id-1", 50, 0))
+	<-messages
+
+	now = now.Add(time.Minute)
+	p.Observe(heartbeat("cf", "router", "id-1", 60, 0))
+
+	envelope := <-messages
+	Expect(envelope.GetGauge().GetMetrics()).To(Equal(map[string]*loggregator_v2.GaugeValue{
+		"system.disk.persistent.time_to_full_seconds": {Value: 240, Unit: "s"},
+	}))
+}
+
+func TestObserveDoesNotEmitForShrinkingUsage(t *testing.T) {
+	RegisterTestingT(t)
+
+	now := time.Unix(1499293724, 0)
+	messages := make(chan *loggregator_v2.Envelope, 10)
+	p := predict.New(
+		messages,
+		predict.WithMinSamples(2),
+		predict.WithClock(func() time.Time { return now }),
+	)
+
+	p.Observe(heartbeat("cf", "router", "id-1", 50, 10))
+	now = now.Add(time.Minute)
+	p.Observe(heartbeat("cf", "router", "id-1", 50, 9))
+
+	Expect(messages).To(BeEmpty())
+}
+
+func TestObserveDoesNotBlockWhenMessagesAreFull(t *testing.T) {
+	RegisterTestingT(t)
+
+	now := time.Unix(1499293724, 0)
+	messages := make(chan *loggregator_v2.Envelope)
+	p := predict.New(
+		messages,
+		predict.WithMinSamples(1),
+		predict.WithClock(func() time.Time { return now }),
+	)
+	p.Observe(heartbeat("cf", "router", "id-1", 50, 10))
+	now = now.Add(time.Minute)
+
+	done := make(chan struct{})
+	go func() {
+		p.Observe(heartbeat("cf", "router", "id-1", 60, 10))
+		close(done)
+	}()
+
+	Eventually(done).Should(BeClosed())
+}
+
+func heartbeat(deployment, job, instanceID string, percent, inodePercent float64) *definitions.Event {
+	return &definitions.Event{
+		Deployment: deployment,
+		Message: &definitions.Event_Heartbeat{
+			Heartbeat: &definitions.Heartbeat{
+				Job:        job,
+				InstanceId: instanceID,
+				Metrics: []*definitions.Heartbeat_Metric{
+					{Name: "system.healthy", Value: 1},
+					{Name: "system.disk.persistent.percent", Value: percent},
+					{Name: "system.disk.persistent.inode_percent", Value: inodePercent},
+				},
+			},
+		},
+	}
+}
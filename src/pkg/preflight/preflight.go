@@ -0,0 +1,122 @@
+package preflight
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Report runs preflight steps and prints whether each of them passed.
+type Report struct {
+	w                       io.Writer
+	passed, failed, skipped int
+}
+
+// NewReport returns a Report that prints to w.
+func NewReport(w io.Writer) *Report {
+	return &Report{w: w}
+}
+
+// Run runs step and prints whether it passed, along with the detail it
+// returned or its error. It reports whether the step passed.
+func (r *Report) Run(name string, step func() (string, error)) bool {
+	detail, err := step()
+	if err != nil {
+		r.failed++
+		fmt.Fprintf(r.w, "FAIL  %s: %s\n", name, err)
+		return false
+	}
+
+	r.passed++
+	if detail == "" {
+		fmt.Fprintf(r.w, "PASS  %s\n", name)
+	} else {
+		fmt.Fprintf(r.w, "PASS  %s: %s\n", name, detail)
+	}
+
+	return true
+}
+
+// Skip prints that the step was not run and why.
+func (r *Report) Skip(name, reason string) {
+	r.skipped++
+	fmt.Fprintf(r.w, "SKIP  %s: %s\n", name, reason)
+}
+
+// Failed returns the number of steps that failed.
+func (r *Report) Failed() int {
+	return r.failed
+}
+
+// Summary prints the number of steps that passed, failed and were
+// skipped.
+func (r *Report) Summary() {
+	fmt.Fprintf(r.w, "\n%d passed, %d failed, %d skipped\n", r.passed, r.failed, r.skipped)
+}
+
+// CACerts verifies that caPEM holds at least one certificate and that
+// none of them has expired at now. It describes the certificates and the
+// earliest expiry.
+func CACerts(caPEM string, now time.Time) (string, error) {
+	var certs []*x509.Certificate
+	rest := []byte(caPEM)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return "", err
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return "", errors.New("no certificate found")
+	}
+
+	return describe(certs, now)
+}
+
+// KeyPair verifies that the certificate and key at the given paths match
+// and that the certificate has not expired at now.
+func KeyPair(certPath, keyPath string, now time.Time) (string, error) {
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return "", err
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return "", err
+	}
+
+	return describe([]*x509.Certificate{cert}, now)
+}
+
+func describe(certs []*x509.Certificate, now time.Time) (string, error) {
+	earliest := certs[0]
+	for _, c := range certs {
+		if now.After(c.NotAfter) {
+			return "", fmt.Errorf("certificate %q expired on %s", c.Subject.CommonName, c.NotAfter.Format(time.RFC3339))
+		}
+		if now.Before(c.NotBefore) {
+			return "", fmt.Errorf("certificate %q is not valid before %s", c.Subject.CommonName, c.NotBefore.Format(time.RFC3339))
+		}
+		if c.NotAfter.Before(earliest.NotAfter) {
+			earliest = c
+		}
+	}
+
+	return fmt.Sprintf("%d certificate(s), %q expires %s", len(certs), earliest.Subject.CommonName, earliest.NotAfter.Format(time.RFC3339)), nil
+}
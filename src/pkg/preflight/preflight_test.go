@@ -0,0 +1,107 @@
+package preflight_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/preflight"
+	. "github.com/onsi/gomega"
+)
+
+func TestReport(t *testing.T) {
+	RegisterTestingT(t)
+
+	var buf bytes.Buffer
+	r := preflight.NewReport(&buf)
+
+	Expect(r.Run("director info", func() (string, error) { return "bosh 280.0.0", nil })).To(BeTrue())
+	Expect(r.Run("uaa token", func() (string, error) { return "", errors.New("bad status code: 401") })).To(BeFalse())
+	r.Skip("metrics server stream", "no token")
+	r.Summary()
+
+	Expect(r.Failed()).To(Equal(1))
+	Expect(buf.String()).To(Equal("PASS  director info: bosh 280.0.0\n" +
+		"FAIL  uaa token: bad status code: 401\n" +
+		"SKIP  metrics server stream: no token\n" +
+		"\n1 passed, 1 failed, 1 skipped\n"))
+}
+
+func TestCACerts(t *testing.T) {
+	RegisterTestingT(t)
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ca, _ := newCert(t, "ca", now.Add(time.Hour))
+
+	detail, err := preflight.CACerts(ca, now)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(detail).To(Equal(`1 certificate(s), "ca" expires 2024-01-01T01:00:00Z`))
+
+	_, err = preflight.CACerts(ca, now.Add(2*time.Hour))
+	Expect(err).To(MatchError(ContainSubstring("expired")))
+
+	_, err = preflight.CACerts("not a cert", now)
+	Expect(err).To(MatchError("no certificate found"))
+}
+
+func TestKeyPair(t *testing.T) {
+	RegisterTestingT(t)
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cert, key := newCert(t, "metron", now.Add(time.Hour))
+	_, otherKey := newCert(t, "other", now.Add(time.Hour))
+
+	_, err := preflight.KeyPair(writeFile(t, cert), writeFile(t, key), now)
+	Expect(err).ToNot(HaveOccurred())
+
+	_, err = preflight.KeyPair(writeFile(t, cert), writeFile(t, otherKey), now)
+	Expect(err).To(HaveOccurred())
+}
+
+func newCert(t *testing.T, cn string, notAfter time.Time) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    notAfter.Add(-24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	return string(certPEM), string(keyPEM)
+}
+
+func writeFile(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "file.pem")
+	err := os.WriteFile(path, []byte(contents), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
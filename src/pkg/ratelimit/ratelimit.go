@@ -0,0 +1,370 @@
+package ratelimit
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/definitions"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var droppedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Subsystem: "ratelimit",
+	Name:      "dropped",
+	Help:      "Tracks the number of events or metrics dropped by the rate and cardinality limits",
+}, []string{"director", "reason"})
+
+func init() {
+	prometheus.MustRegister(droppedCounter)
+}
+
+const (
+	reasonDeploymentRate    = "deployment_rate"
+	reasonInstanceRate      = "instance_rate"
+	reasonMetricCardinality = "metric_cardinality"
+	reasonTagCardinality    = "tag_cardinality"
+)
+
+// logInterval limits how often the drops of a deployment are logged.
+const logInterval = time.Minute
+
+type limit struct {
+	rate  float64
+	burst float64
+}
+
+func newLimit(rate float64, burst int) limit {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return limit{rate: rate, burst: float64(burst)}
+}
+
+// Limiter limits the events of each deployment and instance using token
+// buckets and caps the number of distinct metric names and tag values
+// per deployment.
+// Limits that are not configured are not enforced.
+type Limiter struct {
+	deploymentLimit limit
+	instanceLimit   limit
+	maxMetricNames  int
+	maxTagValues    int
+	window          time.Duration
+	now             func() time.Time
+	director        string
+	logger          *slog.Logger
+
+	mu          sync.Mutex
+	deployments map[string]*deployment
+	lastSweep   time.Time
+}
+
+type LimiterOpt func(*Limiter)
+
+// WithDeploymentLimit limits the events of each deployment to rate per
+// second, allowing bursts of up to burst events.
+// A burst below one is treated as one.
+func WithDeploymentLimit(rate float64, burst int) LimiterOpt {
+	return func(l *Limiter) {
+		l.deploymentLimit = newLimit(rate, burst)
+	}
+}
+
+// WithInstanceLimit limits the events of each instance to rate per second,
+// allowing bursts of up to burst events.
+// A burst below one is treated as one.
+func WithInstanceLimit(rate float64, burst int) LimiterOpt {
+	return func(l *Limiter) {
+		l.instanceLimit = newLimit(rate, burst)
+	}
+}
+
+// WithMaxMetricNames caps the number of distinct metric names per
+// deployment. Metrics with names beyond the cap are removed from events.
+func WithMaxMetricNames(n int) LimiterOpt {
+	return func(l *Limiter) {
+		l.maxMetricNames = n
+	}
+}
+
+// WithMaxTagValues caps the number of distinct values of each metric tag
+// per deployment. Events carrying values beyond the cap are dropped.
+// The job and instance id are not capped.
+func WithMaxTagValues(n int) LimiterOpt {
+	return func(l *Limiter) {
+		l.maxTagValues = n
+	}
+}
+
+// WithCardinalityWindow sets how long a metric name, tag value or instance
+// is remembered after it was last seen.
+func WithCardinalityWindow(d time.Duration) LimiterOpt {
+	return func(l *Limiter) {
+		l.window = d
+	}
+}
+
+// WithDirector sets the name of the director whose events are limited.
+// The name is used to label the drop metrics.
+func WithDirector(name string) LimiterOpt {
+	return func(l *Limiter) {
+		l.director = name
+	}
+}
+
+// WithLogger logs the deployments whose events are dropped, at most once
+// a minute per deployment.
+func WithLogger(logger *slog.Logger) LimiterOpt {
+	return func(l *Limiter) {
+		l.logger = logger
+	}
+}
+
+// WithClock sets the function used to tell the current time.
+func WithClock(now func() time.Time) LimiterOpt {
+	return func(l *Limiter) {
+		l.now = now
+	}
+}
+
+// New returns a new Limiter.
+func New(opts ...LimiterOpt) *Limiter {
+	l := &Limiter{
+		window:      time.Hour,
+		now:         time.Now,
+		deployments: make(map[string]*deployment),
+	}
+
+	for _, o := range opts {
+		o(l)
+	}
+
+	l.lastSweep = l.now()
+
+	return l
+}
+
+// Filter returns false if the event exceeds the limits of its deployment or
+// instance. It removes metrics from the event whose names exceed the metric
+// name cap of the deployment.
+func (l *Limiter) Filter(event *definitions.Event) (*definitions.Event, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	name := event.GetDeployment()
+	d, ok := l.deployments[name]
+	if !ok {
+		d = newDeployment(l.deploymentLimit, now)
+		l.deployments[name] = d
+	}
+	d.lastSeen = now
+
+	hb := event.GetHeartbeat()
+	if !l.allowTags(d, event, now) {
+		l.drop(d, name, reasonTagCardinality, now)
+		return nil, false
+	}
+
+	if l.deploymentLimit.rate > 0 && !d.bucket.take(now) {
+		l.drop(d, name, reasonDeploymentRate, now)
+		return nil, false
+	}
+
+	if l.instanceLimit.rate > 0 && hb != nil {
+		b, ok := d.instances[hb.GetInstanceId()]
+		if !ok {
+			b = newBucket(l.instanceLimit, now)
+			d.instances[hb.GetInstanceId()] = b
+		}
+		if !b.take(now) {
+			l.drop(d, name, reasonInstanceRate, now)
+			return nil, false
+		}
+	}
+
+	if l.maxMetricNames <= 0 || hb == nil {
+		return event, true
+	}
+
+	metrics := make([]*definitions.Heartbeat_Metric, 0, len(hb.GetMetrics()))
+	for _, m := range hb.GetMetrics() {
+		if !admit(d.metricNames, m.GetName(), l.maxMetricNames, now) {
+			l.drop(d, name, reasonMetricCardinality, now)
+			continue
+		}
+		metrics = append(metrics, m)
+	}
+
+	if len(metrics) == len(hb.GetMetrics()) {
+		return event, true
+	}
+
+	if len(metrics) == 0 {
+		return nil, false
+	}
+
+	limited := *hb
+	limited.Metrics = metrics
+	return &definitions.Event{
+		Timestamp:  event.GetTimestamp(),
+		Id:         event.GetId(),
+		Deployment: event.GetDeployment(),
+		Message:    &definitions.Event_Heartbeat{Heartbeat: &limited},
+	}, true
+}
+
+// drop counts an event or metric dropped for the reason and logs the
+// deployment unless it was logged within the log interval.
+func (l *Limiter) drop(d *deployment, name, reason string, now time.Time) {
+	droppedCounter.WithLabelValues(l.director, reason).Inc()
+
+	if l.logger == nil || now.Sub(d.lastLogged) < logInterval {
+		return
+	}
+	d.lastLogged = now
+	l.logger.Warn("dropping events of deployment exceeding the limits", "deployment", name, "reason", reason)
+}
+
+// allowTags reports whether all metric tag values of the event are within
+// the tag value cap of the deployment. The values are only recorded if the
+// event is allowed, so that a dropped event does not use up the cap.
+func (l *Limiter) allowTags(d *deployment, event *definitions.Event, now time.Time) bool {
+	if l.maxTagValues <= 0 {
+		return true
+	}
+
+	tags := make(map[string]map[string]bool)
+	for _, m := range event.GetHeartbeat().GetMetrics() {
+		for k, v := range m.GetTags() {
+			if tags[k] == nil {
+				tags[k] = make(map[string]bool)
+			}
+			tags[k][v] = true
+		}
+	}
+
+	for k, values := range tags {
+		seen := d.tagValues[k]
+		unseen := 0
+		for v := range values {
+			if _, ok := seen[v]; !ok {
+				unseen++
+			}
+		}
+		if len(seen)+unseen > l.maxTagValues {
+			return false
+		}
+	}
+
+	for k, values := range tags {
+		seen, ok := d.tagValues[k]
+		if !ok {
+			seen = make(map[string]time.Time)
+			d.tagValues[k] = seen
+		}
+		for v := range values {
+			seen[v] = now
+		}
+	}
+
+	return true
+}
+
+// sweep forgets the deployments, instances, metric names and tag values
+// that have not been seen within the window.
+// It runs at most once per minute.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	cutoff := now.Add(-l.window)
+	for name, d := range l.deployments {
+		if d.lastSeen.Before(cutoff) {
+			delete(l.deployments, name)
+			continue
+		}
+
+		for id, b := range d.instances {
+			if b.last.Before(cutoff) {
+				delete(d.instances, id)
+			}
+		}
+		expire(d.metricNames, cutoff)
+		for _, values := range d.tagValues {
+			expire(values, cutoff)
+		}
+	}
+}
+
+type deployment struct {
+	lastSeen    time.Time
+	lastLogged  time.Time
+	bucket      *bucket
+	instances   map[string]*bucket
+	metricNames map[string]time.Time
+	tagValues   map[string]map[string]time.Time
+}
+
+func newDeployment(lim limit, now time.Time) *deployment {
+	return &deployment{
+		bucket:      newBucket(lim, now),
+		instances:   make(map[string]*bucket),
+		metricNames: make(map[string]time.Time),
+		tagValues:   make(map[string]map[string]time.Time),
+	}
+}
+
+// admit records that value was seen and reports whether it is within the
+// max distinct values of seen.
+func admit(seen map[string]time.Time, value string, max int, now time.Time) bool {
+	if _, ok := seen[value]; !ok && len(seen) >= max {
+		return false
+	}
+	seen[value] = now
+
+	return true
+}
+
+func expire(seen map[string]time.Time, cutoff time.Time) {
+	for v, t := range seen {
+		if t.Before(cutoff) {
+			delete(seen, v)
+		}
+	}
+}
+
+type bucket struct {
+	limit
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(lim limit, now time.Time) *bucket {
+	return &bucket{
+		limit:  lim,
+		tokens: lim.burst,
+		last:   now,
+	}
+}
+
+func (b *bucket) take(now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+
+	return true
+}
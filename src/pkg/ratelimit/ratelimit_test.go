@@ -0,0 +1,211 @@
+package ratelimit_test
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/ratelimit"
+	. "github.com/onsi/gomega"
+)
+
+func TestLimiterAllowsEverythingWithoutLimits(t *testing.T) {
+	RegisterTestingT(t)
+
+	l := ratelimit.New()
+
+	for n := 0; n < 100; n++ {
+		_, ok := l.Filter(heartbeat("cf", "router", "id-1", "system.healthy"))
+		Expect(ok).To(BeTrue())
+	}
+}
+
+func TestLimiterLimitsEventsPerDeployment(t *testing.T) {
+	RegisterTestingT(t)
+
+	clock := newFakeClock()
+	l := ratelimit.New(ratelimit.WithDeploymentLimit(1, 2), ratelimit.WithClock(clock.Now))
+
+	Expect(allowed(l, heartbeat("cf", "router", "id-1", "system.healthy"), 5)).To(Equal(2))
+	Expect(allowed(l, heartbeat("redis", "redis", "id-2", "system.healthy"), 5)).To(Equal(2))
+
+	clock.Advance(time.Second)
+
+	Expect(allowed(l, heartbeat("cf", "router", "id-1", "system.healthy"), 5)).To(Equal(1))
+}
+
+func TestLimiterLimitsEventsPerInstance(t *testing.T) {
+	RegisterTestingT(t)
+
+	clock := newFakeClock()
+	l := ratelimit.New(ratelimit.WithInstanceLimit(1, 1), ratelimit.WithClock(clock.Now))
+
+	Expect(allowed(l, heartbeat("cf", "router", "id-1", "system.healthy"), 5)).To(Equal(1))
+	Expect(allowed(l, heartbeat("cf", "router", "id-2", "system.healthy"), 5)).To(Equal(1))
+}
+
+func TestLimiterCapsMetricNamesPerDeployment(t *testing.T) {
+	RegisterTestingT(t)
+
+	l := ratelimit.New(ratelimit.WithMaxMetricNames(2))
+
+	event, ok := l.Filter(heartbeat("cf", "router", "id-1", "system.healthy", "system.cpu.user", "custom.metric"))
+	Expect(ok).To(BeTrue())
+	Expect(metricNames(event)).To(Equal([]string{"system.healthy", "system.cpu.user"}))
+
+	_, ok = l.Filter(heartbeat("cf", "router", "id-1", "other.metric"))
+	Expect(ok).To(BeFalse())
+
+	event, ok = l.Filter(heartbeat("redis", "redis", "id-2", "custom.metric"))
+	Expect(ok).To(BeTrue())
+	Expect(metricNames(event)).To(Equal([]string{"custom.metric"}))
+}
+
+func TestLimiterCapsTagValuesPerDeployment(t *testing.T) {
+	RegisterTestingT(t)
+
+	l := ratelimit.New(ratelimit.WithMaxTagValues(2))
+
+	for n := 0; n < 2; n++ {
+		_, ok := l.Filter(tagged("cf", "id-1", map[string]string{"path": fmt.Sprintf("/%d", n)}))
+		Expect(ok).To(BeTrue())
+	}
+
+	_, ok := l.Filter(tagged("cf", "id-1", map[string]string{"path": "/3"}))
+	Expect(ok).To(BeFalse())
+
+	_, ok = l.Filter(tagged("cf", "id-1", map[string]string{"path": "/1"}))
+	Expect(ok).To(BeTrue())
+
+	_, ok = l.Filter(tagged("redis", "id-1", map[string]string{"path": "/3"}))
+	Expect(ok).To(BeTrue())
+}
+
+func TestLimiterDoesNotCapJobsAndInstances(t *testing.T) {
+	RegisterTestingT(t)
+
+	l := ratelimit.New(ratelimit.WithMaxTagValues(1))
+
+	for n := 0; n < 3; n++ {
+		_, ok := l.Filter(heartbeat("cf", fmt.Sprintf("job-%d", n), fmt.Sprintf("id-%d", n), "system.healthy"))
+		Expect(ok).To(BeTrue())
+	}
+}
+
+func TestLimiterDoesNotRecordTagValuesOfDroppedEvents(t *testing.T) {
+	RegisterTestingT(t)
+
+	l := ratelimit.New(ratelimit.WithMaxTagValues(1))
+
+	_, ok := l.Filter(tagged("cf", "id-1", map[string]string{"path": "/1"}))
+	Expect(ok).To(BeTrue())
+
+	_, ok = l.Filter(tagged("cf", "id-1", map[string]string{"path": "/2", "method": "GET"}))
+	Expect(ok).To(BeFalse())
+
+	_, ok = l.Filter(tagged("cf", "id-1", map[string]string{"path": "/1", "method": "POST"}))
+	Expect(ok).To(BeTrue())
+}
+
+func TestLimiterForgetsValuesOutsideWindow(t *testing.T) {
+	RegisterTestingT(t)
+
+	clock := newFakeClock()
+	l := ratelimit.New(
+		ratelimit.WithMaxTagValues(1),
+		ratelimit.WithCardinalityWindow(time.Minute),
+		ratelimit.WithClock(clock.Now),
+	)
+
+	_, ok := l.Filter(tagged("cf", "id-1", map[string]string{"path": "/1"}))
+	Expect(ok).To(BeTrue())
+	_, ok = l.Filter(tagged("cf", "id-1", map[string]string{"path": "/2"}))
+	Expect(ok).To(BeFalse())
+
+	clock.Advance(2 * time.Minute)
+
+	_, ok = l.Filter(tagged("cf", "id-1", map[string]string{"path": "/2"}))
+	Expect(ok).To(BeTrue())
+}
+
+func TestLimiterLogsDroppingDeploymentsOncePerInterval(t *testing.T) {
+	RegisterTestingT(t)
+
+	var buf bytes.Buffer
+	clock := newFakeClock()
+	l := ratelimit.New(
+		ratelimit.WithDeploymentLimit(0.001, 1),
+		ratelimit.WithLogger(slog.New(slog.NewTextHandler(&buf, nil))),
+		ratelimit.WithClock(clock.Now),
+	)
+
+	Expect(allowed(l, heartbeat("cf", "router", "id-1"), 3)).To(Equal(1))
+	Expect(strings.Count(buf.String(), "dropping events")).To(Equal(1))
+	Expect(buf.String()).To(ContainSubstring("deployment=cf reason=deployment_rate"))
+
+	clock.Advance(time.Minute)
+	allowed(l, heartbeat("cf", "router", "id-1"), 2)
+	Expect(strings.Count(buf.String(), "dropping events")).To(Equal(2))
+}
+
+func allowed(l *ratelimit.Limiter, event *definitions.Event, n int) int {
+	var count int
+	for i := 0; i < n; i++ {
+		if _, ok := l.Filter(event); ok {
+			count++
+		}
+	}
+
+	return count
+}
+
+func heartbeat(deployment, job, instanceID string, metrics ...string) *definitions.Event {
+	hb := &definitions.Heartbeat{
+		Job:        job,
+		InstanceId: instanceID,
+	}
+	for _, m := range metrics {
+		hb.Metrics = append(hb.Metrics, &definitions.Heartbeat_Metric{Name: m, Value: 1})
+	}
+
+	return &definitions.Event{
+		Deployment: deployment,
+		Message:    &definitions.Event_Heartbeat{Heartbeat: hb},
+	}
+}
+
+func tagged(deployment, instanceID string, tags map[string]string) *definitions.Event {
+	event := heartbeat(deployment, "router", instanceID, "system.healthy")
+	event.GetHeartbeat().Metrics[0].Tags = tags
+
+	return event
+}
+
+func metricNames(event *definitions.Event) []string {
+	var names []string
+	for _, m := range event.GetHeartbeat().GetMetrics() {
+		names = append(names, m.GetName())
+	}
+
+	return names
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1499293724, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
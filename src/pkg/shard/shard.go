@@ -0,0 +1,223 @@
+package shard
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/definitions"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	skippedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "shard",
+		Name:      "skipped",
+		Help:      "Tracks the number of events skipped because their deployment belongs to another shard",
+	})
+	ownedGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "shard",
+		Name:      "owned",
+		Help:      "The number of shards currently forwarded by this instance",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(skippedCounter)
+	prometheus.MustRegister(ownedGauge)
+}
+
+// Sharder splits deployments across forwarder instances by hashing the
+// director and deployment name. Each instance keeps the events of the deployments that
+// hash to its index.
+// A standby Sharder can additionally take over the shards of peers that
+// are down.
+type Sharder struct {
+	index   int
+	total   int
+	standby bool
+
+	mu    sync.RWMutex
+	owned map[int]bool
+}
+
+type SharderOpt func(*Sharder)
+
+// WithStandby allows the Sharder to take over the shards of its peers.
+func WithStandby() SharderOpt {
+	return func(s *Sharder) {
+		s.standby = true
+	}
+}
+
+// New returns a new Sharder for the instance with the given index out of
+// total instances.
+// It returns an error if the index is not within total.
+func New(index, total int, opts ...SharderOpt) (*Sharder, error) {
+	if total < 1 {
+		return nil, fmt.Errorf("shard total must be at least 1, got %d", total)
+	}
+	if index < 0 || index >= total {
+		return nil, fmt.Errorf("shard index must be between 0 and %d, got %d", total-1, index)
+	}
+
+	s := &Sharder{
+		index: index,
+		total: total,
+		owned: map[int]bool{index: true},
+	}
+
+	for _, o := range opts {
+		o(s)
+	}
+
+	ownedGauge.Set(1)
+
+	return s, nil
+}
+
+// Of returns the shard of the deployment of the director out of total
+// shards. Deployments of an unnamed director are hashed by their name only.
+func Of(director, deployment string, total int) int {
+	key := deployment
+	if director != "" {
+		key = director + "/" + deployment
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(total))
+}
+
+// Filter drops events.
+type Filter interface {
+	Filter(event *definitions.Event) (*definitions.Event, bool)
+}
+
+type directorFilter struct {
+	sharder  *Sharder
+	director string
+}
+
+func (f directorFilter) Filter(event *definitions.Event) (*definitions.Event, bool) {
+	return f.sharder.filter(f.director, event)
+}
+
+// Director returns a Filter dropping the events of the named director
+// whose deployments belong to shards that are not owned.
+func (s *Sharder) Director(name string) Filter {
+	return directorFilter{sharder: s, director: name}
+}
+
+// Filter returns false if the deployment of the event belongs to a shard
+// that is not owned.
+func (s *Sharder) Filter(event *definitions.Event) (*definitions.Event, bool) {
+	return s.filter("", event)
+}
+
+func (s *Sharder) filter(director string, event *definitions.Event) (*definitions.Event, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if !s.owned[Of(director, event.GetDeployment(), s.total)] {
+		skippedCounter.Inc()
+		return nil, false
+	}
+
+	return event, true
+}
+
+// TakeOver starts forwarding the deployments of the given shard.
+// It returns an error if the Sharder is not a standby or the shard does
+// not exist.
+func (s *Sharder) TakeOver(shard int) error {
+	if !s.standby {
+		return errors.New("not a standby")
+	}
+	if shard < 0 || shard >= s.total {
+		return fmt.Errorf("shard must be between 0 and %d, got %d", s.total-1, shard)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.owned[shard] = true
+	ownedGauge.Set(float64(len(s.owned)))
+
+	return nil
+}
+
+// Release stops forwarding the deployments of a shard that was taken over.
+// The own shard cannot be released.
+func (s *Sharder) Release(shard int) error {
+	if shard == s.index {
+		return errors.New("cannot release own shard")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.owned, shard)
+	ownedGauge.Set(float64(len(s.owned)))
+
+	return nil
+}
+
+// Status is the state of a Sharder as reported on the status endpoint.
+type Status struct {
+	Index   int   `json:"index"`
+	Total   int   `json:"total"`
+	Standby bool  `json:"standby"`
+	Owned   []int `json:"owned"`
+}
+
+// Status returns the state of the Sharder.
+func (s *Sharder) Status() Status {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	owned := make([]int, 0, len(s.owned))
+	for shard := range s.owned {
+		owned = append(owned, shard)
+	}
+	sort.Ints(owned)
+
+	return Status{
+		Index:   s.index,
+		Total:   s.total,
+		Standby: s.standby,
+		Owned:   owned,
+	}
+}
+
+// ServeHTTP writes the status of the Sharder as json.
+// PUT ?shard=N takes over shard N and DELETE ?shard=N releases it.
+func (s *Sharder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		shard, err := strconv.Atoi(r.URL.Query().Get("shard"))
+		if err != nil {
+			http.Error(w, "shard is required", http.StatusBadRequest)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPut:
+			err = s.TakeOver(shard)
+		case http.MethodDelete:
+			err = s.Release(shard)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Status())
+}
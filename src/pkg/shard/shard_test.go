@@ -0,0 +1,143 @@
+package shard_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/shard"
+	. "github.com/onsi/gomega"
+)
+
+func TestFilterKeepsEachDeploymentOnExactlyOneShard(t *testing.T) {
+	RegisterTestingT(t)
+
+	var sharders []*shard.Sharder
+	for i := 0; i < 3; i++ {
+		s, err := shard.New(i, 3)
+		Expect(err).ToNot(HaveOccurred())
+		sharders = append(sharders, s)
+	}
+
+	for n := 0; n < 50; n++ {
+		deployment := fmt.Sprintf("deployment-%d", n)
+
+		var kept []int
+		for i, s := range sharders {
+			if _, ok := s.Filter(event(deployment)); ok {
+				kept = append(kept, i)
+			}
+		}
+		Expect(kept).To(Equal([]int{shard.Of("", deployment, 3)}), deployment)
+	}
+}
+
+func TestDirectorSpreadsDeploymentOfSameNameAcrossShards(t *testing.T) {
+	RegisterTestingT(t)
+
+	s, err := shard.New(0, 2)
+	Expect(err).ToNot(HaveOccurred())
+
+	kept := make(map[bool]bool)
+	for n := 0; n < 20; n++ {
+		director := fmt.Sprintf("bosh-%d", n)
+		_, ok := s.Director(director).Filter(event("cf"))
+		Expect(ok).To(Equal(shard.Of(director, "cf", 2) == 0), director)
+		kept[ok] = true
+	}
+	Expect(kept).To(HaveLen(2))
+}
+
+func TestTakeOverKeepsPeerDeployments(t *testing.T) {
+	RegisterTestingT(t)
+
+	s, err := shard.New(0, 2, shard.WithStandby())
+	Expect(err).ToNot(HaveOccurred())
+
+	peer := peerDeployment(0, 2)
+	_, ok := s.Filter(event(peer))
+	Expect(ok).To(BeFalse())
+
+	Expect(s.TakeOver(1)).To(Succeed())
+	_, ok = s.Filter(event(peer))
+	Expect(ok).To(BeTrue())
+
+	Expect(s.Release(1)).To(Succeed())
+	_, ok = s.Filter(event(peer))
+	Expect(ok).To(BeFalse())
+}
+
+func TestTakeOverRequiresStandby(t *testing.T) {
+	RegisterTestingT(t)
+
+	s, err := shard.New(0, 2)
+	Expect(err).ToNot(HaveOccurred())
+
+	Expect(s.TakeOver(1)).ToNot(Succeed())
+}
+
+func TestReleaseOwnShardFails(t *testing.T) {
+	RegisterTestingT(t)
+
+	s, err := shard.New(0, 2, shard.WithStandby())
+	Expect(err).ToNot(HaveOccurred())
+
+	Expect(s.Release(0)).ToNot(Succeed())
+}
+
+func TestNewWithInvalidIndex(t *testing.T) {
+	RegisterTestingT(t)
+
+	_, err := shard.New(2, 2)
+	Expect(err).To(HaveOccurred())
+
+	_, err = shard.New(-1, 2)
+	Expect(err).To(HaveOccurred())
+
+	_, err = shard.New(0, 0)
+	Expect(err).To(HaveOccurred())
+}
+
+func TestServeHTTP(t *testing.T) {
+	RegisterTestingT(t)
+
+	s, err := shard.New(0, 3, shard.WithStandby())
+	Expect(err).ToNot(HaveOccurred())
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/shards?shard=2", nil))
+	Expect(rec.Code).To(Equal(http.StatusOK))
+
+	var status shard.Status
+	Expect(json.Unmarshal(rec.Body.Bytes(), &status)).To(Succeed())
+	Expect(status).To(Equal(shard.Status{Index: 0, Total: 3, Standby: true, Owned: []int{0, 2}}))
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/shards?shard=5", nil))
+	Expect(rec.Code).To(Equal(http.StatusConflict))
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/shards", nil))
+	Expect(rec.Code).To(Equal(http.StatusBadRequest))
+}
+
+func peerDeployment(index, total int) string {
+	for n := 0; ; n++ {
+		d := fmt.Sprintf("deployment-%d", n)
+		if shard.Of("", d, total) != index {
+			return d
+		}
+	}
+}
+
+func event(deployment string) *definitions.Event {
+	return &definitions.Event{
+		Deployment: deployment,
+		Message: &definitions.Event_Heartbeat{
+			Heartbeat: &definitions.Heartbeat{},
+		},
+	}
+}
@@ -0,0 +1,81 @@
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+)
+
+// Supervisor runs a group of components until the first of them fails.
+// It is modelled after errgroup: the context of the components is
+// cancelled once a component returns an error or panics, and Wait returns
+// the first error.
+type Supervisor struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	logger *slog.Logger
+
+	wg   sync.WaitGroup
+	once sync.Once
+	err  error
+}
+
+// New returns a Supervisor whose components run until ctx is done or one
+// of them fails.
+func New(ctx context.Context, l *slog.Logger) *Supervisor {
+	ctx, cancel := context.WithCancel(ctx)
+
+	return &Supervisor{
+		ctx:    ctx,
+		cancel: cancel,
+		logger: l,
+	}
+}
+
+// Context returns the context passed to the components. It is done once
+// the parent context is done or a component failed.
+func (s *Supervisor) Context() context.Context {
+	return s.ctx
+}
+
+// Go runs the named component in a new goroutine. Components are expected
+// to return once their context is done. Errors returned after the context
+// is done are ignored if they are the error of the context.
+func (s *Supervisor) Go(name string, run func(ctx context.Context) error) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		err := s.run(run)
+		if err == nil || (s.ctx.Err() != nil && errors.Is(err, s.ctx.Err())) {
+			return
+		}
+
+		s.logger.Error("component failed", "component", name, "error", err)
+		s.once.Do(func() {
+			s.err = fmt.Errorf("%s: %w", name, err)
+			s.cancel()
+		})
+	}()
+}
+
+func (s *Supervisor) run(run func(ctx context.Context) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	return run(s.ctx)
+}
+
+// Wait blocks until all components returned. It returns the first error
+// of a component.
+func (s *Supervisor) Wait() error {
+	s.wg.Wait()
+	s.cancel()
+
+	return s.err
+}
@@ -0,0 +1,75 @@
+package supervisor_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/logging"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/supervisor"
+	. "github.com/onsi/gomega"
+)
+
+func TestWaitReturnsNilOnceContextIsDone(t *testing.T) {
+	RegisterTestingT(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := supervisor.New(ctx, logging.Discard())
+	for _, name := range []string{"a", "b"} {
+		s.Go(name, func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		})
+	}
+
+	cancel()
+
+	Expect(s.Wait()).To(Succeed())
+}
+
+func TestFailureStopsAllComponents(t *testing.T) {
+	RegisterTestingT(t)
+
+	s := supervisor.New(context.Background(), logging.Discard())
+	stopped := make(chan struct{})
+	s.Go("ingress", func(ctx context.Context) error {
+		<-ctx.Done()
+		close(stopped)
+		return nil
+	})
+	s.Go("egress", func(ctx context.Context) error {
+		return errors.New("metron is down")
+	})
+
+	Expect(s.Wait()).To(MatchError("egress: metron is down"))
+	Expect(stopped).To(BeClosed())
+	Expect(s.Context().Err()).To(HaveOccurred())
+}
+
+func TestWaitReturnsFirstError(t *testing.T) {
+	RegisterTestingT(t)
+
+	s := supervisor.New(context.Background(), logging.Discard())
+	first := errors.New("first")
+	s.Go("a", func(ctx context.Context) error {
+		return first
+	})
+	s.Go("b", func(ctx context.Context) error {
+		<-ctx.Done()
+		return errors.New("second")
+	})
+
+	err := s.Wait()
+	Expect(errors.Is(err, first)).To(BeTrue())
+}
+
+func TestPanicIsReturnedAsError(t *testing.T) {
+	RegisterTestingT(t)
+
+	s := supervisor.New(context.Background(), logging.Discard())
+	s.Go("tagger", func(ctx context.Context) error {
+		panic("boom")
+	})
+
+	Expect(s.Wait()).To(MatchError("tagger: panic: boom"))
+}
@@ -0,0 +1,197 @@
+package tail
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/loggregator_v2"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/mapper"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/tap"
+)
+
+const rowFormat = "%-20s  %-20s  %-20s  %-36s  %-36s  %s\n"
+
+type converter func(event *definitions.Event) (*loggregator_v2.Envelope, error)
+
+// Printer writes heartbeats and alerts either as json lines or as a table
+// with a row per metric.
+// The json lines have the same layout as the records of the event tap.
+type Printer struct {
+	w          io.Writer
+	format     string
+	deployment string
+	job        string
+	convert    converter
+
+	mu sync.Mutex
+}
+
+type PrinterOpt func(*Printer)
+
+// WithDeployment only prints the events of deployments matching the glob.
+func WithDeployment(glob string) PrinterOpt {
+	return func(p *Printer) {
+		p.deployment = glob
+	}
+}
+
+// WithJob only prints the heartbeats of jobs matching the glob.
+func WithJob(glob string) PrinterOpt {
+	return func(p *Printer) {
+		p.job = glob
+	}
+}
+
+// WithMapper prints the envelopes the events are converted to by convert
+// rather than the events.
+func WithMapper(convert converter) PrinterOpt {
+	return func(p *Printer) {
+		p.convert = convert
+	}
+}
+
+// NewPrinter returns a Printer that writes to w in the given format,
+// either json or table.
+// It returns an error if the format or a filter is invalid.
+func NewPrinter(w io.Writer, format string, opts ...PrinterOpt) (*Printer, error) {
+	p := &Printer{
+		w:      w,
+		format: format,
+	}
+
+	for _, o := range opts {
+		o(p)
+	}
+
+	if format != "json" && format != "table" {
+		return nil, fmt.Errorf("invalid format %q, expected json or table", format)
+	}
+
+	for _, g := range []string{p.deployment, p.job} {
+		if _, err := path.Match(g, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %s", g, err)
+		}
+	}
+
+	return p, nil
+}
+
+// Header writes the column names of the table format.
+func (p *Printer) Header() {
+	if p.format != "table" {
+		return
+	}
+
+	fmt.Fprintf(p.w, rowFormat, "TIME", "DEPLOYMENT", "JOB", "ID", "METRIC", "VALUE")
+}
+
+// Print writes the event received from the director if it matches the
+// filters.
+func (p *Printer) Print(director string, event *definitions.Event) error {
+	if !p.matches(event) {
+		return nil
+	}
+
+	r := tap.Record{
+		Time:     time.Now(),
+		Director: director,
+		Event:    event,
+	}
+	if p.convert != nil {
+		envelope, err := p.convert(event)
+		if err != nil {
+			r.Error = err.Error()
+		}
+		r.Envelope = envelope
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.format == "json" {
+		b, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(p.w, "%s\n", b)
+		return err
+	}
+
+	return p.printRows(r)
+}
+
+func (p *Printer) printRows(r tap.Record) error {
+	ts := time.Unix(r.Event.GetTimestamp(), 0).UTC().Format(time.RFC3339)
+	deployment := r.Event.GetDeployment()
+
+	if a := r.Event.GetAlert(); a != nil {
+		_, err := fmt.Fprintf(p.w, rowFormat, ts, deployment, "-", a.GetSource(), "alert", fmt.Sprintf("severity %d: %s", a.GetSeverity(), a.GetTitle()))
+		return err
+	}
+
+	hb := r.Event.GetHeartbeat()
+	if hb == nil {
+		return nil
+	}
+
+	var rows [][2]string
+	switch {
+	case r.Error != "":
+		rows = append(rows, [2]string{"error", r.Error})
+	case p.convert != nil:
+		for name, v := range r.Envelope.GetGauge().GetMetrics() {
+			rows = append(rows, [2]string{name, formatValue(v.GetValue(), v.GetUnit())})
+		}
+	default:
+		for _, m := range hb.GetMetrics() {
+			rows = append(rows, [2]string{m.GetName(), formatValue(m.GetValue(), mapper.Unit(m.GetName()))})
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i][0] < rows[j][0] })
+
+	for _, row := range rows {
+		_, err := fmt.Fprintf(p.w, rowFormat, ts, deployment, hb.GetJob(), hb.GetInstanceId(), row[0], row[1])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *Printer) matches(event *definitions.Event) bool {
+	if !globOrAny(p.deployment, event.GetDeployment()) {
+		return false
+	}
+
+	if p.job == "" {
+		return true
+	}
+
+	hb := event.GetHeartbeat()
+	return hb != nil && globOrAny(p.job, hb.GetJob())
+}
+
+func formatValue(value float64, unit string) string {
+	v := strconv.FormatFloat(value, 'f', -1, 64)
+	if unit == "" {
+		return v
+	}
+
+	return v + " " + unit
+}
+
+func globOrAny(pattern, s string) bool {
+	if pattern == "" {
+		return true
+	}
+	ok, _ := path.Match(pattern, s)
+	return ok
+}
@@ -0,0 +1,115 @@
+package tail_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/mapper"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/tail"
+	. "github.com/onsi/gomega"
+)
+
+func TestPrintTable(t *testing.T) {
+	RegisterTestingT(t)
+
+	var buf bytes.Buffer
+	p, err := tail.NewPrinter(&buf, "table")
+	Expect(err).ToNot(HaveOccurred())
+
+	p.Header()
+	Expect(p.Print("", heartbeat("cf", "router"))).To(Succeed())
+	Expect(p.Print("", alert("cf"))).To(Succeed())
+
+	Expect(buf.String()).To(Equal("" +
+		"TIME                  DEPLOYMENT            JOB                   ID                                    METRIC                                VALUE\n" +
+		"2017-07-05T22:28:44Z  cf                    router                id-1                                  system.cpu.user                       1.5 Load\n" +
+		"2017-07-05T22:28:44Z  cf                    router                id-1                                  system.mem.kb                         2048 Kb\n" +
+		"2017-07-05T22:28:44Z  cf                    -                     director                              alert                                 severity 3: process down\n"))
+}
+
+func TestPrintMappedTable(t *testing.T) {
+	RegisterTestingT(t)
+
+	var buf bytes.Buffer
+	p, err := tail.NewPrinter(&buf, "table", tail.WithMapper(mapper.New("", mapper.WithUnitMode(mapper.BaseUnits))))
+	Expect(err).ToNot(HaveOccurred())
+
+	Expect(p.Print("", heartbeat("cf", "router"))).To(Succeed())
+	Expect(p.Print("", alert("cf"))).To(Succeed())
+
+	Expect(buf.String()).To(ContainSubstring("system.mem.bytes                      2097152 bytes\n"))
+	Expect(buf.String()).To(ContainSubstring("alert"))
+}
+
+func TestPrintJSON(t *testing.T) {
+	RegisterTestingT(t)
+
+	var buf bytes.Buffer
+	p, err := tail.NewPrinter(&buf, "json", tail.WithMapper(mapper.New("10.0.0.1")))
+	Expect(err).ToNot(HaveOccurred())
+
+	Expect(p.Print("director-1", heartbeat("cf", "router"))).To(Succeed())
+
+	Expect(buf.String()).To(ContainSubstring(`"director":"director-1"`))
+	Expect(buf.String()).To(ContainSubstring(`"deployment":"cf"`))
+	Expect(buf.String()).To(ContainSubstring(`"ip":"10.0.0.1"`))
+	Expect(buf.String()).To(HaveSuffix("}\n"))
+}
+
+func TestPrintFilters(t *testing.T) {
+	RegisterTestingT(t)
+
+	var buf bytes.Buffer
+	p, err := tail.NewPrinter(&buf, "json", tail.WithDeployment("cf-*"), tail.WithJob("router"))
+	Expect(err).ToNot(HaveOccurred())
+
+	Expect(p.Print("", heartbeat("redis", "router"))).To(Succeed())
+	Expect(p.Print("", heartbeat("cf-prod", "diego-cell"))).To(Succeed())
+	Expect(p.Print("", alert("cf-prod"))).To(Succeed())
+	Expect(buf.String()).To(BeEmpty())
+
+	Expect(p.Print("", heartbeat("cf-prod", "router"))).To(Succeed())
+	Expect(buf.String()).ToNot(BeEmpty())
+}
+
+func TestNewPrinterWithInvalidSettings(t *testing.T) {
+	RegisterTestingT(t)
+
+	_, err := tail.NewPrinter(&bytes.Buffer{}, "yaml")
+	Expect(err).To(HaveOccurred())
+
+	_, err = tail.NewPrinter(&bytes.Buffer{}, "json", tail.WithJob("["))
+	Expect(err).To(HaveOccurred())
+}
+
+func heartbeat(deployment, job string) *definitions.Event {
+	return &definitions.Event{
+		Timestamp:  1499293724,
+		Deployment: deployment,
+		Message: &definitions.Event_Heartbeat{
+			Heartbeat: &definitions.Heartbeat{
+				Job:        job,
+				InstanceId: "id-1",
+				Metrics: []*definitions.Heartbeat_Metric{
+					{Name: "system.mem.kb", Value: 2048},
+					{Name: "system.cpu.user", Value: 1.5},
+				},
+			},
+		},
+	}
+}
+
+func alert(deployment string) *definitions.Event {
+	return &definitions.Event{
+		Timestamp:  1499293724,
+		Deployment: deployment,
+		Message: &definitions.Event_Alert{
+			Alert: &definitions.Alert{
+				Severity: 3,
+				Title:    "process down",
+				Source:   "director",
+			},
+		},
+	}
+}
@@ -0,0 +1,284 @@
+package tap
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/loggregator_v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	subscribersGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "tap",
+		Name:      "subscribers",
+		Help:      "The number of clients currently tapping the event stream",
+	})
+	droppedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "tap",
+		Name:      "dropped",
+		Help:      "Tracks the number of records dropped because a tap client was too slow",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(subscribersGauge)
+	prometheus.MustRegister(droppedCounter)
+}
+
+// Record is an event received from the metrics server and the envelope
+// it was converted to.
+type Record struct {
+	Time     time.Time                `json:"time"`
+	Director string                   `json:"director,omitempty"`
+	Event    *definitions.Event       `json:"event"`
+	Envelope *loggregator_v2.Envelope `json:"envelope,omitempty"`
+	Error    string                   `json:"error,omitempty"`
+}
+
+type converter func(event *definitions.Event) (*loggregator_v2.Envelope, error)
+
+// Tap streams the events being forwarded and their envelopes to http
+// clients as server-sent events.
+// Clients may filter the stream with the deployment, job and metric query
+// parameters, which are globs, and sample it with the sample parameter, a
+// fraction between 0 and 1. Each client receives at most the max rate of
+// records per second and records are dropped rather than slowing down
+// forwarding when a client cannot keep up.
+type Tap struct {
+	maxRate float64
+
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+	active      atomic.Int32
+}
+
+type TapOpt func(*Tap)
+
+// WithMaxRate sets the maximum number of records per second sent to each
+// client.
+func WithMaxRate(perSecond float64) TapOpt {
+	return func(t *Tap) {
+		t.maxRate = perSecond
+	}
+}
+
+// New returns a new Tap.
+func New(opts ...TapOpt) *Tap {
+	t := &Tap{
+		maxRate:     10,
+		subscribers: make(map[*subscriber]struct{}),
+	}
+
+	for _, o := range opts {
+		o(t)
+	}
+
+	return t
+}
+
+// Wrap returns a converter that publishes every event of the director
+// converted by convert along with the result.
+func (t *Tap) Wrap(director string, convert converter) func(event *definitions.Event) (*loggregator_v2.Envelope, error) {
+	return func(event *definitions.Event) (*loggregator_v2.Envelope, error) {
+		envelope, err := convert(event)
+		if t.active.Load() == 0 {
+			return envelope, err
+		}
+
+		r := Record{
+			Time:     time.Now(),
+			Director: director,
+			Event:    event,
+			Envelope: envelope,
+		}
+		if err != nil {
+			r.Error = err.Error()
+		}
+		t.publish(r)
+
+		return envelope, err
+	}
+}
+
+func (t *Tap) publish(r Record) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for s := range t.subscribers {
+		if !s.accept(r) {
+			continue
+		}
+
+		select {
+		case s.records <- r:
+		default:
+			droppedCounter.Inc()
+		}
+	}
+}
+
+func (t *Tap) subscribe(s *subscriber) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.subscribers[s] = struct{}{}
+	t.active.Add(1)
+	subscribersGauge.Inc()
+}
+
+func (t *Tap) unsubscribe(s *subscriber) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.subscribers, s)
+	t.active.Add(-1)
+	subscribersGauge.Dec()
+}
+
+// ServeHTTP streams the records matching the query of the request until
+// the client disconnects.
+func (t *Tap) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	s, err := t.newSubscriber(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	t.subscribe(s)
+	defer t.unsubscribe(s)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case record := <-s.records:
+			b, err := json.Marshal(record)
+			if err != nil {
+				continue
+			}
+			_, err = fmt.Fprintf(w, "data: %s\n\n", b)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+type subscriber struct {
+	deployment string
+	job        string
+	metric     string
+	sample     float64
+	interval   time.Duration
+
+	// next is only accessed while the tap is locked.
+	next    time.Time
+	records chan Record
+}
+
+func (t *Tap) newSubscriber(r *http.Request) (*subscriber, error) {
+	q := r.URL.Query()
+	s := &subscriber{
+		deployment: q.Get("deployment"),
+		job:        q.Get("job"),
+		metric:     q.Get("metric"),
+		sample:     1,
+		records:    make(chan Record, 64),
+	}
+
+	for _, p := range []string{s.deployment, s.job, s.metric} {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %s", p, err)
+		}
+	}
+
+	if v := q.Get("sample"); v != "" {
+		sample, err := strconv.ParseFloat(v, 64)
+		if err != nil || sample <= 0 || sample > 1 {
+			return nil, fmt.Errorf("invalid sample %q, expected a fraction between 0 and 1", v)
+		}
+		s.sample = sample
+	}
+
+	if t.maxRate > 0 {
+		s.interval = time.Duration(float64(time.Second) / t.maxRate)
+	}
+
+	return s, nil
+}
+
+// accept reports whether the record matches the filters of the subscriber
+// and is within its sample and rate.
+func (s *subscriber) accept(r Record) bool {
+	if !s.matches(r.Event) {
+		return false
+	}
+
+	if s.sample < 1 && rand.Float64() >= s.sample {
+		return false
+	}
+
+	if s.interval > 0 {
+		if r.Time.Before(s.next) {
+			return false
+		}
+		s.next = r.Time.Add(s.interval)
+	}
+
+	return true
+}
+
+func (s *subscriber) matches(event *definitions.Event) bool {
+	if !globOrAny(s.deployment, event.GetDeployment()) {
+		return false
+	}
+
+	if s.job == "" && s.metric == "" {
+		return true
+	}
+
+	hb := event.GetHeartbeat()
+	if hb == nil || !globOrAny(s.job, hb.GetJob()) {
+		return false
+	}
+
+	if s.metric == "" {
+		return true
+	}
+	for _, m := range hb.GetMetrics() {
+		if globOrAny(s.metric, m.GetName()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func globOrAny(pattern, s string) bool {
+	if pattern == "" {
+		return true
+	}
+	ok, _ := path.Match(pattern, s)
+	return ok
+}
@@ -0,0 +1,118 @@
+package tap_test
+
+import (
+	"bufio"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/definitions"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/loggregator_v2"
+	"github.com/cloudfoundry/bosh-system-metrics-forwarder/pkg/tap"
+	. "github.com/onsi/gomega"
+)
+
+func TestWrapReturnsConvertedEnvelope(t *testing.T) {
+	RegisterTestingT(t)
+
+	envelope := &loggregator_v2.Envelope{SourceId: "source"}
+	convert := tap.New().Wrap("director", func(*definitions.Event) (*loggregator_v2.Envelope, error) {
+		return envelope, errors.New("some error")
+	})
+
+	e, err := convert(heartbeat("cf", "router", "system.cpu.user"))
+	Expect(e).To(Equal(envelope))
+	Expect(err).To(MatchError("some error"))
+}
+
+func TestServeHTTPStreamsMatchingRecords(t *testing.T) {
+	RegisterTestingT(t)
+
+	tp := tap.New(tap.WithMaxRate(0))
+	convert := tp.Wrap("director-1", func(*definitions.Event) (*loggregator_v2.Envelope, error) {
+		return &loggregator_v2.Envelope{SourceId: "source"}, nil
+	})
+
+	records := subscribe(t, tp, "?deployment=cf-*&job=router&metric=system.cpu.*")
+
+	convert(heartbeat("redis", "router", "system.cpu.user"))
+	convert(heartbeat("cf-prod", "diego-cell", "system.cpu.user"))
+	convert(heartbeat("cf-prod", "router", "system.mem.percent"))
+	convert(heartbeat("cf-prod", "router", "system.cpu.sys"))
+
+	var r string
+	Eventually(records).Should(Receive(&r))
+	Expect(r).To(ContainSubstring(`"director":"director-1"`))
+	Expect(r).To(ContainSubstring(`"deployment":"cf-prod"`))
+	Expect(r).To(ContainSubstring(`"name":"system.cpu.sys"`))
+	Expect(r).To(ContainSubstring(`"source_id":"source"`))
+	Consistently(records).ShouldNot(Receive())
+}
+
+func TestServeHTTPCapsRate(t *testing.T) {
+	RegisterTestingT(t)
+
+	tp := tap.New(tap.WithMaxRate(1))
+	convert := tp.Wrap("", func(*definitions.Event) (*loggregator_v2.Envelope, error) {
+		return nil, nil
+	})
+
+	records := subscribe(t, tp, "")
+	for i := 0; i < 10; i++ {
+		convert(heartbeat("cf", "router", "system.cpu.user"))
+	}
+
+	Eventually(records).Should(Receive())
+	Consistently(records, "200ms").ShouldNot(Receive())
+}
+
+func TestServeHTTPWithInvalidQuery(t *testing.T) {
+	RegisterTestingT(t)
+
+	for _, q := range []string{"?sample=0", "?sample=2", "?sample=some", "?job=["} {
+		rec := httptest.NewRecorder()
+		tap.New().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/tap"+q, nil))
+		Expect(rec.Code).To(Equal(http.StatusBadRequest), q)
+	}
+}
+
+// subscribe connects to the tap and returns the data of the records it
+// streams.
+func subscribe(t *testing.T, tp *tap.Tap, query string) <-chan string {
+	server := httptest.NewServer(tp)
+	t.Cleanup(server.Close)
+
+	resp, err := http.Get(server.URL + query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	records := make(chan string, 100)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+				records <- data
+			}
+		}
+	}()
+
+	return records
+}
+
+func heartbeat(deployment, job, metric string) *definitions.Event {
+	return &definitions.Event{
+		Deployment: deployment,
+		Message: &definitions.Event_Heartbeat{
+			Heartbeat: &definitions.Heartbeat{
+				Job: job,
+				Metrics: []*definitions.Heartbeat_Metric{
+					{Name: metric, Value: 1},
+				},
+			},
+		},
+	}
+}